@@ -0,0 +1,261 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An ACARS message, from acarsdec or dumpvdl2
+type acarsMessage struct {
+	time         time.Time
+	source       string
+	freq         sql.NullFloat64
+	hex          string
+	registration string
+	flight       string
+	mode         string
+	label        string
+	blockId      string
+	msgNum       string
+	text         string
+	departure    string
+	destination  string
+	outTime      sql.NullTime
+	offTime      sql.NullTime
+	onTime       sql.NullTime
+	inTime       sql.NullTime
+}
+
+// acarsdec -j / --output json
+type acarsdecJson struct {
+	Timestamp float64  `json:"timestamp"`
+	Freq      *float64 `json:"freq"`
+	Icao      *int64   `json:"icao"`
+	Tail      string   `json:"tail"`
+	Flight    string   `json:"flight"`
+	Mode      string   `json:"mode"`
+	Label     string   `json:"label"`
+	BlockId   string   `json:"block_id"`
+	MsgNo     string   `json:"msgno"`
+	Text      string   `json:"text"`
+	Depa      string   `json:"depa"`
+	Dsta      string   `json:"dsta"`
+	GateOut   string   `json:"gtout"`
+	WheelsOff string   `json:"wloff"`
+	WheelsOn  string   `json:"wlin"`
+	GateIn    string   `json:"gtin"`
+}
+
+// dumpvdl2 --output decoded:json
+type dumpvdl2Json struct {
+	Vdl2 struct {
+		T struct {
+			Sec  int64 `json:"sec"`
+			Usec int64 `json:"usec"`
+		} `json:"t"`
+		Freq *float64 `json:"freq"`
+		Avlc *struct {
+			Src   dumpvdl2Address `json:"src"`
+			Dst   dumpvdl2Address `json:"dst"`
+			Acars *struct {
+				Reg     string `json:"reg"`
+				Flight  string `json:"flight"`
+				Mode    string `json:"mode"`
+				Label   string `json:"label"`
+				BlkId   string `json:"blk_id"`
+				MsgNum  string `json:"msg_num"`
+				MsgText string `json:"msg_text"`
+			} `json:"acars"`
+		} `json:"avlc"`
+	} `json:"vdl2"`
+}
+
+type dumpvdl2Address struct {
+	Addr string `json:"addr"`
+	Type string `json:"type"`
+}
+
+// OOOI reports by label, with the text starting with the departure and
+// destination airports and the time, e.g. "EGLLKJFK1432"
+var (
+	oooiLabels = map[string]string{"QP": "out", "QQ": "off", "QR": "on", "QS": "in"}
+	oooiText   = regexp.MustCompile(`^([A-Z]{4})([A-Z]{4})\s*(\d{4})`)
+)
+
+func decodeAcarsdec(data []byte) (*acarsMessage, error) {
+
+	var raw acarsdecJson
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid acarsdec json: %w", err)
+	}
+
+	if raw.Timestamp == 0 {
+		return nil, fmt.Errorf("acarsdec message has no timestamp")
+	}
+
+	message := &acarsMessage{
+		time:         time.UnixMilli(int64(raw.Timestamp * 1000)),
+		source:       "acarsdec",
+		registration: normaliseRegistration(raw.Tail),
+		flight:       normaliseFlightNumber(raw.Flight),
+		mode:         raw.Mode,
+		label:        raw.Label,
+		blockId:      raw.BlockId,
+		msgNum:       raw.MsgNo,
+		text:         raw.Text,
+		departure:    strings.TrimSpace(raw.Depa),
+		destination:  strings.TrimSpace(raw.Dsta),
+	}
+
+	if raw.Freq != nil {
+		message.freq = validFloat(*raw.Freq)
+	}
+	if raw.Icao != nil {
+		message.hex = fmt.Sprintf("%06x", *raw.Icao)
+	}
+
+	// acarsdec has already pulled the OOOI times out of the messages it knows
+	message.outTime = oooiTime(message.time, raw.GateOut)
+	message.offTime = oooiTime(message.time, raw.WheelsOff)
+	message.onTime = oooiTime(message.time, raw.WheelsOn)
+	message.inTime = oooiTime(message.time, raw.GateIn)
+
+	parseOooi(message)
+
+	return message, nil
+}
+
+// Returns nil for frames without an ACARS message, e.g. link management
+func decodeDumpvdl2(data []byte) (*acarsMessage, error) {
+
+	var raw dumpvdl2Json
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid dumpvdl2 json: %w", err)
+	}
+
+	avlc := raw.Vdl2.Avlc
+	if avlc == nil || avlc.Acars == nil {
+		return nil, nil
+	}
+
+	message := &acarsMessage{
+		time:         time.Unix(raw.Vdl2.T.Sec, raw.Vdl2.T.Usec*1000),
+		source:       "dumpvdl2",
+		registration: normaliseRegistration(avlc.Acars.Reg),
+		flight:       normaliseFlightNumber(avlc.Acars.Flight),
+		mode:         avlc.Acars.Mode,
+		label:        avlc.Acars.Label,
+		blockId:      avlc.Acars.BlkId,
+		msgNum:       avlc.Acars.MsgNum,
+		text:         avlc.Acars.MsgText,
+	}
+
+	if raw.Vdl2.Freq != nil {
+		message.freq = validFloat(*raw.Vdl2.Freq / 1e6)
+	}
+
+	// Downlinks come from the aircraft, uplinks go to it
+	if avlc.Src.Type == "Aircraft" {
+		message.hex = strings.ToLower(avlc.Src.Addr)
+	} else if avlc.Dst.Type == "Aircraft" {
+		message.hex = strings.ToLower(avlc.Dst.Addr)
+	}
+
+	parseOooi(message)
+
+	return message, nil
+}
+
+// Reads the airports and time from a QP/QQ/QR/QS OOOI report, filling in
+// whatever the decoder didn't
+func parseOooi(message *acarsMessage) {
+
+	event, ok := oooiLabels[message.label]
+	if !ok {
+		return
+	}
+
+	match := oooiText.FindStringSubmatch(strings.TrimSpace(message.text))
+	if match == nil {
+		return
+	}
+
+	if message.departure == "" {
+		message.departure = match[1]
+	}
+	if message.destination == "" {
+		message.destination = match[2]
+	}
+
+	eventTime := oooiTime(message.time, match[3])
+	switch event {
+	case "out":
+		if !message.outTime.Valid {
+			message.outTime = eventTime
+		}
+	case "off":
+		if !message.offTime.Valid {
+			message.offTime = eventTime
+		}
+	case "on":
+		if !message.onTime.Valid {
+			message.onTime = eventTime
+		}
+	case "in":
+		if !message.inTime.Valid {
+			message.inTime = eventTime
+		}
+	}
+}
+
+// OOOI times are HHMM in UTC, on the day the message was sent unless that
+// would put them after it
+func oooiTime(sent time.Time, hhmm string) sql.NullTime {
+
+	hhmm = strings.ReplaceAll(strings.TrimSpace(hhmm), ":", "")
+	if len(hhmm) != 4 {
+		return sql.NullTime{}
+	}
+
+	hours, hoursErr := strconv.Atoi(hhmm[:2])
+	minutes, minutesErr := strconv.Atoi(hhmm[2:])
+	if hoursErr != nil || minutesErr != nil || hours > 23 || minutes > 59 {
+		return sql.NullTime{}
+	}
+
+	sent = sent.UTC()
+	eventTime := time.Date(sent.Year(), sent.Month(), sent.Day(), hours, minutes, 0, 0, time.UTC)
+	if eventTime.After(sent.Add(time.Hour)) {
+		eventTime = eventTime.AddDate(0, 0, -1)
+	}
+
+	return sql.NullTime{Time: eventTime, Valid: true}
+}
+
+// ACARS pads registrations with leading dots, e.g. ".G-EUPT"
+func normaliseRegistration(registration string) string {
+	return strings.ToUpper(strings.TrimLeft(strings.TrimSpace(registration), "."))
+}
+
+// ACARS flight numbers are the IATA airline code and a zero padded number,
+// e.g. BA0123. The padding is dropped to match adsbdb's IATA callsigns, e.g.
+// BA123, which is how messages are linked to the ADS-B callsign (BAW123).
+func normaliseFlightNumber(flight string) string {
+
+	flight = strings.ToUpper(strings.TrimSpace(flight))
+	if len(flight) < 3 {
+		return flight
+	}
+
+	number := strings.TrimLeft(flight[2:], "0")
+	if number == "" || number[0] < '0' || number[0] > '9' {
+		return flight
+	}
+
+	return flight[:2] + number
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	acarsMaxPacket = 64 * 1024
+	acarsTailPoll  = 1 * time.Second
+)
+
+// Messages received since the last updateAcarsMessages
+var acarsPending = struct {
+	mu       sync.Mutex
+	messages []acarsMessage
+	dropped  int
+}{}
+
+type acarsDecoder func(data []byte) (*acarsMessage, error)
+
+// Starts a listener for every entry in ACARS_SOURCES, a comma separated list
+// of decoder+url, e.g.
+//
+//	acarsdec+udp://0.0.0.0:5550,dumpvdl2+udp://0.0.0.0:5552
+//
+// file:// urls are tailed instead, e.g. dumpvdl2+file:///var/log/vdl2.json,
+// for decoders writing to a file. They stop when ctx is cancelled.
+func startAcarsSources(ctx context.Context) error {
+
+	sources := config.Acars.Sources
+	if sources == "" {
+		return nil
+	}
+
+	type acarsSource struct {
+		decoder acarsDecoder
+		label   string
+		url     string
+	}
+	var parsed []acarsSource
+
+	for _, entry := range strings.Split(sources, ",") {
+
+		entry = strings.TrimSpace(entry)
+		format, url, found := strings.Cut(entry, "+")
+		if !found {
+			return fmt.Errorf("invalid ACARS_SOURCES entry %q, expected acarsdec+url or dumpvdl2+url", entry)
+		}
+
+		var decoder acarsDecoder
+		switch format {
+		case "acarsdec":
+			decoder = decodeAcarsdec
+		case "dumpvdl2":
+			decoder = decodeDumpvdl2
+		default:
+			return fmt.Errorf("invalid ACARS_SOURCES entry %q, %q is not acarsdec or dumpvdl2", entry, format)
+		}
+
+		if !strings.HasPrefix(url, "udp://") && !strings.HasPrefix(url, "file://") {
+			return fmt.Errorf("invalid ACARS_SOURCES entry %q, expected a udp:// or file:// url", entry)
+		}
+
+		parsed = append(parsed, acarsSource{decoder: decoder, label: format, url: url})
+	}
+
+	for _, source := range parsed {
+		if addr, ok := strings.CutPrefix(source.url, "udp://"); ok {
+			conn, err := net.ListenPacket("udp", addr)
+			if err != nil {
+				return fmt.Errorf("unable to listen for %s on %s: %w", source.label, addr, err)
+			}
+			acarsLog.Info("Listening for messages", "source", source.label, "addr", addr)
+			go listenAcars(ctx, source.label, conn, source.decoder)
+		} else {
+			path := strings.TrimPrefix(source.url, "file://")
+			acarsLog.Info("Reading messages", "source", source.label, "path", path)
+			go tailAcars(ctx, source.label, path, source.decoder)
+		}
+	}
+
+	return nil
+}
+
+func listenAcars(ctx context.Context, label string, conn net.PacketConn, decode acarsDecoder) {
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buffer := make([]byte, acarsMaxPacket)
+
+	for {
+		n, _, err := conn.ReadFrom(buffer)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			acarsLog.Warn("Unable to read udp", "source", label, "error", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		// A datagram holds one message, or several on separate lines
+		for _, line := range bytes.Split(buffer[:n], []byte("\n")) {
+			handleAcarsLine(label, line, decode)
+		}
+	}
+}
+
+// Follows a file of json lines from its end, like tail -F, reopening it when
+// it is rotated or truncated
+func tailAcars(ctx context.Context, label string, path string, decode acarsDecoder) {
+
+	var file *os.File
+	var reader *bufio.Reader
+	var offset int64
+
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	for ctx.Err() == nil {
+		if file == nil {
+			f, err := os.Open(path)
+			if err != nil {
+				time.Sleep(acarsTailPoll * 5)
+				continue
+			}
+			// Only new messages, unless this is a new file after rotation
+			if reader == nil {
+				offset, _ = f.Seek(0, io.SeekEnd)
+			} else {
+				offset = 0
+			}
+			file, reader = f, bufio.NewReader(f)
+		}
+
+		line, err := reader.ReadBytes('\n')
+		if err == nil {
+			offset += int64(len(line))
+			handleAcarsLine(label, line, decode)
+			continue
+		}
+
+		// Partial lines are read again once the rest has been written
+		if len(line) > 0 {
+			file.Seek(offset, io.SeekStart)
+			reader.Reset(file)
+		}
+
+		time.Sleep(acarsTailPoll)
+
+		current, statErr := os.Stat(path)
+		opened, openedErr := file.Stat()
+		if statErr != nil || openedErr != nil || !os.SameFile(current, opened) || current.Size() < offset {
+			file.Close()
+			file = nil
+		}
+	}
+}
+
+func handleAcarsLine(label string, line []byte, decode acarsDecoder) {
+
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+
+	message, err := decode(line)
+	if err != nil {
+		acarsLog.Debug("Skipping message", "source", label, "error", err)
+		return
+	}
+	if message == nil {
+		return
+	}
+
+	acarsPending.mu.Lock()
+	defer acarsPending.mu.Unlock()
+
+	// Beyond acars.max_pending, the oldest messages are dropped
+	if len(acarsPending.messages) >= config.Acars.MaxPending {
+		acarsPending.messages = acarsPending.messages[1:]
+		acarsPending.dropped++
+	}
+	acarsPending.messages = append(acarsPending.messages, *message)
+}
+
+// Writes the messages received since the last run, links messages to their
+// aircraft_data sessions, and fills in what the messages say about the flight
+func updateAcarsMessages(ctx context.Context, pg *postgres) error {
+
+	// The messages are taken off the queue, so are written even when the job
+	// is stopping, and put back on it if they can't be
+	ctx = writeContext(ctx)
+
+	acarsPending.mu.Lock()
+	messages := acarsPending.messages
+	dropped := acarsPending.dropped
+	acarsPending.messages = nil
+	acarsPending.dropped = 0
+	acarsPending.mu.Unlock()
+
+	if dropped > 0 {
+		acarsLog.Warn("Dropped messages received while the database was busy", "dropped", dropped)
+	}
+
+	if err := insertAcarsMessages(ctx, pg, messages); err != nil {
+		requeueAcarsMessages(messages)
+		return err
+	}
+	return linkAcarsMessages(ctx, pg)
+}
+
+// Puts messages that couldn't be written back at the front of the queue,
+// ahead of any received since, dropping the oldest beyond acars.max_pending
+func requeueAcarsMessages(messages []acarsMessage) {
+
+	acarsPending.mu.Lock()
+	defer acarsPending.mu.Unlock()
+
+	queued := append(messages, acarsPending.messages...)
+	if excess := len(queued) - config.Acars.MaxPending; excess > 0 {
+		queued = queued[excess:]
+		acarsPending.dropped += excess
+	}
+	acarsPending.messages = queued
+}
+
+// Inserts the messages in one batch, which is one transaction, so either all
+// of them are written or none are
+func insertAcarsMessages(ctx context.Context, pg *postgres, messages []acarsMessage) error {
+
+	if len(messages) == 0 {
+		return nil
+	}
+
+	batch := &pgx.Batch{}
+
+	for _, message := range messages {
+		insertStatement := `
+			INSERT INTO acars_messages (
+				time,
+				source,
+				freq,
+				hex,
+				registration,
+				flight,
+				mode,
+				label,
+				block_id,
+				msg_num,
+				text,
+				departure,
+				destination,
+				out_time,
+				off_time,
+				on_time,
+				in_time
+			) VALUES (
+				$1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), NULLIF($6, ''), $7, $8, $9, $10, $11,
+				NULLIF($12, ''), NULLIF($13, ''), $14, $15, $16, $17)`
+
+		batch.Queue(insertStatement,
+			message.time,
+			message.source,
+			message.freq,
+			message.hex,
+			message.registration,
+			message.flight,
+			message.mode,
+			message.label,
+			message.blockId,
+			message.msgNum,
+			message.text,
+			message.departure,
+			message.destination,
+			message.outTime,
+			message.offTime,
+			message.onTime,
+			message.inTime)
+	}
+
+	br := pg.db.SendBatch(ctx, batch)
+
+	for i := 0; i < len(messages); i++ {
+		if _, err := br.Exec(); err != nil {
+			br.Close()
+			return fmt.Errorf("unable to insert messages: %w", err)
+		}
+	}
+
+	if err := br.Close(); err != nil {
+		return fmt.Errorf("unable to insert messages: %w", err)
+	}
+
+	return nil
+}
+
+// Links each new message to the session of the aircraft that sent (or was
+// sent) it, matched on hex, then registration, then flight number, within
+// sessionGapSeconds of the session. Messages that can't be linked are retried
+// until they are that old.
+//
+// Each match is its own lookup on a (key, last_seen) index. The flight number
+// is IATA, e.g. BA123, so is matched through the route_callsign_iata that
+// insertRoutes stores for a route already looked up, e.g. BAW123.
+//
+// Linked messages fill in the session's OOOI times, and the origin and
+// destination of its route where the route lookup didn't find them.
+func linkAcarsMessages(ctx context.Context, pg *postgres) error {
+
+	query := fmt.Sprintf(`
+		WITH linked AS (
+			SELECT
+				m.id,
+				m.time,
+				(
+					SELECT candidate.id FROM (
+						(
+							SELECT a.id, 1 AS priority FROM aircraft_data a
+							WHERE a.hex = m.hex AND %[2]s
+							ORDER BY a.last_seen DESC
+							LIMIT 1
+						)
+						UNION ALL
+						(
+							SELECT a.id, 2 AS priority FROM aircraft_data a
+							WHERE a.r = m.registration AND %[2]s
+							ORDER BY a.last_seen DESC
+							LIMIT 1
+						)
+						UNION ALL
+						(
+							SELECT a.id, 3 AS priority FROM route_data route
+							JOIN aircraft_data a ON a.flight = route.route_callsign
+							WHERE route.route_callsign_iata = m.flight AND %[2]s
+							ORDER BY a.last_seen DESC
+							LIMIT 1
+						)
+					) candidate
+					ORDER BY candidate.priority
+					LIMIT 1
+				) AS aircraft_id
+			FROM acars_messages m
+			WHERE m.link_processed = false
+		)
+		UPDATE acars_messages m
+		SET
+			aircraft_id = linked.aircraft_id,
+			link_processed = true
+		FROM linked
+		WHERE
+			m.id = linked.id AND
+			(linked.aircraft_id IS NOT NULL OR linked.time < NOW() - INTERVAL '%[1]d seconds')
+		RETURNING m.aircraft_id, COALESCE(m.departure, ''), COALESCE(m.destination, ''), m.out_time, m.off_time, m.on_time, m.in_time`,
+		sessionGapSeconds,
+		fmt.Sprintf(`a.last_seen >= m.time - INTERVAL '%[1]d seconds' AND a.first_seen <= m.time + INTERVAL '%[1]d seconds'`, sessionGapSeconds))
+
+	rows, err := pg.db.Query(ctx, query)
+	if err != nil {
+		return fmt.Errorf("Error linking messages: %w", err)
+	}
+
+	batch := &pgx.Batch{}
+
+	for rows.Next() {
+		var aircraftId sql.NullInt64
+		var departure, destination string
+		var outTime, offTime, onTime, inTime sql.NullTime
+
+		if err := rows.Scan(&aircraftId, &departure, &destination, &outTime, &offTime, &onTime, &inTime); err != nil {
+			acarsLog.Error("Error scanning messages to link", "error", err)
+			continue
+		}
+		if !aircraftId.Valid {
+			continue
+		}
+
+		if outTime.Valid || offTime.Valid || onTime.Valid || inTime.Valid {
+			batch.Queue(`
+				UPDATE aircraft_data SET
+					out_time = COALESCE(out_time, $2),
+					off_time = COALESCE(off_time, $3),
+					on_time = COALESCE(on_time, $4),
+					in_time = COALESCE(in_time, $5)
+				WHERE id = $1`,
+				aircraftId.Int64, outTime, offTime, onTime, inTime)
+		}
+
+		if departure != "" || destination != "" {
+			batch.Queue(`
+				INSERT INTO route_data (route_callsign, route_callsign_icao, origin_icao_code, destination_icao_code)
+				SELECT flight, flight, NULLIF($2, ''), NULLIF($3, '')
+				FROM aircraft_data
+				WHERE id = $1 AND flight != ''
+				ON CONFLICT (route_callsign)
+				DO UPDATE SET
+					origin_icao_code = COALESCE(NULLIF(route_data.origin_icao_code, ''), EXCLUDED.origin_icao_code),
+					destination_icao_code = COALESCE(NULLIF(route_data.destination_icao_code, ''), EXCLUDED.destination_icao_code)`,
+				aircraftId.Int64, departure, destination)
+		}
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("Error linking messages: %w", err)
+	}
+
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	br := pg.db.SendBatch(ctx, batch)
+	defer br.Close()
+
+	for i := 0; i < batch.Len(); i++ {
+		_, err := br.Exec()
+		if err != nil {
+			acarsLog.Error("Unable to link message", "error", err)
+		}
+	}
+	return nil
+}
+
+type acarsMessageJson struct {
+	Id           int        `json:"id"`
+	AircraftId   *int64     `json:"aircraft_id"`
+	Time         time.Time  `json:"time"`
+	Source       string     `json:"source"`
+	Freq         *float64   `json:"freq"`
+	Hex          string     `json:"hex"`
+	Registration string     `json:"registration"`
+	Flight       string     `json:"flight"`
+	Mode         string     `json:"mode"`
+	Label        string     `json:"label"`
+	BlockId      string     `json:"block_id"`
+	MsgNum       string     `json:"msg_num"`
+	Text         string     `json:"text"`
+	Departure    string     `json:"departure"`
+	Destination  string     `json:"destination"`
+	OutTime      *time.Time `json:"out_time"`
+	OffTime      *time.Time `json:"off_time"`
+	OnTime       *time.Time `json:"on_time"`
+	InTime       *time.Time `json:"in_time"`
+}
+
+// Messages linked to one aircraft_data session, oldest first
+func (s *APIServer) getSessionMessages(c *gin.Context) {
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session id"})
+		return
+	}
+
+	s.queryAcarsMessages(c, "m.aircraft_id = $1 ORDER BY m.time ASC", id)
+}
+
+// The most recent messages, optionally for one ADS-B callsign (?flight=) or
+// registration (?registration=)
+func (s *APIServer) getAcarsMessages(c *gin.Context) {
+
+	flight := strings.ToUpper(strings.TrimSpace(c.Query("flight")))
+	registration := normaliseRegistration(c.Query("registration"))
+
+	s.queryAcarsMessages(c, `
+		($1 = '' OR a.flight = $1 OR m.flight = $1) AND
+		($2 = '' OR a.r = $2 OR m.registration = $2)
+		ORDER BY m.time DESC
+		LIMIT $3`,
+		flight, registration, s.getLimit(c))
+}
+
+func (s *APIServer) queryAcarsMessages(c *gin.Context, condition string, args ...any) {
+
+	query := `
+		SELECT
+			m.id, m.aircraft_id, m.time, m.source, m.freq,
+			COALESCE(m.hex, ''), COALESCE(m.registration, ''), COALESCE(m.flight, ''),
+			COALESCE(m.mode, ''), COALESCE(m.label, ''), COALESCE(m.block_id, ''), COALESCE(m.msg_num, ''),
+			COALESCE(m.text, ''), COALESCE(m.departure, ''), COALESCE(m.destination, ''),
+			m.out_time, m.off_time, m.on_time, m.in_time
+		FROM acars_messages m
+		LEFT JOIN aircraft_data a ON a.id = m.aircraft_id
+		WHERE ` + condition
+
+	rows, err := s.pg.db.Query(c.Request.Context(), query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	messages := []acarsMessageJson{}
+	for rows.Next() {
+		var m acarsMessageJson
+		err := rows.Scan(
+			&m.Id, &m.AircraftId, &m.Time, &m.Source, &m.Freq,
+			&m.Hex, &m.Registration, &m.Flight,
+			&m.Mode, &m.Label, &m.BlockId, &m.MsgNum,
+			&m.Text, &m.Departure, &m.Destination,
+			&m.OutTime, &m.OffTime, &m.OnTime, &m.InTime)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		messages = append(messages, m)
+	}
+
+	c.JSON(http.StatusOK, messages)
+}
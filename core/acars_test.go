@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/tomcarman/skystats/data"
+)
+
+// Messages are linked by flight number through route_data's
+// route_callsign_iata, so the flight an ACARS message decodes to has to be
+// the key insertRoutes stores for the ADS-B callsign
+func TestAcarsFlightMatchesRouteCallsign(t *testing.T) {
+
+	for _, test := range []struct {
+		acarsFlight string
+		route       RouteInfo
+		want        string
+	}{
+		{"BA0123", RouteInfo{Callsign: "BAW123", AirlineCode: "BAW", Number: "123"}, "BA123"},
+		// The number is taken from the callsign when the route doesn't have it
+		{"BA0123", RouteInfo{Callsign: "BAW123", AirlineCode: "BAW"}, "BA123"},
+		{"BA123 ", RouteInfo{Callsign: "BAW0123", AirlineCode: "BAW"}, "BA123"},
+		{"U20001", RouteInfo{Callsign: "EZY1", AirlineCode: "EZY", Number: "1"}, "U21"},
+		{"BA084C", RouteInfo{Callsign: "BAW84C", AirlineCode: "BAW", Number: "84C"}, "BA84C"},
+	} {
+		airline, ok := data.LookupAirline(test.route.AirlineCode)
+		if !ok {
+			t.Fatalf("no airline %s", test.route.AirlineCode)
+		}
+
+		key := routeCallsignIata(test.route, airline)
+		if key != test.want {
+			t.Errorf("route_callsign_iata for %s = %q, want %q", test.route.Callsign, key, test.want)
+		}
+
+		message, err := decodeAcarsdec([]byte(fmt.Sprintf(`{"timestamp": 1717243200.5, "flight": %q}`, test.acarsFlight)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.flight != key {
+			t.Errorf("ACARS flight %q = %q, which doesn't link to %s (%q)", test.acarsFlight, message.flight, test.route.Callsign, key)
+		}
+	}
+
+	// Without an IATA code there's nothing for a message to match
+	if key := routeCallsignIata(RouteInfo{Callsign: "AAB12", AirlineCode: "AAB"}, data.Airline{ICAO: "AAB"}); key != "" {
+		t.Errorf("route_callsign_iata without an IATA code = %q, want none", key)
+	}
+	if key := routeCallsignIata(RouteInfo{Callsign: "BAW", AirlineCode: "BAW"}, data.Airline{IATA: "BA"}); key != "" {
+		t.Errorf("route_callsign_iata without a flight number = %q, want none", key)
+	}
+}
+
+// Messages that couldn't be written go back ahead of those received since,
+// and the oldest are dropped beyond acars.max_pending
+func TestRequeueAcarsMessages(t *testing.T) {
+
+	saved := config
+	t.Cleanup(func() {
+		config = saved
+		acarsPending.messages = nil
+		acarsPending.dropped = 0
+	})
+	config.Acars.MaxPending = 3
+
+	acarsPending.messages = []acarsMessage{{text: "received since"}}
+	requeueAcarsMessages([]acarsMessage{{text: "first"}, {text: "second"}, {text: "third"}})
+
+	var texts []string
+	for _, message := range acarsPending.messages {
+		texts = append(texts, message.text)
+	}
+	if fmt.Sprint(texts) != "[second third received since]" || acarsPending.dropped != 1 {
+		t.Errorf("queue = %v, %d dropped, want [second third received since], 1 dropped", texts, acarsPending.dropped)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// What an aircraft's hex is. Only ICAO addresses belong to an airframe;
+// readsb prefixes everything else with ~.
+const (
+	// A 24-bit ICAO address
+	addressTypeIcao = "icao"
+	// A non-ICAO address sent over ADS-B, ADS-R or TIS-B, e.g. an anonymous
+	// address that the aircraft may change at any time
+	addressTypeOther = "other"
+	// A TIS-B track file number, assigned by the ground station
+	addressTypeTrackfile = "trackfile"
+)
+
+// How close, in time and distance, positions from a non-ICAO sighting have to
+// be to an ICAO sighting's to count as the same aircraft, and how many of them
+const (
+	correlationMaxSeconds = 15
+	correlationMaxKm      = 2
+	correlationMinMatches = 3
+)
+
+func addressType(aircraft Aircraft) string {
+	switch {
+	case aircraft.Type == "tisb_trackfile":
+		return addressTypeTrackfile
+	case strings.HasPrefix(aircraft.Hex, "~"), strings.HasSuffix(aircraft.Type, "_other"):
+		return addressTypeOther
+	default:
+		return addressTypeIcao
+	}
+}
+
+// CORRELATE_NON_ICAO=true matches non-ICAO sightings to the ICAO aircraft
+// flying the same track, e.g. one also heard directly on 1090 or by MLAT
+func correlateNonIcao() bool {
+	return config.Correlation.NonIcao
+}
+
+// Correlates finished non-ICAO sightings with the ICAO sighting that had the
+// most positions alongside them, recording its hex as correlated_hex
+func updateNonIcaoCorrelations(ctx context.Context, pg *postgres) error {
+
+	if !correlateNonIcao() {
+		return nil
+	}
+
+	query := fmt.Sprintf(`
+		WITH correlated AS (
+			SELECT
+				a.id,
+				(
+					SELECT i.hex
+					FROM aircraft_positions np
+					JOIN aircraft_positions ip ON
+						ip.time BETWEEN np.time - INTERVAL '%[1]d seconds' AND np.time + INTERVAL '%[1]d seconds'
+					JOIN aircraft_data i ON
+						i.id = ip.aircraft_id AND i.address_type = '%[2]s'
+					WHERE
+						np.aircraft_id = a.id AND
+						111.32 * sqrt(power((ip.lat - np.lat)::float8, 2) + power((ip.lon - np.lon)::float8 * cos(radians(np.lat::float8)), 2)) < %[3]d AND
+						(np.alt_baro IS NULL OR ip.alt_baro IS NULL OR abs(ip.alt_baro - np.alt_baro) < 500)
+					GROUP BY i.hex
+					HAVING COUNT(DISTINCT np.id) >= %[4]d
+					ORDER BY COUNT(DISTINCT np.id) DESC
+					LIMIT 1
+				) AS hex
+			FROM aircraft_data a
+			WHERE
+				a.address_type != '%[2]s' AND
+				a.correlation_processed = false AND
+				a.last_seen < NOW() - INTERVAL '%[5]d seconds'
+			ORDER BY a.first_seen ASC
+			LIMIT %[6]d
+		)
+		UPDATE aircraft_data a
+		SET
+			correlated_hex = correlated.hex,
+			correlation_processed = true
+		FROM correlated
+		WHERE a.id = correlated.id`,
+		correlationMaxSeconds, addressTypeIcao, correlationMaxKm, correlationMinMatches, sessionGapSeconds, config.Correlation.BatchSize)
+
+	result, err := pg.db.Exec(ctx, query)
+	if err != nil {
+		return fmt.Errorf("Error correlating non-ICAO sightings: %w", err)
+	}
+
+	correlationLog.Debug("Checked non-ICAO sightings for correlation", "count", result.RowsAffected())
+	return nil
+}
@@ -3,53 +3,38 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"math"
-	"os"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	cheapruler "github.com/JamesLMilner/cheap-ruler-go"
-	"github.com/jackc/pgx/v5"
 )
 
-func updateAircraftDatabase(pg *postgres) {
+// An aircraft unseen for longer than this starts a new session when it returns
+const sessionGapSeconds = 600
 
-	responseData, err := Fetch()
+// Snapshots are polled and pushed to /api/ingest at the same time, and are
+// written one at a time so an aircraft in both doesn't start two sessions
+var updateDatabaseMu sync.Mutex
+
+func updateAircraftDatabase(ctx context.Context, pg *postgres, source AircraftSource) error {
+
+	response, err := source.Snapshot(ctx)
 
 	if err != nil {
-		fmt.Println("Error fetching data: ", err)
-		return
+		return fmt.Errorf("Error fetching data: %w", err)
 	}
 
-	var response Response
-	json.Unmarshal(responseData, &response)
-
 	response.TrimFlightStrings()
 
-	loc := []float64{getLon(), getLat()}
-
-	var aircraftsInRange []Aircraft
-
-	for _, aircraft := range response.Aircraft {
-
-		// Filter out non-aircraft
-		if isNonAircraft(aircraft) {
-			continue
-		}
-
-		// Filter out aircraft not within radius
-		planeLoc := []float64{aircraft.Lon, aircraft.Lat}
-		distance := getRuler().Distance(loc, planeLoc)
+	// Filter out non-aircraft, anything excluded by FILTERS_FILE, and
+	// aircraft outside RADIUS or the filter polygons
+	aircraftsInRange := filterAircraft(response.Aircraft)
 
-		if distance < getRadius() {
-			aircraftsInRange = append(aircraftsInRange, aircraft)
-		}
-
-	}
-	pg.updateDatabase(response.Now, aircraftsInRange)
+	// Spooled to disk if the database is unavailable, see SPOOL_DIR
+	return storeSnapshot(ctx, pg, response.Now, aircraftsInRange)
 }
 
 func isNonAircraft(aircraft Aircraft) bool {
@@ -62,7 +47,7 @@ func isNonAircraft(aircraft Aircraft) bool {
 func getRuler() *cheapruler.CheapRuler {
 	ruler, err := cheapruler.NewCheapruler(getLat(), "kilometers")
 	if err != nil {
-		fmt.Println("Error creating ruler: ", err)
+		ingestLog.Error("Error creating ruler", "error", err)
 		return nil
 	}
 
@@ -75,208 +60,274 @@ func getDistance(aircraft []float64) *float64 {
 	return &distance
 }
 
-func (pg *postgres) updateDatabase(nowEpoch float64, aircrafts []Aircraft) {
+// Writes a snapshot. An error means none of it was written, so it can be
+// spooled and tried again. Once its new sessions are inserted the snapshot
+// counts as written, and later failures, e.g. of its positions, are only
+// logged, as writing it again would record them twice.
+func (pg *postgres) updateDatabase(ctx context.Context, nowEpoch float64, aircrafts []Aircraft) error {
 
-	existingAircrafts := getAircraftsRecentlySeen(pg, nowEpoch, aircrafts)
+	updateDatabaseMu.Lock()
+	defer updateDatabaseMu.Unlock()
+
+	existingAircrafts, err := getLiveSessions(ctx, pg, nowEpoch, aircrafts)
+	if err != nil {
+		return fmt.Errorf("Error querying sessions: %w", err)
+	}
+
+	sessionIds, err := insertNewAircrafts(ctx, pg, nowEpoch, existingAircrafts, aircrafts)
+	if err != nil {
+		return fmt.Errorf("Unable to insert new sessions: %w", err)
+	}
 
 	if len(existingAircrafts) > 0 {
-		updateExistingAircrafts(pg, nowEpoch, aircrafts, existingAircrafts)
+		updateExistingAircrafts(ctx, pg, nowEpoch, aircrafts, existingAircrafts)
 	}
 
-	insertNewAircrafts(pg, nowEpoch, existingAircrafts, aircrafts)
+	trackLiveSessions(nowEpoch, aircrafts, sessionIds)
+	for hex, existingAircraft := range existingAircrafts {
+		sessionIds[hex] = existingAircraft.Id
+	}
+
+	if err := recordPositions(ctx, pg, nowEpoch, aircrafts, sessionIds); err != nil {
+		ingestLog.Error("Unable to insert positions", "error", err)
+	}
 
+	flushLiveSessionsIfDue(ctx, pg, nowEpoch)
+	return nil
 }
 
-func getAircraftsRecentlySeen(pg *postgres, nowEpoch float64, aircrafts []Aircraft) map[string]*Aircraft {
+// Inserts a session for each aircraft that isn't already being tracked, and
+// returns the new session ids by hex. The sessions are copied into a staging
+// table and inserted with a single statement, so either all or none of them
+// are inserted.
+func insertNewAircrafts(ctx context.Context, pg *postgres, nowEpoch float64, existingAircrafts map[string]*Aircraft, aircrafts []Aircraft) (map[string]int, error) {
 
-	existingAircrafts := make(map[string]*Aircraft)
+	sessionIds := make(map[string]int)
 
-	var hexValues []string
-	for _, a := range aircrafts {
-		hexValues = append(hexValues, a.Hex)
-	}
+	nowAsTime := time.Unix(int64(nowEpoch), 0)
+	nowAsEpoch := int64(nowEpoch)
 
-	query := `
-		SELECT DISTINCT ON (hex)
-			id,
-			hex,
-			last_seen_epoch,
-			last_seen_lat,
-			last_seen_lon,
-			last_seen_distance,
-			alt_baro,
-			alt_geom,
-			gs,
-			ias,
-			tas
-		FROM aircraft_data
-		WHERE hex = ANY($1::text[])
-		ORDER BY hex, last_seen DESC;
-    `
-
-	rows, err := pg.db.Query(context.Background(), query, hexValues)
-	if err != nil {
-		fmt.Println("getAircraftsRecentlySeen() - Error querying db: ", err)
-		return nil
+	columns := []string{
+		"hex",
+		"flight",
+		"first_seen",
+		"first_seen_epoch",
+		"last_seen",
+		"last_seen_epoch",
+		"last_seen_lat",
+		"last_seen_lon",
+		"last_seen_distance",
+		"type",
+		"r",
+		"t",
+		"alt_baro",
+		"alt_geom",
+		"gs",
+		"ias",
+		"tas",
+		"track",
+		"baro_rate",
+		"nav_qnh",
+		"nav_altitude_mcp",
+		"nav_heading",
+		"lat",
+		"lon",
+		"nic",
+		"rc",
+		"seen_pos",
+		"r_dst",
+		"r_dir",
+		"version",
+		"nic_baro",
+		"nac_p",
+		"nac_v",
+		"sil",
+		"sil_type",
+		"alert",
+		"spi",
+		"mlat",
+		"tisb",
+		"messages",
+		"seen",
+		"rssi",
+		"db_flags",
+		"stations",
+		"on_ground",
+		"squawk",
+		"emergency",
+		"mach",
+		"roll",
+		"mag_heading",
+		"true_heading",
+		"track_rate",
+		"geom_rate",
+		"nav_modes",
+		"nav_altitude_fms",
+		"gva",
+		"sda",
+		"oat",
+		"tat",
+		"wd",
+		"ws",
+		"rr_lat",
+		"rr_lon",
+		"last_position_lat",
+		"last_position_lon",
+		"last_position_nic",
+		"last_position_rc",
+		"last_position_seen_pos",
+		"mode_s_only",
+		"datalinks",
+		"address_type",
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var existingAircraft Aircraft
-		err := rows.Scan(
-			&existingAircraft.Id,
-			&existingAircraft.Hex,
-			&existingAircraft.LastSeenEpoch,
-			&existingAircraft.LastSeenLat,
-			&existingAircraft.LastSeenLon,
-			&existingAircraft.LastSeenDistance,
-			&existingAircraft.AltBaro,
-			&existingAircraft.AltGeom,
-			&existingAircraft.Gs,
-			&existingAircraft.Ias,
-			&existingAircraft.Tas)
-
-		if err != nil {
-			fmt.Println("getAircraftsRecentlySeen() - Error scanning rows: ", err)
-			continue
-		}
-		if nowEpoch-existingAircraft.LastSeenEpoch > 600 {
+
+	var rows [][]any
+
+	for _, aircraft := range aircrafts {
+		if _, exists := existingAircrafts[aircraft.Hex]; exists {
 			continue
 		}
 
-		existingAircrafts[existingAircraft.Hex] = &existingAircraft
+		lastSeenDistance := sightingDistance(aircraft)
+		lat := sightingCoordinate(aircraft, aircraft.Lat)
+		lon := sightingCoordinate(aircraft, aircraft.Lon)
+
+		rows = append(rows, []any{
+			aircraft.Hex,
+			aircraft.Flight,
+			nowAsTime,
+			nowAsEpoch,
+			nowAsTime,
+			nowAsEpoch,
+			lat,
+			lon,
+			lastSeenDistance,
+			aircraft.Type,
+			aircraft.R,
+			aircraft.T,
+			aircraft.AltBaro,
+			aircraft.AltGeom,
+			aircraft.Gs,
+			aircraft.Ias,
+			aircraft.Tas,
+			aircraft.Track,
+			aircraft.BaroRate,
+			aircraft.NavQnh,
+			aircraft.NavAltitudeMcp,
+			aircraft.NavHeading,
+			lat,
+			lon,
+			aircraft.Nic,
+			aircraft.Rc,
+			aircraft.SeenPos,
+			aircraft.RDst,
+			aircraft.RDir,
+			aircraft.Version,
+			aircraft.NicBaro,
+			aircraft.NacP,
+			aircraft.NacV,
+			aircraft.Sil,
+			aircraft.SilType,
+			aircraft.Alert,
+			aircraft.Spi,
+			aircraft.Mlat,
+			aircraft.Tisb,
+			aircraft.Messages,
+			aircraft.Seen,
+			aircraft.Rssi,
+			aircraft.DbFlags,
+			aircraft.Stations,
+			aircraft.OnGround,
+			nonEmptyString(aircraft.Squawk),
+			nonEmptyString(aircraft.Emergency),
+			aircraft.Mach,
+			aircraft.Roll,
+			aircraft.MagHeading,
+			aircraft.TrueHeading,
+			aircraft.TrackRate,
+			aircraft.GeomRate,
+			aircraft.NavModes,
+			aircraft.NavAltitudeFms,
+			aircraft.Gva,
+			aircraft.Sda,
+			aircraft.Oat,
+			aircraft.Tat,
+			aircraft.Wd,
+			aircraft.Ws,
+			aircraft.RrLat,
+			aircraft.RrLon,
+			aircraft.LastPosition.Lat,
+			aircraft.LastPosition.Lon,
+			aircraft.LastPosition.Nic,
+			aircraft.LastPosition.Rc,
+			aircraft.LastPosition.SeenPos,
+			!aircraft.HasPosition(),
+			aircraftDatalinks(aircraft),
+			addressType(aircraft),
+		})
 	}
 
-	return existingAircrafts
-
-}
+	if len(rows) == 0 {
+		return sessionIds, nil
+	}
 
-func insertNewAircrafts(pg *postgres, nowEpoch float64, existingAircrafts map[string]*Aircraft, aircrafts []Aircraft) {
+	tx, err := pg.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
 
-	batch := &pgx.Batch{}
+	staging, err := copyToStaging(ctx, tx, "aircraft_data", columns, rows)
+	if err != nil {
+		return nil, err
+	}
 
-	nowAsTime := time.Unix(int64(nowEpoch), 0)
-	nowAsEpoch := int64(nowEpoch)
+	insertStatement := `
+		INSERT INTO aircraft_data (` + strings.Join(columns, ", ") + `)
+		SELECT ` + strings.Join(columns, ", ") + `
+		FROM ` + staging + `
+		RETURNING id, hex`
 
-	var aircraftsToInsert []Aircraft
+	insertedRows, err := tx.Query(ctx, insertStatement)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, aircraft := range aircrafts {
-		_, exists := existingAircrafts[aircraft.Hex]
-		if !exists {
-			lastSeenDistance := getDistance([]float64{aircraft.Lon, aircraft.Lat})
-			aircraftsToInsert = append(aircraftsToInsert, aircraft)
-			insertStatement := `
-				INSERT INTO aircraft_data (
-					hex,
-					flight,
-					first_seen,
-					first_seen_epoch,
-					last_seen,
-					last_seen_epoch,
-					last_seen_lat,
-					last_seen_lon,
-					last_seen_distance,
-					type,
-					r,
-					t,
-					alt_baro,
-					alt_geom,
-					gs,
-					ias,
-					tas,
-					track,
-					baro_rate,
-					nav_qnh,
-					nav_altitude_mcp,
-					nav_heading,
-					lat,
-					lon,
-					nic,
-					rc,
-					seen_pos,
-					r_dst,
-					r_dir,
-					version,
-					nic_baro,
-					nac_p,
-					nac_v,
-					sil,
-					sil_type,
-					alert,
-					spi,
-					mlat,
-					tisb,
-					messages,
-					seen,
-					rssi,
-					db_flags
-				) VALUES (
-					$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15,
-					$16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28,
-					$29, $30, $31, $32, $33, $34, $35, $36, $37, $38, $39, $40, $41, $42, $43
-				)`
-
-			batch.Queue(insertStatement,
-				aircraft.Hex,
-				aircraft.Flight,
-				nowAsTime,
-				nowAsEpoch,
-				nowAsTime,
-				nowAsEpoch,
-				aircraft.Lat,
-				aircraft.Lon,
-				lastSeenDistance,
-				aircraft.Type,
-				aircraft.R,
-				aircraft.T,
-				aircraft.AltBaro,
-				aircraft.AltGeom,
-				aircraft.Gs,
-				aircraft.Ias,
-				aircraft.Tas,
-				aircraft.Track,
-				aircraft.BaroRate,
-				aircraft.NavQnh,
-				aircraft.NavAltitudeMcp,
-				aircraft.NavHeading,
-				aircraft.Lat,
-				aircraft.Lon,
-				aircraft.Nic,
-				aircraft.Rc,
-				aircraft.SeenPos,
-				aircraft.RDst,
-				aircraft.RDir,
-				aircraft.Version,
-				aircraft.NicBaro,
-				aircraft.NacP,
-				aircraft.NacV,
-				aircraft.Sil,
-				aircraft.SilType,
-				aircraft.Alert,
-				aircraft.Spi,
-				aircraft.Mlat,
-				aircraft.Tisb,
-				aircraft.Messages,
-				aircraft.Seen,
-				aircraft.Rssi,
-				aircraft.DbFlags)
+	inserted := make(map[string]int)
+	for insertedRows.Next() {
+		var id int
+		var hex string
+		if err := insertedRows.Scan(&id, &hex); err != nil {
+			insertedRows.Close()
+			return nil, err
 		}
+		inserted[hex] = id
 	}
+	insertedRows.Close()
 
-	br := pg.db.SendBatch(context.Background(), batch)
-	defer br.Close()
+	if err := insertedRows.Err(); err != nil {
+		return nil, err
+	}
 
-	for i := 0; i < len(aircraftsToInsert); i++ {
-		_, err := br.Exec()
-		if err != nil {
-			fmt.Println("insertNewAircrafts() - unable to insert data: ", err)
-		}
+	// The ids only exist once committed
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
 	}
+
+	return inserted, nil
 }
 
-func updateExistingAircrafts(pg *postgres, nowEpoch float64, aircrafts []Aircraft, existingAircrafts map[string]*Aircraft) {
+// Applies a snapshot to the sessions already being tracked. The changes are
+// written to aircraft_data by flushLiveSessions.
+func updateExistingAircrafts(ctx context.Context, pg *postgres, nowEpoch float64, aircrafts []Aircraft, existingAircrafts map[string]*Aircraft) {
 
-	batch := &pgx.Batch{}
+	var flights []string
+	for _, aircraft := range aircrafts {
+		if _, exists := existingAircrafts[aircraft.Hex]; exists && aircraft.Flight != "" && aircraft.HasPosition() {
+			flights = append(flights, aircraft.Flight)
+		}
+	}
+	routes := getCachedRoutes(ctx, pg, flights)
 
 	for _, aircraft := range aircrafts {
 		existingAircraft, exists := existingAircrafts[aircraft.Hex]
@@ -295,148 +346,61 @@ func updateExistingAircrafts(pg *postgres, nowEpoch float64, aircrafts []Aircraf
 		existingAircraft.LastSeenEpoch = nowEpoch
 		existingAircraft.LastSeen = time.Unix(int64(nowEpoch), 0)
 
-		// Update last_seen_lat, last_seen_lon, last_seen_distance with the latest lat/lon
-		existingAircraft.LastSeenLat = sql.NullFloat64{Float64: aircraft.Lat, Valid: true}
-		existingAircraft.LastSeenLon = sql.NullFloat64{Float64: aircraft.Lon, Valid: true}
-		lastSeenDistance := getDistance([]float64{aircraft.Lon, aircraft.Lat})
-		existingAircraft.LastSeenDistance = sql.NullFloat64{Float64: *lastSeenDistance, Valid: true}
+		// Update last_seen_lat, last_seen_lon, last_seen_distance with the latest lat/lon,
+		// or keep the last known ones if the aircraft has no position
+		existingAircraft.LastSeenLat = coalesceFloat(sightingCoordinate(aircraft, aircraft.Lat), existingAircraft.LastSeenLat)
+		existingAircraft.LastSeenLon = coalesceFloat(sightingCoordinate(aircraft, aircraft.Lon), existingAircraft.LastSeenLon)
+		existingAircraft.LastSeenDistance = coalesceFloat(sightingDistance(aircraft), existingAircraft.LastSeenDistance)
 
 		// Update destination distance
-		if aircraft.Flight != "" {
-			routeData, err := getRouteData(pg, aircraft.Flight)
-			if err != nil {
-			} else if routeData != nil && routeData.DestinationLatitude.Valid && routeData.DestinationLongitude.Valid {
+		if aircraft.Flight != "" && aircraft.HasPosition() {
+			routeData := routes[aircraft.Flight]
+			if routeData != nil && routeData.DestinationLatitude.Valid && routeData.DestinationLongitude.Valid {
 				destinationDistance := getDestinationDistance(
-					aircraft.Lat,
-					aircraft.Lon,
+					aircraft.Lat.Float64,
+					aircraft.Lon.Float64,
 					routeData.DestinationLatitude.Float64,
 					routeData.DestinationLongitude.Float64)
 				existingAircraft.DestinationDistance = sql.NullFloat64{Float64: destinationDistance, Valid: true}
 			}
 		}
 
-		// Update track
-		existingAircraft.Track = aircraft.Track
+		// Update track, keeping the last known track if it is missing. The
+		// other latest readings are merged the same way by
+		// updateLiveSession, apart from mach which keeps the highest, and
+		// emergency which isn't cleared once declared
+		existingAircraft.Track = coalesceFloat(aircraft.Track, existingAircraft.Track)
+		existingAircraft.OnGround = aircraft.OnGround
 
 		// Update barometric altitude & geometric altitudes if higher than already stored
-		if existingAircraft.AltBaro < aircraft.AltBaro {
-			existingAircraft.AltBaro = aircraft.AltBaro
-		}
-		if existingAircraft.AltGeom < aircraft.AltGeom {
-			existingAircraft.AltGeom = aircraft.AltGeom
-		}
+		existingAircraft.AltBaro = maxNullInt(existingAircraft.AltBaro, aircraft.AltBaro)
+		existingAircraft.AltGeom = maxNullInt(existingAircraft.AltGeom, aircraft.AltGeom)
 
 		// Update ground speed, indicated air speed, and true air speed if higher than already stored
-		if existingAircraft.Gs < aircraft.Gs {
-			existingAircraft.Gs = aircraft.Gs
-		}
-		if existingAircraft.Ias < aircraft.Ias {
-			existingAircraft.Ias = aircraft.Ias
-		}
-		if existingAircraft.Tas < aircraft.Tas {
-			existingAircraft.Tas = aircraft.Tas
-		}
-
-		updateStatement := `UPDATE aircraft_data
-							SET last_seen = $1,
-								last_seen_epoch = $2,
-								last_seen_lat = $3,
-								last_seen_lon = $4,
-								last_seen_distance = $5,
-								destination_distance = $6,
-								track = $7,
-								alt_baro = $8,
-								alt_geom = $9,
-								gs = $10,
-								ias = $11,
-								tas = $12,
-								flight = $13
-							WHERE id = $14`
-
-		batch.Queue(
-			updateStatement,
-			existingAircraft.LastSeen,
-			existingAircraft.LastSeenEpoch,
-			existingAircraft.LastSeenLat,
-			existingAircraft.LastSeenLon,
-			existingAircraft.LastSeenDistance,
-			existingAircraft.DestinationDistance,
-			existingAircraft.Track,
-			existingAircraft.AltBaro,
-			existingAircraft.AltGeom,
-			existingAircraft.Gs,
-			existingAircraft.Ias,
-			existingAircraft.Tas,
-			existingAircraft.Flight,
-			existingAircraft.Id,
-		)
-	}
+		existingAircraft.Gs = maxNullFloat(existingAircraft.Gs, aircraft.Gs)
+		existingAircraft.Ias = maxNullInt(existingAircraft.Ias, aircraft.Ias)
+		existingAircraft.Tas = maxNullInt(existingAircraft.Tas, aircraft.Tas)
 
-	br := pg.db.SendBatch(context.Background(), batch)
-	defer br.Close()
-
-	for i := 0; i < len(existingAircrafts); i++ {
-		_, err := br.Exec()
-		if err != nil {
-			fmt.Println("updateExistingAircrafts() - unable to update data: ", err)
-		}
+		updateLiveSession(existingAircraft, aircraft)
 	}
 }
 
 func getLat() float64 {
-	lat, _ := strconv.ParseFloat(os.Getenv("LAT"), 64)
-	return lat
+	return receiverLocation.Lat
 }
 
 func getLon() float64 {
-	lon, _ := strconv.ParseFloat(os.Getenv("LON"), 64)
-	return lon
+	return receiverLocation.Lon
 }
 
 func getRadius() float64 {
-	radius, _ := strconv.ParseFloat(os.Getenv("RADIUS"), 64)
-	return radius
-}
-
-type RouteData struct {
-	DestinationLatitude  sql.NullFloat64
-	DestinationLongitude sql.NullFloat64
-}
-
-func getRouteData(pg *postgres, flight string) (*RouteData, error) {
-	if flight == "" {
-		return nil, nil
-	}
-
-	var route RouteData
-	query := `
-		SELECT destination_latitude, destination_longitude
-		FROM route_data
-		WHERE route_callsign = $1
-		AND destination_latitude IS NOT NULL
-		AND destination_longitude IS NOT NULL
-		LIMIT 1
-	`
-
-	err := pg.db.QueryRow(context.Background(), query, flight).Scan(
-		&route.DestinationLatitude,
-		&route.DestinationLongitude,
-	)
-
-	if err != nil {
-		if err == pgx.ErrNoRows {
-			return nil, nil // No route data found
-		}
-		return nil, err
-	}
-
-	return &route, nil
+	return config.Receiver.Radius
 }
 
 func getDestinationDistance(currentLat, currentLon, destLat, destLon float64) float64 {
 	ruler, err := cheapruler.NewCheapruler(currentLat, "kilometers")
 	if err != nil {
-		fmt.Printf("Error creating ruler for destination distance: %v\n", err)
+		ingestLog.Error("Error creating ruler for destination distance", "error", err)
 		return 0
 	}
 
@@ -2,38 +2,57 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"fmt"
+	"io/fs"
+	"net"
 	"net/http"
 	"os"
+	"path"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/tomcarman/skystats/web"
 )
 
 type APIServer struct {
-	pg   *postgres
-	port string
+	pg       *postgres
+	port     string
+	stations []string
+	server   *http.Server
 }
 
-func NewAPIServer(pg *postgres) *APIServer {
-	port := os.Getenv("API_PORT")
-	if port == "" {
-		port = "8080"
-	}
+// Requests are handled with contexts derived from ctx, so they are cancelled
+// when skystats shuts down
+func NewAPIServer(ctx context.Context, pg *postgres, stations []string) *APIServer {
+	port := strconv.Itoa(config.API.Port)
 	return &APIServer{
-		pg:   pg,
-		port: port,
+		pg:       pg,
+		port:     port,
+		stations: stations,
+		server: &http.Server{
+			Addr:        "0.0.0.0:" + port,
+			BaseContext: func(net.Listener) context.Context { return ctx },
+		},
 	}
 }
 
+// Stops accepting requests, and waits for the ones in progress to finish
+// until ctx is done
+func (s *APIServer) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
 func (s *APIServer) Start() {
-	r := gin.Default()
+	r := gin.New()
+	r.Use(requestLogger(), requestRecovery())
 
 	r.Use(func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
 		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Content-Type")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Content-Encoding, Authorization, X-Feeder-Id")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(200)
@@ -52,6 +71,7 @@ func (s *APIServer) Start() {
 
 			stats.GET("/seen/flights", s.getFlightsSeenMetrics)
 			stats.GET("/seen/aircraft", s.getAircraftSeenMetrics)
+			stats.GET("/seen/datalinks", s.getDatalinkSeenMetrics)
 
 			stats.GET("/routes/metrics", s.getRouteMetrics)
 			stats.GET("/routes/airlines", s.getTopAirlines)
@@ -93,37 +113,87 @@ func (s *APIServer) Start() {
 		}
 
 		api.GET("/version", s.getVersion)
+		api.GET("/stations", s.getStations)
+		api.GET("/receiver", s.getReceiver)
+		api.GET("/sessions/:id/track", s.getSessionTrack)
+		api.GET("/sessions/:id/messages", s.getSessionMessages)
+		api.GET("/messages", s.getAcarsMessages)
+		api.GET("/filters", s.getFilters)
+		api.GET("/config", s.getConfig)
+		api.POST("/ingest", s.ingest)
+		api.GET("/ingest/feeders", s.getIngestFeeders)
+		api.GET("/spool", s.getSpool)
+		api.GET("/jobs", s.getJobs)
+		api.POST("/jobs/:name/run", s.runJob)
 	}
 
-	// Serve static files
-	r.Static("/static", "../web")
-	r.StaticFile("/", "../web/index.html")
+	s.serveWebApp(r)
 
-	r.Run("0.0.0.0:" + s.port)
+	s.server.Handler = r
+	if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		apiLog.Error("Error running API server", "error", err)
+	}
 
 }
+
+// Serves the web app from api.web_dir if set, otherwise the copy built into
+// the binary, if there is one. Paths that aren't files are routes within the
+// app, so get index.html.
+func (s *APIServer) serveWebApp(r *gin.Engine) {
+
+	var app fs.FS
+	if config.API.WebDir != "" {
+		app = os.DirFS(config.API.WebDir)
+	} else if dist, ok := web.Dist(); ok {
+		app = dist
+	} else {
+		apiLog.Info("Not serving the web app, as it isn't built in (go build -tags embedweb) and api.web_dir isn't set")
+		return
+	}
+
+	files := http.FileServer(http.FS(app))
+
+	r.NoRoute(func(c *gin.Context) {
+
+		if strings.HasPrefix(c.Request.URL.Path, "/api/") ||
+			(c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+			return
+		}
+
+		name := strings.TrimPrefix(path.Clean(c.Request.URL.Path), "/")
+		if info, err := fs.Stat(app, name); err != nil || info.IsDir() {
+			c.Request.URL.Path = "/"
+		}
+
+		files.ServeHTTP(c.Writer, c.Request)
+	})
+}
+
 func (s *APIServer) getFlightsSeenMetrics(c *gin.Context) {
 	stats := gin.H{}
+	station := s.getStation(c)
 
 	// Total flights count
 	var totalFlights int
-	err := s.pg.db.QueryRow(context.Background(), "SELECT COUNT(*) FROM aircraft_data").Scan(&totalFlights)
+	err := s.pg.db.QueryRow(c.Request.Context(),
+		"SELECT COUNT(*) FROM aircraft_data WHERE "+stationCondition("", 1), station).Scan(&totalFlights)
 	if err == nil {
 		stats["total_flights"] = totalFlights
 	}
 
 	// Today's flights count
 	var todayFlights int
-	err = s.pg.db.QueryRow(context.Background(),
-		"SELECT COUNT(*) FROM aircraft_data WHERE DATE(first_seen) = CURRENT_DATE").Scan(&todayFlights)
+	err = s.pg.db.QueryRow(c.Request.Context(),
+		"SELECT COUNT(*) FROM aircraft_data WHERE DATE(first_seen) = CURRENT_DATE AND "+stationCondition("", 1), station).Scan(&todayFlights)
 	if err == nil {
 		stats["today_flights"] = todayFlights
 	}
 
 	// Past hour flights count
 	var hourFlights int
-	err = s.pg.db.QueryRow(context.Background(),
-		"SELECT COUNT(*) FROM aircraft_data WHERE first_seen >= NOW() - INTERVAL '1 hour'").Scan(&hourFlights)
+	err = s.pg.db.QueryRow(c.Request.Context(),
+		"SELECT COUNT(*) FROM aircraft_data WHERE first_seen >= NOW() - INTERVAL '1 hour' AND "+stationCondition("", 1), station).Scan(&hourFlights)
 	if err == nil {
 		stats["hour_flights"] = hourFlights
 	}
@@ -134,43 +204,130 @@ func (s *APIServer) getFlightsSeenMetrics(c *gin.Context) {
 
 func (s *APIServer) getAircraftSeenMetrics(c *gin.Context) {
 	stats := gin.H{}
+	station := s.getStation(c)
 
 	// Total aircraft count
 	var totalAircraft int
-	err := s.pg.db.QueryRow(context.Background(), "SELECT COUNT(DISTINCT hex) FROM aircraft_data").Scan(&totalAircraft)
+	err := s.pg.db.QueryRow(c.Request.Context(),
+		"SELECT COUNT(DISTINCT hex) FROM aircraft_data WHERE address_type = 'icao' AND "+stationCondition("", 1), station).Scan(&totalAircraft)
 	if err == nil {
 		stats["total_aircraft"] = totalAircraft
 	}
 
 	// Today's aircraft count
 	var todayAircraft int
-	err = s.pg.db.QueryRow(context.Background(),
-		"SELECT COUNT(DISTINCT hex) FROM aircraft_data WHERE DATE(first_seen) = CURRENT_DATE").Scan(&todayAircraft)
+	err = s.pg.db.QueryRow(c.Request.Context(),
+		"SELECT COUNT(DISTINCT hex) FROM aircraft_data WHERE address_type = 'icao' AND DATE(first_seen) = CURRENT_DATE AND "+stationCondition("", 1), station).Scan(&todayAircraft)
 	if err == nil {
 		stats["today_aircraft"] = todayAircraft
 	}
 
 	// Past hour aircraft count
 	var hourAircraft int
-	err = s.pg.db.QueryRow(context.Background(),
-		"SELECT COUNT(DISTINCT hex) FROM aircraft_data WHERE first_seen >= NOW() - INTERVAL '1 hour'").Scan(&hourAircraft)
+	err = s.pg.db.QueryRow(c.Request.Context(),
+		"SELECT COUNT(DISTINCT hex) FROM aircraft_data WHERE address_type = 'icao' AND first_seen >= NOW() - INTERVAL '1 hour' AND "+stationCondition("", 1), station).Scan(&hourAircraft)
 	if err == nil {
 		stats["hour_aircraft"] = hourAircraft
 	}
 
+	// Mode S only aircraft, never seen with a position
+	var totalModeSOnly, todayModeSOnly, hourModeSOnly int
+	err = s.pg.db.QueryRow(c.Request.Context(),
+		`SELECT
+			COUNT(DISTINCT hex),
+			COUNT(DISTINCT hex) FILTER (WHERE DATE(first_seen) = CURRENT_DATE),
+			COUNT(DISTINCT hex) FILTER (WHERE first_seen >= NOW() - INTERVAL '1 hour')
+		FROM aircraft_data
+		WHERE mode_s_only = true AND `+stationCondition("", 1), station).Scan(&totalModeSOnly, &todayModeSOnly, &hourModeSOnly)
+	if err == nil {
+		stats["total_mode_s_only"] = totalModeSOnly
+		stats["today_mode_s_only"] = todayModeSOnly
+		stats["hour_mode_s_only"] = hourModeSOnly
+	}
+
+	// Non-ICAO (anonymous and TIS-B track file) addresses, counted by
+	// sighting as the address can change from one to the next. Sightings
+	// correlated to an ICAO address are already counted under it.
+	var totalNonIcao, todayNonIcao, hourNonIcao, correlatedNonIcao int
+	err = s.pg.db.QueryRow(c.Request.Context(),
+		`SELECT
+			COUNT(*) FILTER (WHERE correlated_hex IS NULL),
+			COUNT(*) FILTER (WHERE correlated_hex IS NULL AND DATE(first_seen) = CURRENT_DATE),
+			COUNT(*) FILTER (WHERE correlated_hex IS NULL AND first_seen >= NOW() - INTERVAL '1 hour'),
+			COUNT(*) FILTER (WHERE correlated_hex IS NOT NULL)
+		FROM aircraft_data
+		WHERE address_type != 'icao' AND `+stationCondition("", 1), station).Scan(&totalNonIcao, &todayNonIcao, &hourNonIcao, &correlatedNonIcao)
+	if err == nil {
+		stats["total_non_icao"] = totalNonIcao
+		stats["today_non_icao"] = todayNonIcao
+		stats["hour_non_icao"] = hourNonIcao
+		stats["correlated_non_icao"] = correlatedNonIcao
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
+// Flights and aircraft seen on each datalink (1090 and UAT). A flight heard on
+// both is counted under each, and under neither of the "only" counts.
+func (s *APIServer) getDatalinkSeenMetrics(c *gin.Context) {
+	station := s.getStation(c)
+
+	query := `
+		SELECT
+			link,
+			COUNT(*),
+			COUNT(*) FILTER (WHERE DATE(first_seen) = CURRENT_DATE),
+			COUNT(*) FILTER (WHERE first_seen >= NOW() - INTERVAL '1 hour'),
+			COUNT(*) FILTER (WHERE cardinality(datalinks) = 1),
+			COUNT(DISTINCT hex),
+			COUNT(DISTINCT hex) FILTER (WHERE DATE(first_seen) = CURRENT_DATE),
+			COUNT(DISTINCT hex) FILTER (WHERE first_seen >= NOW() - INTERVAL '1 hour')
+		FROM aircraft_data, unnest(datalinks) AS link
+		WHERE ` + stationCondition("", 1) + `
+		GROUP BY link
+		ORDER BY link`
+
+	rows, err := s.pg.db.Query(c.Request.Context(), query, station)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	stats := gin.H{}
+	for rows.Next() {
+		var link string
+		var totalFlights, todayFlights, hourFlights, onlyFlights, totalAircraft, todayAircraft, hourAircraft int
+		if err := rows.Scan(&link, &totalFlights, &todayFlights, &hourFlights, &onlyFlights, &totalAircraft, &todayAircraft, &hourAircraft); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		stats[link] = gin.H{
+			"total_flights":  totalFlights,
+			"today_flights":  todayFlights,
+			"hour_flights":   hourFlights,
+			"only_flights":   onlyFlights,
+			"total_aircraft": totalAircraft,
+			"today_aircraft": todayAircraft,
+			"hour_aircraft":  hourAircraft,
+		}
+	}
+
 	c.JSON(http.StatusOK, stats)
 }
 
 func (s *APIServer) getRouteMetrics(c *gin.Context) {
 
 	stats := gin.H{}
+	station := s.getStation(c)
 
 	// Total Routes
 	var total_routes int
-	err := s.pg.db.QueryRow(context.Background(),
+	err := s.pg.db.QueryRow(c.Request.Context(),
 		`SELECT COUNT(*)
 			FROM aircraft_data a
-			INNER JOIN route_data r ON a.flight = r.route_callsign`).Scan(&total_routes)
+			INNER JOIN route_data r ON a.flight = r.route_callsign
+			WHERE `+stationCondition("a.", 1), station).Scan(&total_routes)
 
 	if err == nil {
 		stats["total_routes"] = total_routes
@@ -178,13 +335,13 @@ func (s *APIServer) getRouteMetrics(c *gin.Context) {
 
 	// Unique countries
 	var uniqueCountries int
-	err = s.pg.db.QueryRow(context.Background(),
+	err = s.pg.db.QueryRow(c.Request.Context(),
 		`SELECT COUNT(*) 
 		FROM (
-			SELECT origin_country_name AS country FROM route_data
+			SELECT origin_country_name AS country FROM route_data r WHERE `+stationRouteCondition("r.", 1)+`
 			UNION 
-			SELECT destination_country_name AS country FROM route_data
-		) AS unique_countries`).Scan(&uniqueCountries)
+			SELECT destination_country_name AS country FROM route_data r WHERE `+stationRouteCondition("r.", 1)+`
+		) AS unique_countries`, station).Scan(&uniqueCountries)
 
 	if err == nil {
 		stats["unqiue_countries"] = uniqueCountries
@@ -192,13 +349,13 @@ func (s *APIServer) getRouteMetrics(c *gin.Context) {
 
 	// Unique airports
 	var uniqueAirports int
-	err = s.pg.db.QueryRow(context.Background(),
+	err = s.pg.db.QueryRow(c.Request.Context(),
 		`SELECT COUNT(*) 
 		FROM (
-			SELECT origin_icao_code AS airport FROM route_data
+			SELECT origin_icao_code AS airport FROM route_data r WHERE `+stationRouteCondition("r.", 1)+`
 			UNION 
-			SELECT destination_icao_code AS airport FROM route_data
-		) AS unique_airports`).Scan(&uniqueAirports)
+			SELECT destination_icao_code AS airport FROM route_data r WHERE `+stationRouteCondition("r.", 1)+`
+		) AS unique_airports`, station).Scan(&uniqueAirports)
 
 	if err == nil {
 		stats["unique_airports"] = uniqueAirports
@@ -210,26 +367,28 @@ func (s *APIServer) getRouteMetrics(c *gin.Context) {
 
 func (s *APIServer) getInterestingMetrics(c *gin.Context) {
 	stats := gin.H{}
+	station := s.getStation(c)
 
 	// Interesting aircraft count
 	var interestingCount int
-	err := s.pg.db.QueryRow(context.Background(), "SELECT COUNT(*) FROM interesting_aircraft_seen").Scan(&interestingCount)
+	err := s.pg.db.QueryRow(c.Request.Context(),
+		"SELECT COUNT(*) FROM interesting_aircraft_seen i WHERE "+stationSeenCondition("i.", "seen", 1), station).Scan(&interestingCount)
 	if err == nil {
 		stats["total_interesting"] = interestingCount
 	}
 
 	// Today's interesting aircraft count
 	var todayInterestingCount int
-	err = s.pg.db.QueryRow(context.Background(),
-		"SELECT COUNT(*) FROM interesting_aircraft_seen WHERE DATE(first_seen) = CURRENT_DATE").Scan(&todayInterestingCount)
+	err = s.pg.db.QueryRow(c.Request.Context(),
+		"SELECT COUNT(*) FROM interesting_aircraft_seen i WHERE DATE(seen) = CURRENT_DATE AND "+stationSeenCondition("i.", "seen", 1), station).Scan(&todayInterestingCount)
 	if err == nil {
 		stats["today_interesting"] = todayInterestingCount
 	}
 
 	// Past hour interesting aircraft count
 	var hourInterestingCount int
-	err = s.pg.db.QueryRow(context.Background(),
-		"SELECT COUNT(*) FROM interesting_aircraft_seen WHERE first_seen >= NOW() - INTERVAL '1 hour'").Scan(&hourInterestingCount)
+	err = s.pg.db.QueryRow(c.Request.Context(),
+		"SELECT COUNT(*) FROM interesting_aircraft_seen i WHERE seen >= NOW() - INTERVAL '1 hour' AND "+stationSeenCondition("i.", "seen", 1), station).Scan(&hourInterestingCount)
 	if err == nil {
 		stats["hour_interesting"] = hourInterestingCount
 	}
@@ -240,15 +399,11 @@ func (s *APIServer) getInterestingMetrics(c *gin.Context) {
 
 func (s *APIServer) getAboveStats(c *gin.Context) {
 
-	radiusValue := os.Getenv("ABOVE_RADIUS")
-	radius, err := strconv.Atoi(radiusValue)
-	if err != nil || radius <= 0 {
-		fmt.Println("Error parsing ABOVE_RADIUS environment variable ", err)
-		return
-	}
+	radius := config.Receiver.AboveRadius
 
 	query := `
 		SELECT 
+			ad.id,
 			ad.hex, 
 			ad.flight, 
 			ad.r, 
@@ -289,10 +444,11 @@ func (s *APIServer) getAboveStats(c *gin.Context) {
 		LEFT JOIN route_data rt ON ad.flight = rt.route_callsign
 		WHERE ad.last_seen >= NOW() - INTERVAL '60 seconds'
 			AND ad.last_seen_distance <= $1
+			AND ` + stationCondition("ad.", 2) + `
 		ORDER BY ad.last_seen_distance ASC
 		LIMIT 5;`
 
-	rows, err := s.pg.db.Query(context.Background(), query, radius)
+	rows, err := s.pg.db.Query(c.Request.Context(), query, radius, s.getStation(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -302,10 +458,11 @@ func (s *APIServer) getAboveStats(c *gin.Context) {
 	aircraft := []gin.H{}
 	for rows.Next() {
 		// Core data
+		var id int
 		var hex, flight, registration, aircraftType string
 		var firstSeen, lastSeen *time.Time
-		var track, lastSeenLat, lastSeenLon, lastSeenDistance float64
-		var destinationDistance *float64
+		var lastSeenLat, lastSeenLon, lastSeenDistance float64
+		var track, destinationDistance *float64
 
 		// Registration data
 		var regType, icaoType, manufacturer, registeredOwnerCountryName, registeredOwnerCountryISO, registeredOwnerOperatorFlag, registeredOwner *string
@@ -318,7 +475,7 @@ func (s *APIServer) getAboveStats(c *gin.Context) {
 
 		err := rows.Scan(
 			// Core data
-			&hex, &flight, &registration, &aircraftType, &track,
+			&id, &hex, &flight, &registration, &aircraftType, &track,
 			&firstSeen, &lastSeen, &lastSeenLat, &lastSeenLon, &lastSeenDistance, &destinationDistance,
 
 			// Registration data
@@ -330,12 +487,13 @@ func (s *APIServer) getAboveStats(c *gin.Context) {
 			&originICAOCode, &originName, &destinationCountryName, &destinationCountryISOName,
 			&destinationIATACode, &destinationICAOCode, &destinationName, &routeDistance)
 		if err != nil {
-			fmt.Println("Error in getAboveStats() ", err)
+			apiLog.Error("Error scanning above stats", "error", err)
 			continue
 		}
 
 		aircraft = append(aircraft, gin.H{
 			// Core data
+			"id":                   id,
 			"hex":                  hex,
 			"flight":               flight,
 			"registration":         registration,
@@ -388,8 +546,9 @@ func (s *APIServer) getRecentInterestingAircraft(c *gin.Context, group string) {
 			category, tag1, tag2, tag3, image_link_1, 
 			image_link_2, image_link_3,
 					hex, flight, seen, seen_epoch
-			FROM interesting_aircraft_seen
+			FROM interesting_aircraft_seen i
 			WHERE "group" = $1
+				AND ` + stationSeenCondition("i.", "seen", 3) + `
 			ORDER BY registration, seen DESC
 		)
 		SELECT *
@@ -397,7 +556,7 @@ func (s *APIServer) getRecentInterestingAircraft(c *gin.Context, group string) {
 		ORDER BY seen DESC
 		LIMIT $2`
 
-	rows, err := s.pg.db.Query(context.Background(), query, group, limit)
+	rows, err := s.pg.db.Query(c.Request.Context(), query, group, limit, s.getStation(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -450,11 +609,12 @@ func (s *APIServer) getFastestAircraft(c *gin.Context) {
 	query := `
 		SELECT hex, flight, registration, type, first_seen, last_seen, 
 			   ground_speed, indicated_air_speed, true_air_speed
-		FROM fastest_aircraft 
+		FROM fastest_aircraft m
+		WHERE ` + stationSeenCondition("m.", "first_seen", 2) + `
 		ORDER BY ground_speed DESC 
 		LIMIT $1`
 
-	rows, err := s.pg.db.Query(context.Background(), query, limit)
+	rows, err := s.pg.db.Query(c.Request.Context(), query, limit, s.getStation(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -496,11 +656,12 @@ func (s *APIServer) getSlowestAircraft(c *gin.Context) {
 	query := `
 		SELECT hex, flight, registration, type, first_seen, last_seen, 
 			   ground_speed, indicated_air_speed, true_air_speed
-		FROM slowest_aircraft 
+		FROM slowest_aircraft m
+		WHERE ` + stationSeenCondition("m.", "first_seen", 2) + `
 		ORDER BY ground_speed ASC 
 		LIMIT $1`
 
-	rows, err := s.pg.db.Query(context.Background(), query, limit)
+	rows, err := s.pg.db.Query(c.Request.Context(), query, limit, s.getStation(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -542,11 +703,12 @@ func (s *APIServer) getHighestAircraft(c *gin.Context) {
 	query := `
 		SELECT hex, flight, registration, type, first_seen, last_seen, 
 			   barometric_altitude, geometric_altitude
-		FROM highest_aircraft 
+		FROM highest_aircraft m
+		WHERE ` + stationSeenCondition("m.", "first_seen", 2) + `
 		ORDER BY barometric_altitude DESC 
 		LIMIT $1`
 
-	rows, err := s.pg.db.Query(context.Background(), query, limit)
+	rows, err := s.pg.db.Query(c.Request.Context(), query, limit, s.getStation(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -586,11 +748,12 @@ func (s *APIServer) getLowestAircraft(c *gin.Context) {
 	query := `
 		SELECT hex, flight, registration, type, first_seen, last_seen, 
 			   barometric_altitude, geometric_altitude
-		FROM lowest_aircraft 
+		FROM lowest_aircraft m
+		WHERE ` + stationSeenCondition("m.", "first_seen", 2) + `
 		ORDER BY barometric_altitude ASC 
 		LIMIT $1`
 
-	rows, err := s.pg.db.Query(context.Background(), query, limit)
+	rows, err := s.pg.db.Query(c.Request.Context(), query, limit, s.getStation(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -640,7 +803,7 @@ func (s *APIServer) getTopAircraftTypes(c *gin.Context, period string, flightora
 	default:
 		timeFilter = ""
 	}
-	innerFilter = `WHERE ` + timeFilter + ` t IS NOT NULL AND t != ''`
+	innerFilter = `WHERE ` + timeFilter + ` t IS NOT NULL AND t != '' AND ` + stationCondition("", 1) + ` `
 
 	switch flightoraircraft {
 	case "aircraft":
@@ -665,7 +828,7 @@ func (s *APIServer) getTopAircraftTypes(c *gin.Context, period string, flightora
 
 	// for debugging:
 	// fmt.Printf("Executing query: %s\n", query)
-	rows, err := s.pg.db.Query(context.Background(), query)
+	rows, err := s.pg.db.Query(c.Request.Context(), query, s.getStation(c))
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -711,14 +874,15 @@ func (s *APIServer) getTopRoutes(c *gin.Context) {
 			COUNT(*) as flight_count
 		FROM aircraft_data ad 
 		INNER JOIN route_data rd ON ad.flight = rd.route_callsign
-		WHERE rd.origin_iata_code IS NOT NULL AND rd.origin_iata_code != ''
+		WHERE ` + stationCondition("ad.", 2) + `
+			AND rd.origin_iata_code IS NOT NULL AND rd.origin_iata_code != ''
 			AND rd.destination_iata_code IS NOT NULL AND rd.destination_iata_code != ''
 			AND rd.origin_iata_code != rd.destination_iata_code
 		GROUP BY rd.origin_iata_code, rd.origin_name, rd.destination_iata_code, rd.destination_name
 		ORDER BY flight_count DESC
 		LIMIT $1`
 
-	rows, err := s.pg.db.Query(context.Background(), query, limit)
+	rows, err := s.pg.db.Query(c.Request.Context(), query, limit, s.getStation(c))
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -761,13 +925,14 @@ func (s *APIServer) getTopDestinationCountries(c *gin.Context) {
 			COUNT(*) as flight_count
 		FROM aircraft_data ad 
 		INNER JOIN route_data rd ON ad.flight = rd.route_callsign
-		WHERE rd.destination_country_iso_name IS NOT NULL AND rd.destination_country_iso_name != ''
+		WHERE ` + stationCondition("ad.", 2) + `
+			AND rd.destination_country_iso_name IS NOT NULL AND rd.destination_country_iso_name != ''
 			AND rd.origin_country_iso_name != rd.destination_country_iso_name
 		GROUP BY rd.destination_country_name, destination_country_iso_name
 		ORDER BY flight_count DESC
 		LIMIT $1`
 
-	rows, err := s.pg.db.Query(context.Background(), query, limit)
+	rows, err := s.pg.db.Query(c.Request.Context(), query, limit, s.getStation(c))
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -807,13 +972,14 @@ func (s *APIServer) getTopOriginCountries(c *gin.Context) {
 			COUNT(*) as flight_count
 		FROM aircraft_data ad 
 		INNER JOIN route_data rd ON ad.flight = rd.route_callsign
-		WHERE rd.origin_country_iso_name IS NOT NULL AND rd.origin_country_iso_name != ''
+		WHERE ` + stationCondition("ad.", 2) + `
+			AND rd.origin_country_iso_name IS NOT NULL AND rd.origin_country_iso_name != ''
 			AND rd.destination_country_iso_name != rd.origin_country_iso_name
 		GROUP BY rd.origin_country_name, origin_country_iso_name
 		ORDER BY flight_count DESC
 		LIMIT $1`
 
-	rows, err := s.pg.db.Query(context.Background(), query, limit)
+	rows, err := s.pg.db.Query(c.Request.Context(), query, limit, s.getStation(c))
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -854,7 +1020,8 @@ func (s *APIServer) getTopAirlines(c *gin.Context) {
 			COUNT(*) as flight_count
 		FROM aircraft_data ad 
 		INNER JOIN route_data rd ON ad.flight = rd.route_callsign
-		WHERE rd.airline_name IS NOT NULL AND rd.airline_name != ''
+		WHERE ` + stationCondition("ad.", 2) + `
+			AND rd.airline_name IS NOT NULL AND rd.airline_name != ''
 			AND rd.origin_iata_code != rd.destination_iata_code
 			AND rd.origin_iata_code IS NOT NULL AND rd.origin_iata_code != ''
 			AND rd.destination_iata_code IS NOT NULL AND rd.destination_iata_code != ''
@@ -862,7 +1029,7 @@ func (s *APIServer) getTopAirlines(c *gin.Context) {
 		ORDER BY flight_count DESC
 		LIMIT $1`
 
-	rows, err := s.pg.db.Query(context.Background(), query, limit)
+	rows, err := s.pg.db.Query(c.Request.Context(), query, limit, s.getStation(c))
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -910,7 +1077,8 @@ func (s *APIServer) getTopDomesticAirports(c *gin.Context) {
 				COUNT(*) as flight_count
 			FROM aircraft_data ad
 			INNER JOIN route_data rd ON ad.flight = rd.route_callsign
-			WHERE rd.origin_country_iso_name = $1
+			WHERE ` + stationCondition("ad.", 3) + `
+				AND rd.origin_country_iso_name = $1
 				AND rd.origin_iata_code IS NOT NULL AND rd.origin_iata_code != ''
 				AND rd.destination_iata_code IS NOT NULL AND rd.destination_iata_code != ''
 				AND rd.origin_iata_code != rd.destination_iata_code
@@ -923,7 +1091,8 @@ func (s *APIServer) getTopDomesticAirports(c *gin.Context) {
 				COUNT(*) as flight_count
 			FROM aircraft_data ad
 			INNER JOIN route_data rd ON ad.flight = rd.route_callsign
-			WHERE rd.destination_country_iso_name = $1
+			WHERE ` + stationCondition("ad.", 3) + `
+				AND rd.destination_country_iso_name = $1
 				AND rd.origin_iata_code IS NOT NULL AND rd.origin_iata_code != ''
 				AND rd.destination_iata_code IS NOT NULL AND rd.destination_iata_code != ''
 				AND rd.origin_iata_code != rd.destination_iata_code
@@ -933,7 +1102,7 @@ func (s *APIServer) getTopDomesticAirports(c *gin.Context) {
 		ORDER BY flight_count DESC
 		LIMIT $2`
 
-	rows, err := s.pg.db.Query(context.Background(), query, s.getCountry(), limit)
+	rows, err := s.pg.db.Query(c.Request.Context(), query, s.getCountry(), limit, s.getStation(c))
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -985,7 +1154,8 @@ func (s *APIServer) getChartFlightsOverTime(c *gin.Context, period string) {
 					DATE_TRUNC('month', first_seen)::date AS month,
 					COUNT(*) AS count
 				FROM aircraft_data
-				WHERE first_seen >= DATE_TRUNC('month', CURRENT_DATE - INTERVAL '12 months')
+				WHERE ` + stationCondition("", 1) + `
+					AND first_seen >= DATE_TRUNC('month', CURRENT_DATE - INTERVAL '12 months')
 					AND first_seen < DATE_TRUNC('month', CURRENT_DATE) + INTERVAL '1 month'
 				GROUP BY 1
 				)
@@ -1011,7 +1181,8 @@ func (s *APIServer) getChartFlightsOverTime(c *gin.Context, period string) {
 					DATE(first_seen) AS day,
 					COUNT(*) AS count
 				FROM aircraft_data
-				WHERE first_seen >= CURRENT_DATE - INTERVAL '1 month'
+				WHERE ` + stationCondition("", 1) + `
+					AND first_seen >= CURRENT_DATE - INTERVAL '1 month'
 					AND first_seen < CURRENT_DATE + INTERVAL '1 day'
 				GROUP BY 1
 				)
@@ -1040,7 +1211,8 @@ func (s *APIServer) getChartFlightsOverTime(c *gin.Context, period string) {
 				LEFT JOIN (
 				SELECT date_trunc('hour', first_seen) AS hour, COUNT(*) AS count
 				FROM aircraft_data, end_hour
-				WHERE first_seen >= (SELECT h FROM end_hour) - interval '23 hours'
+				WHERE ` + stationCondition("", 1) + `
+					AND first_seen >= (SELECT h FROM end_hour) - interval '23 hours'
 					AND first_seen <= (SELECT now FROM end_hour)
 				GROUP BY 1
 				) c ON c.hour = gs
@@ -1050,7 +1222,7 @@ func (s *APIServer) getChartFlightsOverTime(c *gin.Context, period string) {
 		return
 	}
 
-	rows, err := s.pg.db.Query(context.Background(), query)
+	rows, err := s.pg.db.Query(c.Request.Context(), query, s.getStation(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -1115,7 +1287,8 @@ func (s *APIServer) getChartAircraftOverTime(c *gin.Context, period string) {
 					DATE_TRUNC('month', first_seen)::date AS month,
 					COUNT(DISTINCT hex) AS count
 				FROM aircraft_data
-				WHERE first_seen >= DATE_TRUNC('month', CURRENT_DATE - INTERVAL '12 months')
+				WHERE ` + stationCondition("", 1) + `
+					AND first_seen >= DATE_TRUNC('month', CURRENT_DATE - INTERVAL '12 months')
 					AND first_seen <  DATE_TRUNC('month', CURRENT_DATE) + INTERVAL '1 month'
 				GROUP BY 1
 				)
@@ -1141,7 +1314,8 @@ func (s *APIServer) getChartAircraftOverTime(c *gin.Context, period string) {
 					DATE(first_seen) AS day,
 					COUNT(DISTINCT hex) AS count
 				FROM aircraft_data
-				WHERE first_seen >= CURRENT_DATE - INTERVAL '1 month'
+				WHERE ` + stationCondition("", 1) + `
+					AND first_seen >= CURRENT_DATE - INTERVAL '1 month'
 					AND first_seen < CURRENT_DATE + INTERVAL '1 day'
 				GROUP BY 1
 				)
@@ -1173,7 +1347,8 @@ func (s *APIServer) getChartAircraftOverTime(c *gin.Context, period string) {
 					date_trunc('hour', first_seen) AS hour,
 					COUNT(DISTINCT hex) AS count
 				FROM aircraft_data, end_hour
-				WHERE first_seen >= (SELECT h FROM end_hour) - interval '23 hours'
+				WHERE ` + stationCondition("", 1) + `
+					AND first_seen >= (SELECT h FROM end_hour) - interval '23 hours'
 					AND first_seen <= (SELECT now FROM end_hour)
 				GROUP BY 1
 				) c ON c.hour = gs
@@ -1183,7 +1358,7 @@ func (s *APIServer) getChartAircraftOverTime(c *gin.Context, period string) {
 		return
 	}
 
-	rows, err := s.pg.db.Query(context.Background(), query)
+	rows, err := s.pg.db.Query(c.Request.Context(), query, s.getStation(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -1244,7 +1419,8 @@ func (s *APIServer) getTopInternationalAirports(c *gin.Context) {
 				COUNT(*) as flight_count
 			FROM aircraft_data ad
 			INNER JOIN route_data rd ON ad.flight = rd.route_callsign
-			WHERE rd.origin_country_iso_name != $1
+			WHERE ` + stationCondition("ad.", 3) + `
+				AND rd.origin_country_iso_name != $1
 				AND rd.origin_iata_code IS NOT NULL AND rd.origin_iata_code != ''
 				AND rd.destination_iata_code IS NOT NULL AND rd.destination_iata_code != ''
 				AND rd.origin_iata_code != rd.destination_iata_code
@@ -1257,7 +1433,8 @@ func (s *APIServer) getTopInternationalAirports(c *gin.Context) {
 				COUNT(*) as flight_count
 			FROM aircraft_data ad
 			INNER JOIN route_data rd ON ad.flight = rd.route_callsign
-			WHERE rd.destination_country_iso_name != $1
+			WHERE ` + stationCondition("ad.", 3) + `
+				AND rd.destination_country_iso_name != $1
 				AND rd.origin_iata_code IS NOT NULL AND rd.origin_iata_code != ''
 				AND rd.destination_iata_code IS NOT NULL AND rd.destination_iata_code != ''
 				AND rd.origin_iata_code != rd.destination_iata_code
@@ -1267,7 +1444,7 @@ func (s *APIServer) getTopInternationalAirports(c *gin.Context) {
 		ORDER BY flight_count DESC
 		LIMIT $2`
 
-	rows, err := s.pg.db.Query(context.Background(), query, s.getCountry(), limit)
+	rows, err := s.pg.db.Query(c.Request.Context(), query, s.getCountry(), limit, s.getStation(c))
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -1306,6 +1483,75 @@ func (s *APIServer) getVersion(c *gin.Context) {
 	})
 }
 
+func (s *APIServer) getStations(c *gin.Context) {
+	c.JSON(http.StatusOK, s.stations)
+}
+
+func (s *APIServer) getReceiver(c *gin.Context) {
+	c.JSON(http.StatusOK, receiverLocation)
+}
+
+func (s *APIServer) getFilters(c *gin.Context) {
+	c.JSON(http.StatusOK, getFilterStatus())
+}
+
+func (s *APIServer) getConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, config.Public())
+}
+
+func (s *APIServer) getSpool(c *gin.Context) {
+
+	status := SpoolStatus{}
+	if spool != nil {
+		status = spool.Status()
+	}
+	status.DatabaseAvailable = pingDatabase(c.Request.Context(), s.pg) == nil
+
+	c.JSON(http.StatusOK, status)
+}
+
+func (s *APIServer) getJobs(c *gin.Context) {
+
+	if scheduler == nil {
+		c.JSON(http.StatusOK, []JobStatus{})
+		return
+	}
+
+	c.JSON(http.StatusOK, scheduler.Status())
+}
+
+// Running a job on demand can mean hundreds of adsbdb lookups, so it needs
+// api.admin_token, and is turned off without one
+func (s *APIServer) runJob(c *gin.Context) {
+
+	if config.API.AdminToken == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "running jobs needs api.admin_token (API_ADMIN_TOKEN) to be set"})
+		return
+	}
+
+	token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(token), []byte(config.API.AdminToken)) != 1 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid admin token"})
+		return
+	}
+
+	if scheduler == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "jobs are not running"})
+		return
+	}
+
+	switch err := scheduler.Trigger(c.Param("name")); err {
+	case nil:
+		c.JSON(http.StatusAccepted, gin.H{"status": "triggered"})
+	case errUnknownJob:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errJobRunning:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
 func (s *APIServer) getLimit(c *gin.Context) int {
 	limitStr := c.DefaultQuery("limit", "5")
 
@@ -1322,5 +1568,31 @@ func (s *APIServer) getLimit(c *gin.Context) int {
 }
 
 func (s *APIServer) getCountry() string {
-	return os.Getenv("DOMESTIC_COUNTRY_ISO")
+	return config.Receiver.DomesticCountryIso
+}
+
+// Optional ?station= filter on the stats endpoints. Empty means all stations.
+func (s *APIServer) getStation(c *gin.Context) string {
+	return c.Query("station")
+}
+
+// SQL condition limiting aircraft_data rows to those seen by the station
+// passed as query parameter n
+func stationCondition(alias string, n int) string {
+	return fmt.Sprintf("($%[1]d::text = '' OR $%[1]d = ANY(%[2]sstations))", n, alias)
+}
+
+// SQL condition for tables derived from aircraft_data (motion, interesting)
+// which are tied back to their aircraft_data session by hex and first seen
+func stationSeenCondition(alias string, seenColumn string, n int) string {
+	return fmt.Sprintf(`($%[1]d::text = '' OR EXISTS (
+		SELECT 1 FROM aircraft_data sad
+		WHERE sad.hex = %[2]shex AND sad.first_seen = %[2]s%[3]s AND $%[1]d = ANY(sad.stations)))`, n, alias, seenColumn)
+}
+
+// SQL condition for route_data rows flown by an aircraft seen by the station
+func stationRouteCondition(alias string, n int) string {
+	return fmt.Sprintf(`($%[1]d::text = '' OR EXISTS (
+		SELECT 1 FROM aircraft_data sad
+		WHERE sad.flight = %[2]sroute_callsign AND $%[1]d = ANY(sad.stations)))`, n, alias)
 }
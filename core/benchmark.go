@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+)
+
+// Rows per call, roughly a busy snapshot or a full page of lookups
+const benchmarkBatchSize = 500
+
+// Times the bulk write paths against the configured database with synthetic
+// rows, which are deleted again afterwards. The hexes are non-ICAO (~bench...)
+// so nothing tries to look them up in the meantime.
+func BenchmarkWrites(ctx context.Context, pg *postgres, rows int) error {
+
+	if rows <= 0 {
+		return fmt.Errorf("benchmark needs a number of rows")
+	}
+
+	nowEpoch := float64(time.Now().Unix())
+
+	aircrafts := make([]Aircraft, rows)
+	for i := range aircrafts {
+		aircrafts[i] = Aircraft{
+			Hex:      fmt.Sprintf("~bench%06x", i),
+			Type:     "adsb_other",
+			Flight:   fmt.Sprintf("BENCH%d", i),
+			Lat:      validFloat(getLat() + float64(i%100)/1000),
+			Lon:      validFloat(getLon() + float64(i/100%100)/1000),
+			AltBaro:  validInt(30000 + i%1000),
+			Gs:       validFloat(450),
+			Track:    validFloat(float64(i % 360)),
+			Stations: []string{defaultStationName},
+		}
+	}
+
+	defer cleanUpBenchmark(writeContext(ctx), pg)
+
+	// Sessions
+	sessionIds := make(map[string]int)
+	elapsed := timeBatches(aircrafts, func(batch []Aircraft) {
+		inserted, err := insertNewAircrafts(ctx, pg, nowEpoch, nil, batch)
+		if err != nil {
+			slog.Error("Unable to insert new sessions", "error", err)
+		}
+		for hex, id := range inserted {
+			sessionIds[hex] = id
+		}
+	})
+	if len(sessionIds) != rows {
+		return fmt.Errorf("only %d of %d sessions were inserted", len(sessionIds), rows)
+	}
+	logBenchmark("insertNewAircrafts", rows, elapsed)
+
+	// Positions
+	var positionIds []int
+	var points []trackPoint
+	for _, aircraft := range aircrafts {
+		positionIds = append(positionIds, sessionIds[aircraft.Hex])
+		points = append(points, trackPoint{
+			time:    time.Unix(int64(nowEpoch), 0),
+			lat:     aircraft.Lat.Float64,
+			lon:     aircraft.Lon.Float64,
+			altBaro: aircraft.AltBaro,
+			gs:      aircraft.Gs,
+			track:   aircraft.Track,
+			source:  aircraft.Type,
+		})
+	}
+	start := time.Now()
+	for i := 0; i < len(points); i += benchmarkBatchSize {
+		end := min(i+benchmarkBatchSize, len(points))
+		if err := insertPositions(ctx, pg, positionIds[i:end], points[i:end]); err != nil {
+			return fmt.Errorf("Unable to insert positions: %w", err)
+		}
+	}
+	logBenchmark("insertPositions", rows, time.Since(start))
+
+	// Processed flags
+	processed := make([]Aircraft, 0, rows)
+	for _, aircraft := range aircrafts {
+		processed = append(processed, Aircraft{Id: sessionIds[aircraft.Hex]})
+	}
+	elapsed = timeBatches(processed, func(batch []Aircraft) {
+		MarkProcessed(ctx, pg, "registration_processed", batch)
+	})
+	logBenchmark("MarkProcessed", rows, elapsed)
+
+	// Registrations
+	registrations := make([]RegistrationInfo, rows)
+	for i, aircraft := range aircrafts {
+		registration := &registrations[i].Response.Aircraft
+		registration.ModeS = aircraft.Hex
+		registration.Registration = fmt.Sprintf("G-B%04d", i)
+		registration.Type = "Benchmark"
+		registration.IcaoType = "BNCH"
+		registration.Manufacturer = "Skystats"
+		registration.RegisteredOwner = "Skystats"
+	}
+	start = time.Now()
+	for i := 0; i < len(registrations); i += benchmarkBatchSize {
+		insertRegistrations(ctx, pg, registrations[i:min(i+benchmarkBatchSize, len(registrations))])
+	}
+	logBenchmark("insertRegistrations", rows, time.Since(start))
+
+	// Routes
+	var template RouteInfo
+	err := json.Unmarshal([]byte(`{
+		"_airport_codes_iata": "LHR-JFK",
+		"_airports": [
+			{"alt_feet": 83, "countryiso2": "GB", "iata": "LHR", "icao": "EGLL", "lat": 51.4706, "lon": -0.461941, "location": "London", "name": "Heathrow"},
+			{"alt_feet": 13, "countryiso2": "US", "iata": "JFK", "icao": "KJFK", "lat": 40.639801, "lon": -73.7789, "location": "New York", "name": "John F Kennedy"}
+		],
+		"airline_code": "BAW",
+		"plausible": true
+	}`), &template)
+	if err != nil {
+		return err
+	}
+	routes := make([]RouteInfo, rows)
+	for i, aircraft := range aircrafts {
+		routes[i] = template
+		routes[i].Callsign = aircraft.Flight
+	}
+	start = time.Now()
+	for i := 0; i < len(routes); i += benchmarkBatchSize {
+		insertRoutes(ctx, pg, routes[i:min(i+benchmarkBatchSize, len(routes))])
+	}
+	logBenchmark("insertRoutes", rows, time.Since(start))
+
+	return nil
+}
+
+func timeBatches(aircrafts []Aircraft, write func(batch []Aircraft)) time.Duration {
+	start := time.Now()
+	for i := 0; i < len(aircrafts); i += benchmarkBatchSize {
+		write(aircrafts[i:min(i+benchmarkBatchSize, len(aircrafts))])
+	}
+	return time.Since(start)
+}
+
+func logBenchmark(name string, rows int, elapsed time.Duration) {
+	slog.Info("Benchmarked write path", "path", name, "rows", rows, "duration", elapsed, "rows_per_second", math.Round(float64(rows)/elapsed.Seconds()))
+}
+
+func cleanUpBenchmark(ctx context.Context, pg *postgres) {
+
+	statements := []string{
+		`DELETE FROM aircraft_data WHERE hex LIKE '~bench%'`,
+		`DELETE FROM registration_data WHERE mode_s LIKE '~bench%'`,
+		`DELETE FROM route_data WHERE route_callsign LIKE 'BENCH%'`,
+	}
+
+	for _, statement := range statements {
+		if _, err := pg.db.Exec(ctx, statement); err != nil {
+			slog.Error("Unable to delete benchmark rows", "error", err)
+		}
+	}
+}
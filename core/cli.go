@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"github.com/golang-migrate/migrate/v4"
+)
+
+// Exit codes, so scripts and service managers can tell what went wrong
+const (
+	exitOK       = 0
+	exitFailed   = 1 // the command ran, but failed
+	exitUsage    = 2 // unknown command, or bad flags or arguments
+	exitConfig   = 3 // invalid configuration
+	exitDatabase = 4 // unable to connect to or migrate the database
+)
+
+type command struct {
+	name  string
+	args  string
+	about string
+	run   func(args []string) int
+}
+
+// Set in init, as help lists them
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "[-foreground]", "record aircraft, run the background jobs and serve the API (default)", runServe},
+		{"migrate", "up | down [steps] | force <version> | version", "apply, roll back or inspect database migrations", runMigrate},
+		{"import", "traces [-station name] <dir> | replay [-speed x] <path>", "import readsb trace_full files, or replay recorded snapshots", runImport},
+		{"export", "sessions [-from date] [-to date] [-station name] [-format csv|json] [-o file]", "export sessions with their registration and route", runExport},
+		{"reprocess", "-from date [-to date] [-only jobs]", "redo registrations, routes, interesting, statistics and correlations for a date range", runReprocess},
+		{"doctor", "", "check the config, readsb, the database and clock skew", runDoctor},
+		{"systemd-unit", "[-user name] [-watchdog seconds]", "print a systemd unit that runs serve -foreground", runSystemdUnit},
+		{"benchmark", "<rows>", "time the bulk write paths with synthetic rows, then remove them", runBenchmark},
+		{"version", "", "print the version", runVersion},
+		{"help", "", "show this help", runHelp},
+	}
+
+	flag.Usage = usage
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: skystats [flags] [command] [arguments]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-13s %s\n", cmd.name, cmd.about)
+		if cmd.args != "" {
+			fmt.Fprintf(out, "  %-13s   %s %s\n", "", cmd.name, cmd.args)
+		}
+	}
+	fmt.Fprintf(out, "\nRun skystats <command> -h for a command's flags. Every setting in\n")
+	fmt.Fprintf(out, "skystats.example.yml can also be given as a flag, e.g. -receiver.radius 500.\n")
+	fmt.Fprintf(out, "\nExit codes: 0 ok, 1 failed, 2 usage, 3 configuration, 4 database\n")
+}
+
+// Runs the command named by the first argument, serve if there isn't one,
+// and returns the exit code
+func runCommand(args []string) int {
+
+	if len(args) == 0 {
+		return runServe(nil)
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd.run(args[1:])
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "skystats: unknown command %q\n\n", args[0])
+	usage()
+	return exitUsage
+}
+
+// A command's flags, which include every config flag so they can be given
+// after the command as well as before it
+func commandFlags(name string, args string) *flag.FlagSet {
+
+	flags := flag.NewFlagSet("skystats "+name, flag.ContinueOnError)
+	addConfigFlags(flags)
+
+	shared := make(map[string]bool)
+	flags.VisitAll(func(f *flag.Flag) {
+		shared[f.Name] = true
+	})
+
+	// Only the command's own flags, as the config flags are the same for all
+	flags.Usage = func() {
+		own := flag.NewFlagSet(name, flag.ContinueOnError)
+		own.SetOutput(flags.Output())
+		flags.VisitAll(func(f *flag.Flag) {
+			if !shared[f.Name] {
+				own.Var(f.Value, f.Name, f.Usage)
+			}
+		})
+
+		fmt.Fprintf(flags.Output(), "Usage: skystats %s %s\n", name, args)
+		own.PrintDefaults()
+		fmt.Fprintf(flags.Output(), "  -config, -env-file, and a flag for every setting in skystats.example.yml\n")
+	}
+
+	return flags
+}
+
+// Parses a command's flags, checks it was given between minArgs and maxArgs
+// arguments, and loads the config. If the command shouldn't go on to run,
+// ok is false and code is the exit code to return.
+func parseCommand(flags *flag.FlagSet, args []string, minArgs int, maxArgs int) (code int, ok bool) {
+
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK, false
+		}
+		return exitUsage, false
+	}
+
+	if n := flags.NArg(); n < minArgs || n > maxArgs {
+		flags.Usage()
+		return exitUsage, false
+	}
+
+	if err := loadConfig(); err != nil {
+		slog.Error("Unable to start", "error", err)
+		return exitConfig, false
+	}
+	setupLogging()
+
+	return exitOK, true
+}
+
+// Runs fn with a connection to an up to date database, see setUp
+func withDatabase(fn func(ctx context.Context, pg *postgres) int) int {
+
+	// Cancelled on SIGINT / SIGTERM
+	ctx := shutdownContext()
+
+	pg, code := setUp(ctx)
+	if pg == nil {
+		return code
+	}
+	defer pg.Close()
+
+	return fn(ctx, pg)
+}
+
+func runServe(args []string) int {
+
+	flags := commandFlags("serve", "[-foreground]")
+	flags.BoolVar(&foreground, "foreground", false, "don't daemonise, for running under systemd or another supervisor")
+	// Before daemonising, so mistakes are shown in the terminal
+	if code, ok := parseCommand(flags, args, 0, 0); !ok {
+		return code
+	}
+
+	return serve(foreground)
+}
+
+func runMigrate(args []string) int {
+
+	flags := commandFlags("migrate", "up | down [steps] | force <version> | version")
+	if code, ok := parseCommand(flags, args, 1, 2); !ok {
+		return code
+	}
+
+	action := flags.Arg(0)
+	if action == "up" {
+		if flags.NArg() != 1 {
+			flags.Usage()
+			return exitUsage
+		}
+		if err := RunDatabaseMigrations(); err != nil {
+			dbLog.Error("Error initialising or migrating the database", "error", err)
+			return exitDatabase
+		}
+		return exitOK
+	}
+
+	var number int
+	switch action {
+	case "down":
+		number = 1
+		if flags.NArg() == 2 {
+			n, err := strconv.Atoi(flags.Arg(1))
+			if err != nil || n < 1 {
+				fmt.Fprintf(os.Stderr, "skystats migrate down: %q is not a number of steps\n", flags.Arg(1))
+				return exitUsage
+			}
+			number = n
+		}
+	case "force":
+		n, err := strconv.Atoi(flags.Arg(1))
+		if flags.NArg() != 2 || err != nil || n < 0 {
+			fmt.Fprintf(os.Stderr, "skystats migrate force: needs the version to mark the database as\n")
+			return exitUsage
+		}
+		number = n
+	case "version":
+		if flags.NArg() != 1 {
+			flags.Usage()
+			return exitUsage
+		}
+	default:
+		flags.Usage()
+		return exitUsage
+	}
+
+	db, err := openMigrationDatabase()
+	if err != nil {
+		dbLog.Error("Unable to open the database", "error", err)
+		return exitDatabase
+	}
+	defer db.Close()
+
+	migrator, err := initMigrator(db)
+	if err != nil {
+		dbLog.Error("Unable to read the migrations", "error", err)
+		return exitDatabase
+	}
+
+	switch action {
+	case "down":
+		dbLog.Info("Rolling back migrations", "steps", number)
+		err = migrator.Steps(-number)
+	case "force":
+		dbLog.Info("Marking the database version", "version", number)
+		err = migrator.Force(number)
+	}
+	if err != nil && err != migrate.ErrNoChange {
+		dbLog.Error("Database migration failed", "error", err)
+		return exitDatabase
+	}
+
+	current, dirty, err := migrator.Version()
+	if err == migrate.ErrNilVersion {
+		fmt.Println("No migrations applied")
+		return exitOK
+	}
+	if err != nil {
+		dbLog.Error("Error reading the database version", "error", err)
+		return exitDatabase
+	}
+
+	latest, err := latestMigration()
+	if err != nil {
+		dbLog.Error("Unable to read the migrations", "error", err)
+		return exitFailed
+	}
+
+	fmt.Printf("Database version %d of %d", current, latest)
+	if dirty {
+		// A migration failed part way, fix it by hand then force the version
+		fmt.Print(" (dirty)")
+	}
+	fmt.Println()
+
+	return exitOK
+}
+
+func runImport(args []string) int {
+
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: skystats import traces [-station name] <dir> | replay [-speed x] <path>\n")
+		return exitUsage
+	}
+
+	switch args[0] {
+	case "traces":
+		flags := commandFlags("import traces", "[-station name] <dir>")
+		station := flags.String("station", defaultStationName, "station name to record against imported traces")
+		if code, ok := parseCommand(flags, args[1:], 1, 1); !ok {
+			return code
+		}
+
+		return withDatabase(func(ctx context.Context, pg *postgres) int {
+			ingestLog.Info("Importing trace files", "path", flags.Arg(0))
+			if err := ImportTraces(ctx, pg, flags.Arg(0), *station); err != nil {
+				ingestLog.Error("Error importing trace files", "error", err)
+				return exitFailed
+			}
+			return exitOK
+		})
+
+	case "replay":
+		flags := commandFlags("import replay", "[-speed x] <path>")
+		speed := flags.Float64("speed", 1, "replay speed multiplier, 0 replays as fast as possible")
+		if code, ok := parseCommand(flags, args[1:], 1, 1); !ok {
+			return code
+		}
+
+		return withDatabase(func(ctx context.Context, pg *postgres) int {
+			ingestLog.Info("Replaying recorded snapshots", "path", flags.Arg(0), "speed", *speed)
+			if err := ReplayArchives(ctx, pg, flags.Arg(0), *speed); err != nil {
+				ingestLog.Error("Error replaying snapshots", "error", err)
+				return exitFailed
+			}
+			return exitOK
+		})
+	}
+
+	fmt.Fprintf(os.Stderr, "skystats import: unknown source %q, expected traces or replay\n", args[0])
+	return exitUsage
+}
+
+func runBenchmark(args []string) int {
+
+	flags := commandFlags("benchmark", "<rows>")
+	if code, ok := parseCommand(flags, args, 1, 1); !ok {
+		return code
+	}
+
+	rows, err := strconv.Atoi(flags.Arg(0))
+	if err != nil || rows <= 0 {
+		fmt.Fprintf(os.Stderr, "skystats benchmark: %q is not a number of rows\n", flags.Arg(0))
+		return exitUsage
+	}
+
+	return withDatabase(func(ctx context.Context, pg *postgres) int {
+		slog.Info("Benchmarking writes", "rows", rows)
+		if err := BenchmarkWrites(ctx, pg, rows); err != nil {
+			slog.Error("Error benchmarking writes", "error", err)
+			return exitFailed
+		}
+		return exitOK
+	})
+}
+
+func runVersion(args []string) int {
+	fmt.Printf("skystats %s (commit %s) build %s\n", version, commit, date)
+	return exitOK
+}
+
+func runHelp(args []string) int {
+	flag.CommandLine.SetOutput(os.Stdout)
+	usage()
+	return exitOK
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Every setting, loaded once at startup by loadConfig. Each one can be set in
+// the config file (by its yaml key, which is also its TOML key), by its
+// environment variable (env tag),
+// or by a flag named after its path in the file, e.g. -receiver.radius 500.
+// Later sources override earlier ones: defaults, file, environment, flags.
+//
+// The env tag of a section is a prefix for the variables inside it. Settings
+// tagged secret are blanked out at /api/config.
+type Config struct {
+	Database        DatabaseConfig      `yaml:"database"`
+	Receiver        ReceiverConfig      `yaml:"receiver"`
+	Readsb          ReadsbConfig        `yaml:"readsb"`
+	API             APIConfig           `yaml:"api"`
+	Filters         FiltersConfig       `yaml:"filters"`
+	Ingest          IngestConfig        `yaml:"ingest"`
+	Acars           AcarsConfig         `yaml:"acars"`
+	Registrations   RegistrationsConfig `yaml:"registrations"`
+	Routes          RoutesConfig        `yaml:"routes"`
+	Interesting     InterestingConfig   `yaml:"interesting"`
+	Statistics      StatisticsConfig    `yaml:"statistics"`
+	Correlation     CorrelationConfig   `yaml:"correlation"`
+	Sessions        SessionsConfig      `yaml:"sessions"`
+	Positions       PositionsConfig     `yaml:"positions"`
+	Record          RecordConfig        `yaml:"record"`
+	Spool           SpoolConfig         `yaml:"spool"`
+	Jobs            JobsConfig          `yaml:"jobs"`
+	Log             LogConfig           `yaml:"log"`
+	ShutdownTimeout float64             `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+}
+
+type DatabaseConfig struct {
+	Host     string `yaml:"host" env:"DB_HOST"`
+	Port     int    `yaml:"port" env:"DB_PORT"`
+	User     string `yaml:"user" env:"DB_USER"`
+	Password string `yaml:"password" env:"DB_PASSWORD" secret:"true"`
+	Name     string `yaml:"name" env:"DB_NAME"`
+}
+
+type ReceiverConfig struct {
+	Lat                *float64 `yaml:"lat" env:"LAT"`
+	Lon                *float64 `yaml:"lon" env:"LON"`
+	Radius             float64  `yaml:"radius" env:"RADIUS"`
+	AboveRadius        int      `yaml:"above_radius" env:"ABOVE_RADIUS"`
+	DomesticCountryIso string   `yaml:"domestic_country_iso" env:"DOMESTIC_COUNTRY_ISO"`
+	ModeSOnly          string   `yaml:"mode_s_only" env:"MODE_S_ONLY"`
+}
+
+type ReadsbConfig struct {
+	AircraftJson string `yaml:"aircraft_json" env:"READSB_AIRCRAFT_JSON"`
+	ReceiverJson string `yaml:"receiver_json" env:"READSB_RECEIVER_JSON"`
+	Sbs          string `yaml:"sbs" env:"READSB_SBS"`
+	Beast        string `yaml:"beast" env:"READSB_BEAST"`
+	Sources      string `yaml:"sources" env:"READSB_SOURCES"`
+
+	FetchTimeoutSeconds float64 `yaml:"fetch_timeout_seconds" env:"READSB_FETCH_TIMEOUT_SECONDS"`
+}
+
+type APIConfig struct {
+	Port       int    `yaml:"port" env:"API_PORT"`
+	WebDir     string `yaml:"web_dir" env:"WEB_DIR"`
+	AdminToken string `yaml:"admin_token" env:"API_ADMIN_TOKEN" secret:"true"`
+}
+
+type FiltersConfig struct {
+	File string `yaml:"file" env:"FILTERS_FILE"`
+}
+
+type IngestConfig struct {
+	Feeders       string  `yaml:"feeders" env:"INGEST_FEEDERS" secret:"true"`
+	MaxLagSeconds float64 `yaml:"max_lag_seconds" env:"INGEST_MAX_LAG_SECONDS"`
+}
+
+type AcarsConfig struct {
+	Sources    string `yaml:"sources" env:"ACARS_SOURCES"`
+	MaxPending int    `yaml:"max_pending" env:"ACARS_MAX_PENDING"`
+}
+
+type RegistrationsConfig struct {
+	BatchSize int `yaml:"batch_size" env:"REGISTRATIONS_BATCH_SIZE"`
+}
+
+type RoutesConfig struct {
+	BatchSize     int     `yaml:"batch_size" env:"ROUTES_BATCH_SIZE"`
+	MaxAgeSeconds float64 `yaml:"max_age_seconds" env:"ROUTES_MAX_AGE_SECONDS"`
+	CacheSeconds  float64 `yaml:"cache_seconds" env:"ROUTES_CACHE_SECONDS"`
+}
+
+type InterestingConfig struct {
+	BatchSize     int    `yaml:"batch_size" env:"INTERESTING_BATCH_SIZE"`
+	PlaneAlertUrl string `yaml:"plane_alert_db_url" env:"PLANE_DB_URL"`
+}
+
+type StatisticsConfig struct {
+	KeepRows int `yaml:"keep_rows" env:"STATISTICS_KEEP_ROWS"`
+}
+
+type CorrelationConfig struct {
+	NonIcao   bool `yaml:"non_icao" env:"CORRELATE_NON_ICAO"`
+	BatchSize int  `yaml:"batch_size" env:"CORRELATION_BATCH_SIZE"`
+}
+
+type SessionsConfig struct {
+	FlushSeconds float64 `yaml:"flush_seconds" env:"LIVE_FLUSH_SECONDS"`
+}
+
+type PositionsConfig struct {
+	MinInterval float64 `yaml:"min_interval" env:"POSITION_MIN_INTERVAL"`
+	MinDistance float64 `yaml:"min_distance" env:"POSITION_MIN_DISTANCE"`
+}
+
+type RecordConfig struct {
+	Dir           string `yaml:"dir" env:"RECORD_DIR"`
+	RetentionDays int    `yaml:"retention_days" env:"RECORD_RETENTION_DAYS"`
+}
+
+type SpoolConfig struct {
+	Dir   string `yaml:"dir" env:"SPOOL_DIR"`
+	MaxMb int64  `yaml:"max_mb" env:"SPOOL_MAX_MB"`
+}
+
+type JobsConfig struct {
+	Aircraft      JobConfig `yaml:"aircraft" env:"JOB_AIRCRAFT"`
+	Statistics    JobConfig `yaml:"statistics" env:"JOB_STATISTICS"`
+	Registrations JobConfig `yaml:"registrations" env:"JOB_REGISTRATIONS"`
+	Routes        JobConfig `yaml:"routes" env:"JOB_ROUTES"`
+	Interesting   JobConfig `yaml:"interesting" env:"JOB_INTERESTING"`
+	Acars         JobConfig `yaml:"acars" env:"JOB_ACARS"`
+	Correlations  JobConfig `yaml:"correlations" env:"JOB_CORRELATIONS"`
+}
+
+// See setupLogging
+type LogConfig struct {
+	Level  string `yaml:"level" env:"LOG_LEVEL"`
+	Format string `yaml:"format" env:"LOG_FORMAT"`
+	Levels string `yaml:"levels" env:"LOG_LEVELS"`
+}
+
+// In seconds, see Job
+type JobConfig struct {
+	Interval float64 `yaml:"interval" env:"INTERVAL"`
+	Jitter   float64 `yaml:"jitter" env:"JITTER"`
+	Timeout  float64 `yaml:"timeout" env:"TIMEOUT"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Database: DatabaseConfig{Port: 5432},
+		Receiver: ReceiverConfig{AboveRadius: 20, ModeSOnly: modeSOnlyInclude},
+		Readsb:   ReadsbConfig{FetchTimeoutSeconds: 5},
+		API:      APIConfig{Port: 8080},
+		Ingest:   IngestConfig{MaxLagSeconds: 300},
+		Acars:    AcarsConfig{MaxPending: 10000},
+
+		Registrations: RegistrationsConfig{BatchSize: 50},
+		Routes:        RoutesConfig{BatchSize: 100, MaxAgeSeconds: 3600, CacheSeconds: 600},
+		Interesting:   InterestingConfig{BatchSize: 1000},
+		Statistics:    StatisticsConfig{KeepRows: 50},
+		Correlation:   CorrelationConfig{BatchSize: 100},
+
+		Sessions:  SessionsConfig{FlushSeconds: 10},
+		Positions: PositionsConfig{MinInterval: 15},
+		Spool:     SpoolConfig{MaxMb: 512},
+		Jobs: JobsConfig{
+			Aircraft:      JobConfig{Interval: 2, Jitter: 0, Timeout: 30},
+			Statistics:    JobConfig{Interval: 120, Jitter: 10, Timeout: 120},
+			Registrations: JobConfig{Interval: 30, Jitter: 5, Timeout: 120},
+			Routes:        JobConfig{Interval: 300, Jitter: 30, Timeout: 120},
+			Interesting:   JobConfig{Interval: 120, Jitter: 10, Timeout: 120},
+			Acars:         JobConfig{Interval: 30, Jitter: 5, Timeout: 60},
+			Correlations:  JobConfig{Interval: 120, Jitter: 10, Timeout: 120},
+		},
+		Log:             LogConfig{Level: "info", Format: "text"},
+		ShutdownTimeout: 30,
+	}
+}
+
+var config = defaultConfig()
+
+var (
+	configFile string
+	envFile    string
+	// Settings given as flags, applied in order after the environment
+	configFlags []configFlag
+)
+
+type configFlag struct {
+	path  string
+	value string
+}
+
+func init() {
+	addConfigFlags(flag.CommandLine)
+}
+
+// Registers -config, -env-file and a flag for every setting, named after its
+// path in the config file. They can be given before or after the command.
+func addConfigFlags(flags *flag.FlagSet) {
+	flags.StringVar(&configFile, "config", configFile, "path to a YAML, or .toml, config file, see skystats.example.yml (or set SKYSTATS_CONFIG)")
+	flags.StringVar(&envFile, "env-file", envFile, "path to a .env file (default .env, then ../.env)")
+
+	defaults := defaultConfig()
+	for _, field := range configFields(&defaults) {
+		usage := "sets " + field.path
+		if field.env != "" {
+			usage += ", overrides " + field.env
+		}
+		flags.Func(field.path, usage, func(value string) error {
+			configFlags = append(configFlags, configFlag{path: field.path, value: value})
+			return nil
+		})
+	}
+}
+
+// A setting, found by walking Config
+type configField struct {
+	path   string
+	env    string
+	secret bool
+	value  reflect.Value
+}
+
+func configFields(cfg *Config) []configField {
+
+	var fields []configField
+
+	var walk func(v reflect.Value, path string, envPrefix string)
+	walk = func(v reflect.Value, path string, envPrefix string) {
+		for i := 0; i < v.NumField(); i++ {
+			structField := v.Type().Field(i)
+
+			name := structField.Tag.Get("yaml")
+			if path != "" {
+				name = path + "." + name
+			}
+			env := structField.Tag.Get("env")
+			if envPrefix != "" && env != "" {
+				env = envPrefix + "_" + env
+			}
+
+			if structField.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), name, env)
+				continue
+			}
+
+			fields = append(fields, configField{
+				path:   name,
+				env:    env,
+				secret: structField.Tag.Get("secret") == "true",
+				value:  v.Field(i),
+			})
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem(), "", "")
+
+	return fields
+}
+
+func (field configField) set(value string) error {
+
+	value = strings.TrimSpace(value)
+
+	switch field.value.Kind() {
+	case reflect.String:
+		field.value.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %q", value)
+		}
+		field.value.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("expected a whole number, got %q", value)
+		}
+		field.value.SetInt(i)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("expected a number, got %q", value)
+		}
+		field.value.SetFloat(f)
+	// Settings where being set to 0 and not being set at all differ
+	case reflect.Pointer:
+		elem := reflect.New(field.value.Type().Elem())
+		if err := (configField{value: elem.Elem()}).set(value); err != nil {
+			return err
+		}
+		field.value.Set(elem)
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.value.Kind())
+	}
+
+	return nil
+}
+
+// Loads the .env file, then the config from the defaults, the config file
+// (-config or SKYSTATS_CONFIG), the environment and flags, and validates it.
+// Every problem found is returned, not just the first.
+func loadConfig() error {
+
+	if err := loadEnvFile(); err != nil {
+		return err
+	}
+
+	cfg := defaultConfig()
+
+	if configFile == "" {
+		configFile = os.Getenv("SKYSTATS_CONFIG")
+	}
+	if configFile != "" {
+		// The daemon runs from the executable's directory, see serve
+		if abs, err := filepath.Abs(configFile); err == nil {
+			configFile = abs
+		}
+		if err := readConfigFile(&cfg, configFile); err != nil {
+			return err
+		}
+	}
+
+	fields := configFields(&cfg)
+	byPath := make(map[string]configField, len(fields))
+
+	var errs []error
+	for _, field := range fields {
+		byPath[field.path] = field
+
+		// Empty variables are treated as unset, as they are in .env files
+		if value := os.Getenv(field.env); field.env != "" && value != "" {
+			if err := field.set(value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", field.env, err))
+			}
+		}
+	}
+
+	for _, f := range configFlags {
+		if err := byPath[f.path].set(f.value); err != nil {
+			errs = append(errs, fmt.Errorf("-%s: %w", f.path, err))
+		}
+	}
+
+	errs = append(errs, cfg.validate()...)
+	if len(errs) > 0 {
+		problems := make([]string, len(errs))
+		for i, err := range errs {
+			problems[i] = err.Error()
+		}
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	config = cfg
+	return nil
+}
+
+// An -env-file that doesn't exist is an error, the defaults are optional
+func loadEnvFile() error {
+
+	if envFile != "" {
+		if err := godotenv.Load(envFile); err != nil {
+			return fmt.Errorf("unable to load -env-file %s: %w", envFile, err)
+		}
+		return nil
+	}
+
+	// ../.env is where it is when running from core/ in a checkout
+	for _, file := range []string{".env", "../.env"} {
+		if err := godotenv.Load(file); err == nil {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// Reads a YAML config file, or TOML if it ends in .toml
+func readConfigFile(cfg *Config, file string) error {
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("unable to read config file: %w", err)
+	}
+
+	if strings.EqualFold(filepath.Ext(file), ".toml") {
+		if err := readTomlConfig(cfg, data); err != nil {
+			return fmt.Errorf("invalid config file %s: %w", file, err)
+		}
+		return nil
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	// An empty file is fine, it leaves the defaults
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config file %s: %w", file, err)
+	}
+
+	return nil
+}
+
+// Sets each value in a TOML config by its path, the same as a flag, so
+// unknown keys and values of the wrong type are errors as they are in YAML
+func readTomlConfig(cfg *Config, data []byte) error {
+
+	var values map[string]any
+	if err := toml.Unmarshal(data, &values); err != nil {
+		return err
+	}
+
+	byPath := make(map[string]configField)
+	for _, field := range configFields(cfg) {
+		byPath[field.path] = field
+	}
+
+	var errs []string
+
+	var walk func(values map[string]any, path string)
+	walk = func(values map[string]any, path string) {
+		for key, value := range values {
+			if path != "" {
+				key = path + "." + key
+			}
+
+			switch value := value.(type) {
+			case map[string]any:
+				walk(value, key)
+				continue
+			case []any:
+				errs = append(errs, fmt.Sprintf("%s: expected a single value, got a list", key))
+				continue
+			}
+
+			field, ok := byPath[key]
+			if !ok {
+				errs = append(errs, fmt.Sprintf("%s: unknown setting", key))
+				continue
+			}
+			if err := field.set(fmt.Sprint(value)); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", key, err))
+			}
+		}
+	}
+	walk(values, "")
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errors.New(strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+func (cfg *Config) validate() []error {
+
+	envs := make(map[string]string)
+	for _, field := range configFields(cfg) {
+		envs[field.path] = field.env
+	}
+
+	var errs []error
+	check := func(ok bool, path string, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s (%s): "+format, append([]any{path, envs[path]}, args...)...))
+		}
+	}
+
+	check(cfg.Database.Host != "", "database.host", "must be set")
+	check(cfg.Database.Port > 0 && cfg.Database.Port < 65536, "database.port", "must be a port number, got %d", cfg.Database.Port)
+	check(cfg.Database.User != "", "database.user", "must be set")
+	check(cfg.Database.Name != "", "database.name", "must be set")
+
+	if lat := cfg.Receiver.Lat; lat != nil {
+		check(*lat >= -90 && *lat <= 90, "receiver.lat", "must be between -90 and 90, got %v", *lat)
+	}
+	if lon := cfg.Receiver.Lon; lon != nil {
+		check(*lon >= -180 && *lon <= 180, "receiver.lon", "must be between -180 and 180, got %v", *lon)
+	}
+	// 0 would drop every aircraft with a position, unless polygons in
+	// FILTERS_FILE replace the radius, which loadFilters checks
+	check(cfg.Receiver.Radius > 0 || (cfg.Receiver.Radius == 0 && cfg.Filters.File != ""), "receiver.radius", "must be more than 0, unless FILTERS_FILE has polygons, got %v", cfg.Receiver.Radius)
+	check(cfg.Receiver.AboveRadius > 0, "receiver.above_radius", "must be more than 0")
+
+	switch cfg.Receiver.ModeSOnly {
+	case modeSOnlyInclude, modeSOnlyRanged, modeSOnlyExclude:
+	default:
+		check(false, "receiver.mode_s_only", "must be %s, %s or %s, got %q", modeSOnlyInclude, modeSOnlyRanged, modeSOnlyExclude, cfg.Receiver.ModeSOnly)
+	}
+
+	check(cfg.Readsb.FetchTimeoutSeconds > 0, "readsb.fetch_timeout_seconds", "must be more than 0")
+	check(cfg.API.Port > 0 && cfg.API.Port < 65536, "api.port", "must be a port number, got %d", cfg.API.Port)
+
+	check(cfg.Ingest.MaxLagSeconds > 0, "ingest.max_lag_seconds", "must be more than 0")
+	check(cfg.Acars.MaxPending > 0, "acars.max_pending", "must be more than 0")
+	check(cfg.Registrations.BatchSize > 0, "registrations.batch_size", "must be more than 0")
+	check(cfg.Routes.BatchSize > 0, "routes.batch_size", "must be more than 0")
+	check(cfg.Routes.MaxAgeSeconds > 0, "routes.max_age_seconds", "must be more than 0")
+	check(cfg.Routes.CacheSeconds >= 0, "routes.cache_seconds", "can't be negative")
+	check(cfg.Interesting.BatchSize > 0, "interesting.batch_size", "must be more than 0")
+	check(cfg.Statistics.KeepRows > 0, "statistics.keep_rows", "must be more than 0")
+	check(cfg.Correlation.BatchSize > 0, "correlation.batch_size", "must be more than 0")
+
+	check(cfg.Sessions.FlushSeconds >= 0, "sessions.flush_seconds", "can't be negative")
+	check(cfg.Positions.MinInterval >= 0, "positions.min_interval", "can't be negative")
+	check(cfg.Positions.MinDistance >= 0, "positions.min_distance", "can't be negative")
+	check(cfg.Record.RetentionDays >= 0, "record.retention_days", "can't be negative")
+	check(cfg.Spool.MaxMb > 0, "spool.max_mb", "must be more than 0")
+
+	jobs := reflect.ValueOf(cfg.Jobs)
+	for i := 0; i < jobs.NumField(); i++ {
+		job := jobs.Field(i).Interface().(JobConfig)
+		path := "jobs." + jobs.Type().Field(i).Tag.Get("yaml")
+		check(job.Interval > 0, path+".interval", "must be more than 0")
+		check(job.Jitter >= 0, path+".jitter", "can't be negative")
+		check(job.Timeout > 0, path+".timeout", "must be more than 0")
+	}
+
+	_, err := parseLogLevel(cfg.Log.Level)
+	check(err == nil, "log.level", "%v", err)
+	check(cfg.Log.Format == "text" || cfg.Log.Format == "json", "log.format", "must be text or json, got %q", cfg.Log.Format)
+	_, err = parseLogLevels(cfg.Log.Levels)
+	check(err == nil, "log.levels", "%v", err)
+
+	check(cfg.ShutdownTimeout > 0, "shutdown_timeout", "must be more than 0")
+
+	return errs
+}
+
+// The config in use, as it would be written in the config file, without
+// passwords or tokens
+func (cfg Config) Public() map[string]any {
+
+	public := make(map[string]any)
+
+	for _, field := range configFields(&cfg) {
+
+		section := public
+		keys := strings.Split(field.path, ".")
+		for _, key := range keys[:len(keys)-1] {
+			if _, ok := section[key]; !ok {
+				section[key] = make(map[string]any)
+			}
+			section = section[key].(map[string]any)
+		}
+
+		value := field.value.Interface()
+		if field.secret && field.value.String() != "" {
+			value = "********"
+		}
+		section[keys[len(keys)-1]] = value
+	}
+
+	return public
+}
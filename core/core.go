@@ -2,30 +2,31 @@ package main
 
 import (
 	"context"
+	_ "embed"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"time"
 
-	"github.com/joho/godotenv"
 	"github.com/sevlyar/go-daemon"
 )
 
-func main() {
+//go:embed banner.txt
+var banner string
 
+func main() {
 	checkFlags()
+	os.Exit(runCommand(flag.Args()))
+}
 
-	// Load .env file
-	if err := godotenv.Load("../.env"); err != nil {
-		if err := godotenv.Load(); err != nil {
-			log.Println("No .env file found, using environment variables")
-		}
-	}
+// Runs skystats: polls readsb, runs the background jobs and serves the API
+// until stopped. Outside of docker it runs as a daemon, unless foreground is
+// set, e.g. to run under systemd (see runSystemdUnit).
+func serve(foreground bool) int {
 
-	// If running outside of docker, run as a daemon
-	if os.Getenv("DOCKER_ENV") != "true" {
+	if !foreground && os.Getenv("DOCKER_ENV") != "true" {
 		execPath, _ := os.Executable()
 		execDir := filepath.Dir(execPath)
 
@@ -40,91 +41,214 @@ func main() {
 
 		d, err := cntxt.Reborn()
 		if err != nil {
-			fmt.Println("Unable to run: ", err)
-			log.Fatal("Unable to run: ", err)
+			slog.Error("Unable to run", "error", err)
+			return exitFailed
 		}
 		if d != nil {
-			return
+			return exitOK
 		}
 		defer cntxt.Release()
 
-		log.Print("Skystats: Running in daemon mode")
+		slog.Info("Running in daemon mode")
+	}
+
+	// Welcome to skystats, unless the logs are being read by a machine
+	if config.Log.Format == "text" {
+		fmt.Fprintln(os.Stderr, banner)
+	}
+
+	// Cancelled on SIGINT / SIGTERM
+	ctx := shutdownContext()
+
+	pg, code := setUp(ctx)
+	if pg == nil {
+		return code
+	}
+
+	slog.Info("Updating database with plane-alert-db data")
+	if err := UpsertPlaneAlertDb(ctx, pg); err != nil {
+		slog.Error("Error updating interesting aircraft data", "error", err)
+		return exitFailed
 	}
 
-	// Welcome to skystats
-	if banner, err := os.ReadFile("../docs/logo/skystats_ascii.txt"); err == nil {
-		log.Print("\n" + string(banner))
+	slog.Info("Loading active sessions")
+	if err := warmLiveState(ctx, pg); err != nil {
+		slog.Error("Error loading active sessions", "error", err)
+		return exitDatabase
 	}
 
-	url := GetConnectionUrl()
-	log.Printf("Connecting to postgres database...")
-	pg, err := NewPG(context.Background(), url)
+	recorder, err := getRecorder()
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		slog.Error("Error setting up snapshot recording", "error", err)
+		return exitFailed
 	}
 
-	// Setup db
-	log.Println("Running database initialisation / migrations...")
-	if err := RunDatabaseMigrations(); err != nil {
-		log.Printf("Error initialising or migrating the database: %v", err)
-		os.Exit(1)
+	source, err := NewAircraftSource(ctx, recorder)
+	if err != nil {
+		slog.Error("Error configuring aircraft sources", "error", err)
+		return exitConfig
 	}
 
-	log.Println("Updating database with plane-alert-db data...")
-	if err := UpsertPlaneAlertDb(pg); err != nil {
-		log.Printf("Error updating interesting aircraft data: %v", err)
-		os.Exit(1)
+	spool, err = getSpool(ctx)
+	if err != nil {
+		slog.Error("Error setting up the spool", "error", err)
+		return exitFailed
+	}
+
+	if err := loadIngestFeeders(source.StationNames()); err != nil {
+		slog.Error("Error configuring ingest feeders", "error", err)
+		return exitConfig
+	}
+
+	if err := startAcarsSources(ctx); err != nil {
+		slog.Error("Error configuring ACARS sources", "error", err)
+		return exitConfig
 	}
 
 	// Start API server in a separate goroutine
-	log.Println("Starting API server...")
-	go func() {
-		apiServer := NewAPIServer(pg)
-		apiServer.Start()
-	}()
-
-	updateAircraftDataTicker := time.NewTicker(2 * time.Second)
-	updateStatisticsTicker := time.NewTicker(120 * time.Second)
-	updateRegistrationsTicker := time.NewTicker(30 * time.Second)
-	updateRoutesTicker := time.NewTicker(300 * time.Second)
-	updateInterestingSeenTicker := time.NewTicker(120 * time.Second)
-
-	defer func() {
-		fmt.Println("Closing database connection")
-		updateAircraftDataTicker.Stop()
-		updateStatisticsTicker.Stop()
-		updateRegistrationsTicker.Stop()
-		updateRoutesTicker.Stop()
-		updateInterestingSeenTicker.Stop()
-		pg.Close()
-	}()
-
-	for {
-		select {
-		case <-updateAircraftDataTicker.C:
-			fmt.Println("Update Aircraft: ", time.Now().Format("2006-01-02 15:04:05"))
-			updateAircraftDatabase(pg)
-		case <-updateStatisticsTicker.C:
-			fmt.Println("Update Statistics: ", time.Now().Format("2006-01-02 15:04:05"))
-			updateMeasurementStatistics(pg)
-		case <-updateRegistrationsTicker.C:
-			fmt.Println("Update Registrations: ", time.Now().Format("2006-01-02 15:04:05"))
-			updateRegistrations(pg)
-		case <-updateRoutesTicker.C:
-			fmt.Println("Update Routes: ", time.Now().Format("2006-01-02 15:04:05"))
-			updateRoutes(pg)
-		case <-updateInterestingSeenTicker.C:
-			fmt.Println("Update Interesting Seen: ", time.Now().Format("2006-01-02 15:04:05"))
-			updateInterestingSeen(pg)
+	slog.Info("Starting API server", "port", config.API.Port)
+	apiServer := NewAPIServer(ctx, pg, append(source.StationNames(), ingestFeederNames()...))
+	go apiServer.Start()
+
+	scheduler = newScheduler(pg, source)
+	scheduler.Start(ctx)
+
+	if err := sdNotify("READY=1\nSTATUS=Recording aircraft"); err != nil {
+		slog.Warn("Unable to notify systemd", "error", err)
+	}
+	if interval := watchdogInterval(); interval > 0 {
+		go runWatchdog(ctx, interval)
+	}
+
+	<-ctx.Done()
+
+	if err := sdNotify("STOPPING=1"); err != nil {
+		slog.Warn("Unable to notify systemd", "error", err)
+	}
+
+	// Let runs in progress finish before writing what's left
+	slog.Info("Waiting for jobs to finish")
+	scheduler.Wait()
+
+	shutdown(ctx, pg, apiServer, recorder)
+	return exitOK
+}
+
+// Everything the commands that write aircraft need: the receiver location,
+// the filters, and a connection to an up to date database. Returns a nil
+// connection and the exit code if any of them fail.
+func setUp(ctx context.Context) (*postgres, int) {
+
+	slog.Info("Resolving receiver location")
+	if err := resolveReceiverLocation(ctx); err != nil {
+		slog.Error("Unable to start", "error", err)
+		if ctx.Err() != nil {
+			return nil, exitFailed
 		}
+		return nil, exitConfig
+	}
+
+	if err := loadFilters(); err != nil {
+		slog.Error("Unable to start", "error", err)
+		return nil, exitConfig
+	}
+
+	slog.Info("Connecting to postgres database")
+	pg, err := NewPG(ctx, GetConnectionUrl())
+	if err != nil {
+		slog.Error("Unable to connect to the database", "error", err)
+		return nil, exitDatabase
+	}
+
+	// Setup db
+	slog.Info("Running database initialisation / migrations")
+	if err := RunDatabaseMigrations(); err != nil {
+		slog.Error("Error initialising or migrating the database", "error", err)
+		pg.Close()
+		return nil, exitDatabase
 	}
 
+	return pg, exitOK
+}
+
+// The background jobs, scheduled as set in config.Jobs
+func newScheduler(pg *postgres, source AircraftSource) *Scheduler {
+	return NewScheduler(
+		NewJob("aircraft", config.Jobs.Aircraft, func(ctx context.Context) error {
+			return updateAircraftDatabase(ctx, pg, source)
+		}),
+		NewJob("statistics", config.Jobs.Statistics, func(ctx context.Context) error {
+			return updateMeasurementStatistics(ctx, pg)
+		}),
+		NewJob("registrations", config.Jobs.Registrations, func(ctx context.Context) error {
+			return updateRegistrations(ctx, pg)
+		}),
+		NewJob("routes", config.Jobs.Routes, func(ctx context.Context) error {
+			return updateRoutes(ctx, pg)
+		}),
+		NewJob("interesting", config.Jobs.Interesting, func(ctx context.Context) error {
+			return updateInterestingSeen(ctx, pg)
+		}),
+		NewJob("acars", config.Jobs.Acars, func(ctx context.Context) error {
+			return updateAcarsMessages(ctx, pg)
+		}),
+		NewJob("correlations", config.Jobs.Correlations, func(ctx context.Context) error {
+			return updateNonIcaoCorrelations(ctx, pg)
+		}),
+	)
+}
+
+// Stops the API server, then writes anything still held in memory before
+// closing the database. Bounded by SHUTDOWN_TIMEOUT, see shutdownContext.
+func shutdown(ctx context.Context, pg *postgres, apiServer *APIServer, recorder *Recorder) {
+
+	writeCtx := writeContext(ctx)
+
+	slog.Info("Stopping API server")
+	shutdownCtx, cancel := context.WithTimeout(writeCtx, getShutdownTimeout())
+	if err := apiServer.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Error stopping API server", "error", err)
+	}
+	cancel()
+
+	slog.Info("Writing queued data")
+	updateDatabaseMu.Lock()
+	flushLiveSessions(writeCtx, pg, float64(time.Now().Unix()))
+	updateDatabaseMu.Unlock()
+	if err := updateAcarsMessages(writeCtx, pg); err != nil {
+		slog.Error("Error writing ACARS messages", "error", err)
+	}
+
+	if recorder != nil {
+		recorder.Close()
+	}
+	if spool != nil {
+		spool.Close()
+	}
+
+	slog.Info("Closing database connection")
+	pg.Close()
+
+	slog.Info("Shutdown complete")
+}
+
+// Recording is enabled by setting record.dir. record.retention_days limits
+// how long archives are kept for.
+func getRecorder() (*Recorder, error) {
+
+	dir := config.Record.Dir
+	if dir == "" {
+		return nil, nil
+	}
+
+	slog.Info("Recording aircraft.json snapshots", "dir", dir)
+
+	return NewRecorder(dir, time.Duration(config.Record.RetentionDays)*24*time.Hour)
 }
 
 func checkFlags() {
 	flag.Parse()
 	if showVersion {
-		showVersionExit()
+		os.Exit(runVersion(nil))
 	}
 }
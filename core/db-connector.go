@@ -3,32 +3,50 @@ package main
 import (
 	"context"
 	"fmt"
-	"os"
+	"net"
+	"net/url"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// How long to wait for postgres to answer when first connecting
+const dbConnectTimeout = 10 * time.Second
+
 type postgres struct {
 	db *pgxpool.Pool
 }
 
 var (
 	pgInstance *postgres
+	pgErr      error
 	pgOnce     sync.Once
 )
 
+// Creates the connection pool and checks postgres can be reached with it
 func NewPG(ctx context.Context, connString string) (*postgres, error) {
 	pgOnce.Do(func() {
 		db, err := pgxpool.New(ctx, connString)
 		if err != nil {
-			fmt.Println(err)
+			pgErr = fmt.Errorf("invalid database connection settings: %w", err)
+			return
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, dbConnectTimeout)
+		defer cancel()
+
+		if err := db.Ping(pingCtx); err != nil {
+			db.Close()
+			pgErr = fmt.Errorf("unable to connect to %s:%d: %w", config.Database.Host, config.Database.Port, err)
+			return
 		}
 
 		pgInstance = &postgres{db}
 	})
 
-	return pgInstance, nil
+	return pgInstance, pgErr
 }
 
 func (pg *postgres) Ping(ctx context.Context) error {
@@ -41,10 +59,12 @@ func (pg *postgres) Close() {
 
 func GetConnectionUrl() string {
 
-	return "postgres://" +
-		os.Getenv("DB_USER") + ":" +
-		os.Getenv("DB_PASSWORD") + "@" +
-		os.Getenv("DB_HOST") + ":" +
-		os.Getenv("DB_PORT") + "/" +
-		os.Getenv("DB_NAME")
+	connectionUrl := url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(config.Database.User, config.Database.Password),
+		Host:   net.JoinHostPort(config.Database.Host, strconv.Itoa(config.Database.Port)),
+		Path:   config.Database.Name,
+	}
+
+	return connectionUrl.String()
 }
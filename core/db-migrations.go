@@ -2,22 +2,23 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"io/fs"
 
 	"github.com/golang-migrate/migrate/v4"
 	postgres_migrate "github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
 	_ "github.com/lib/pq"
+	"github.com/tomcarman/skystats/migrations"
 )
 
 func RunDatabaseMigrations() error {
 
 	// Setup db connection
-	url := GetConnectionUrl() + "?sslmode=disable"
-	db, err := sql.Open("postgres", url)
+	db, err := openMigrationDatabase()
 	if err != nil {
-		return fmt.Errorf("Error connecting to the database: %w", err)
+		return err
 	}
 	defer db.Close()
 
@@ -26,7 +27,7 @@ func RunDatabaseMigrations() error {
 	if err != nil {
 		return fmt.Errorf("Error checking if its a pre-script version of the db: %w", err)
 	}
-	log.Printf("Pre-script DB check result: %v", isExistingDb)
+	dbLog.Debug("Checked for a pre-script database", "existing", isExistingDb)
 
 	// Setup migrator
 	migrator, err := initMigrator(db)
@@ -36,11 +37,11 @@ func RunDatabaseMigrations() error {
 
 	// If it was a pre-script DB, force version to 1
 	if isExistingDb {
-		log.Println("Found existing pre-scripted db. Automatically setting as version 1...")
+		dbLog.Info("Found existing pre-scripted db, automatically setting as version 1")
 		if err := migrator.Force(1); err != nil {
 			return fmt.Errorf("Error forcing migration version to 1 in pre-scripted db: %w", err)
 		}
-		log.Println("Successfully marked existing database as migration version 1")
+		dbLog.Info("Successfully marked existing database as migration version 1")
 	}
 
 	// Run migrations
@@ -50,26 +51,42 @@ func RunDatabaseMigrations() error {
 	}
 
 	if err == migrate.ErrNoChange {
-		log.Println("Database schema is up to date")
+		dbLog.Info("Database schema is up to date")
 	} else {
 		version, _, err := migrator.Version()
 		if err != nil {
-			log.Printf("Migration completed, but unable to get current version: %v", err)
+			dbLog.Warn("Migration completed, but unable to get current version", "error", err)
 		}
-		log.Printf("Successfully migrated database to version: %d", version)
+		dbLog.Info("Successfully migrated database", "version", version)
 	}
 
 	return nil
 }
 
+func openMigrationDatabase() (*sql.DB, error) {
+	url := GetConnectionUrl() + "?sslmode=disable"
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to the database: %w", err)
+	}
+	return db, nil
+}
+
 func initMigrator(db *sql.DB) (*migrate.Migrate, error) {
 	driver, err := postgres_migrate.WithInstance(db, &postgres_migrate.Config{})
 	if err != nil {
 		return nil, fmt.Errorf("Error creating migration driver: %w", err)
 	}
 
-	migrator, err := migrate.NewWithDatabaseInstance(
-		"file://../migrations",
+	// Built into the binary, see migrations/migrations_embed.go
+	source, err := iofs.New(migrations.FS, ".")
+	if err != nil {
+		return nil, fmt.Errorf("Error reading embedded migrations: %w", err)
+	}
+
+	migrator, err := migrate.NewWithInstance(
+		"iofs",
+		source,
 		"postgres",
 		driver,
 	)
@@ -80,6 +97,32 @@ func initMigrator(db *sql.DB) (*migrate.Migrate, error) {
 	return migrator, nil
 }
 
+// The version the embedded migrations take the database to
+func latestMigration() (uint, error) {
+
+	source, err := iofs.New(migrations.FS, ".")
+	if err != nil {
+		return 0, fmt.Errorf("Error reading embedded migrations: %w", err)
+	}
+	defer source.Close()
+
+	version, err := source.First()
+	if err != nil {
+		return 0, fmt.Errorf("Error reading embedded migrations: %w", err)
+	}
+
+	for {
+		next, err := source.Next(version)
+		if errors.Is(err, fs.ErrNotExist) {
+			return version, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("Error reading embedded migrations: %w", err)
+		}
+		version = next
+	}
+}
+
 // Only for users who were using a version of Skystats prior to the db
 // creation being scripted. Checks for when the schema_migrations table does not exist,
 // but the aircraft_data does. If so, forces the db version to 1.
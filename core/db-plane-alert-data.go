@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 
 	"github.com/jackc/pgx/v5"
 )
@@ -38,28 +37,28 @@ type GitHubAPIResponse struct {
 	}
 }
 
-func UpsertPlaneAlertDb(pg *postgres) error {
+func UpsertPlaneAlertDb(ctx context.Context, pg *postgres) error {
 
-	planeAlertUrl, isCustomPlaneAlertUrl := os.LookupEnv("PLANE_DB_URL")
+	planeAlertUrl := config.Interesting.PlaneAlertUrl
+	isCustomPlaneAlertUrl := planeAlertUrl != ""
 
 	if !isCustomPlaneAlertUrl {
 		planeAlertUrl = "https://raw.githubusercontent.com/sdr-enthusiasts/plane-alert-db/refs/heads/main/plane-alert-db-images.csv"
 	}
 
-	needsUpdating, commitHash, err := checkForUpdates(pg, isCustomPlaneAlertUrl)
+	needsUpdating, commitHash, err := checkForUpdates(ctx, pg, isCustomPlaneAlertUrl)
 	if err != nil {
-		fmt.Printf("Error checking for updates: %w\n", err)
-		fmt.Printf("Updating despite error checking.\n")
+		interestingLog.Warn("Error checking for plane-alert-db updates, updating anyway", "error", err)
 		needsUpdating = true
 		commitHash = "failed_to_get_commit_hash"
 	}
 
 	if !needsUpdating {
-		fmt.Println("No updates found for interesting aircraft data")
+		interestingLog.Info("No updates found for interesting aircraft data")
 		return nil
 	}
 
-	fmt.Println("Updating interesting aircraft data...")
+	interestingLog.Info("Updating interesting aircraft data", "url", planeAlertUrl)
 
 	planeAlertRecords, err := fetchCSVData(planeAlertUrl)
 	if err != nil {
@@ -146,7 +145,7 @@ func UpsertPlaneAlertDb(pg *postgres) error {
 		)
 	}
 
-	br := pg.db.SendBatch(context.Background(), batch)
+	br := pg.db.SendBatch(ctx, batch)
 	defer br.Close()
 
 	for range data {
@@ -156,7 +155,7 @@ func UpsertPlaneAlertDb(pg *postgres) error {
 		}
 	}
 
-	fmt.Printf("Succesfully upserted %d interesting aircraft records\n", len(data))
+	interestingLog.Info("Upserted interesting aircraft records", "count", len(data))
 
 	return nil
 }
@@ -192,17 +191,17 @@ func getValue(s string) *string {
 	return &s
 }
 
-func checkForUpdates(pg *postgres, isCustom bool) (needsUpdating bool, commitHash string, err error) {
+func checkForUpdates(ctx context.Context, pg *postgres, isCustom bool) (needsUpdating bool, commitHash string, err error) {
 
 	var exists bool
-	err = pg.db.QueryRow(context.Background(), "SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'interesting_aircraft')").Scan(&exists)
+	err = pg.db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'interesting_aircraft')").Scan(&exists)
 	if err != nil || !exists {
 		return false, "", fmt.Errorf("Error checking for interesting_aircraft table: %w", err)
 	}
 
 	// If exists and is empty, then always needs updating
 	var count int
-	err = pg.db.QueryRow(context.Background(), "SELECT COUNT(*) FROM interesting_aircraft").Scan(&count)
+	err = pg.db.QueryRow(ctx, "SELECT COUNT(*) FROM interesting_aircraft").Scan(&count)
 	if err != nil {
 		return false, "", fmt.Errorf("Error checking interesting_aircraft table: %w", err)
 	}
@@ -215,7 +214,7 @@ func checkForUpdates(pg *postgres, isCustom bool) (needsUpdating bool, commitHas
 
 	// Otherwise, check if newer commit hash
 	var existingCommitHash sql.NullString
-	err = pg.db.QueryRow(context.Background(), "SELECT commit_hash FROM interesting_aircraft LIMIT 1").Scan(&existingCommitHash)
+	err = pg.db.QueryRow(ctx, "SELECT commit_hash FROM interesting_aircraft LIMIT 1").Scan(&existingCommitHash)
 	if err != nil {
 		return false, "", fmt.Errorf("Error checking interesting_aircraft table: %w", err)
 	}
@@ -258,7 +257,6 @@ func getLatestCommitHash() (string, error) {
 			return file.SHA, nil
 		}
 	}
-	fmt.Printf("getLatestCommitHash failed, printing commitResponse\n%+v\n", commitResponse)
-	fmt.Printf("getLatestCommitHash failed, printing body\n%s\n", body)
+	interestingLog.Debug("plane-alert-db-images.csv not found in the GitHub response", "body", string(body))
 	return "", fmt.Errorf("Error finding plane-alert-db-images.csv commit hash")
 }
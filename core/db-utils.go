@@ -3,38 +3,59 @@ package main
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/jackc/pgx/v5"
 )
 
-func MarkProcessed(pg *postgres, colName string, aircrafts []Aircraft) {
+func MarkProcessed(ctx context.Context, pg *postgres, colName string, aircrafts []Aircraft) {
 
-	batch := &pgx.Batch{}
+	if len(aircrafts) == 0 {
+		return
+	}
 
+	ids := make([]int, 0, len(aircrafts))
 	for _, aircraft := range aircrafts {
-		updateStatement := `UPDATE aircraft_data SET ` + colName + ` = true WHERE id = $1`
-		batch.Queue(updateStatement, aircraft.Id)
+		ids = append(ids, aircraft.Id)
 	}
 
-	br := pg.db.SendBatch(context.Background(), batch)
-	defer br.Close()
+	updateStatement := `UPDATE aircraft_data SET ` + colName + ` = true WHERE id = ANY($1::int[])`
 
-	for i := 0; i < len(aircrafts); i++ {
-		_, err := br.Exec()
-		if err != nil {
-			fmt.Println("MarkProcessed() - Unable to update data: ", err)
-		}
+	_, err := pg.db.Exec(ctx, updateStatement, ids)
+	if err != nil {
+		dbLog.Error("Unable to mark sessions processed", "column", colName, "error", err)
+	}
+}
+
+// Copies rows into a temporary table with the same columns as table, named
+// table_staging and dropped when tx ends, ready to be merged in with a
+// single INSERT ... SELECT
+func copyToStaging(ctx context.Context, tx pgx.Tx, table string, columns []string, rows [][]any) (string, error) {
+
+	staging := table + "_staging"
+
+	createStatement := `CREATE TEMP TABLE ` + staging + ` ON COMMIT DROP AS
+						SELECT ` + strings.Join(columns, ", ") + ` FROM ` + table + ` WITH NO DATA`
+
+	if _, err := tx.Exec(ctx, createStatement); err != nil {
+		return "", fmt.Errorf("Error creating %s: %w", staging, err)
 	}
+
+	if _, err := tx.CopyFrom(ctx, pgx.Identifier{staging}, columns, pgx.CopyFromRows(rows)); err != nil {
+		return "", fmt.Errorf("Error copying to %s: %w", staging, err)
+	}
+
+	return staging, nil
 }
 
-func DeleteExcessRows(pg *postgres, tableName string, metricName string, sortOrder string, maxRows int) {
+func DeleteExcessRows(ctx context.Context, pg *postgres, tableName string, metricName string, sortOrder string, maxRows int) {
 
 	queryCount := `SELECT COUNT(*) FROM ` + tableName
 
 	var rowCount int
-	err := pg.db.QueryRow(context.Background(), queryCount).Scan(&rowCount)
+	err := pg.db.QueryRow(ctx, queryCount).Scan(&rowCount)
 	if err != nil {
-		fmt.Println("DeleteExcessRows() - Error querying db in DeleteExcessRows(): ", err)
+		dbLog.Error("Error counting rows", "table", tableName, "error", err)
 		return
 	}
 
@@ -43,7 +64,7 @@ func DeleteExcessRows(pg *postgres, tableName string, metricName string, sortOrd
 		excessRows := rowCount - maxRows
 
 		if excessRows <= 0 {
-			fmt.Println("DeleteExcessRows() - No excess rows in ", tableName)
+			dbLog.Debug("No excess rows", "table", tableName)
 			return
 		}
 
@@ -55,9 +76,9 @@ func DeleteExcessRows(pg *postgres, tableName string, metricName string, sortOrd
 								LIMIT $1
 								)`
 
-		_, err := pg.db.Exec(context.Background(), deleteStatement, excessRows)
+		_, err := pg.db.Exec(ctx, deleteStatement, excessRows)
 		if err != nil {
-			fmt.Println("DeleteExcessRows() - Failed to delete excess rows in ", tableName, ": ", err)
+			dbLog.Error("Failed to delete excess rows", "table", tableName, "error", err)
 		}
 	}
 }
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4"
+)
+
+const (
+	doctorTimeout = 5 * time.Second
+	// Snapshots older than maxLag are rejected by ingest, and sessions are
+	// timed by readsb's clock, so skew beyond a few seconds is worth knowing
+	doctorSkewWarn = 5 * time.Second
+	doctorSkewFail = 30 * time.Second
+)
+
+type doctorResult int
+
+const (
+	doctorOk doctorResult = iota
+	doctorWarn
+	doctorFail
+)
+
+// Collects the result of each check, printing them as they are made
+type doctor struct {
+	failed bool
+}
+
+func (d *doctor) report(result doctorResult, check string, format string, args ...any) {
+	label := map[doctorResult]string{doctorOk: "ok  ", doctorWarn: "warn", doctorFail: "FAIL"}[result]
+	fmt.Printf("[%s] %-20s %s\n", label, check, fmt.Sprintf(format, args...))
+	if result == doctorFail {
+		d.failed = true
+	}
+}
+
+// Checks the config, that readsb can be reached, the receiver location, the
+// database and its schema, and the clock skew between readsb and this host.
+// Exits 1 if any check fails; warnings don't affect the exit code.
+func runDoctor(args []string) int {
+
+	flags := commandFlags("doctor", "[flags]")
+	// An invalid config is reported by parseCommand, exiting 3
+	if code, ok := parseCommand(flags, args, 0, 0); !ok {
+		return code
+	}
+
+	d := &doctor{}
+	ctx, cancel := context.WithTimeout(shutdownContext(), time.Minute)
+	defer cancel()
+
+	d.report(doctorOk, "config", "loaded%s", configSource())
+	d.checkConfig()
+	d.checkReadsb(ctx)
+	d.checkReceiver(ctx)
+	d.checkDatabase(ctx)
+
+	if d.failed {
+		return exitFailed
+	}
+	return exitOK
+}
+
+func configSource() string {
+	if configFile == "" {
+		return " from the environment"
+	}
+	return " from " + configFile
+}
+
+// Settings that only make sense with the filters file, or that are valid but
+// probably not what was meant
+func (d *doctor) checkConfig() {
+
+	if err := loadFilters(); err != nil {
+		d.report(doctorFail, "filters", "%v", err)
+	}
+	if config.Receiver.DomesticCountryIso == "" {
+		d.report(doctorWarn, "domestic country", "receiver.domestic_country_iso (DOMESTIC_COUNTRY_ISO) is not set, domestic and international flights won't be told apart")
+	}
+}
+
+// Every readsb endpoint being recorded from, by station name
+func readsbEndpoints() map[string]string {
+
+	endpoints := make(map[string]string)
+
+	if sources := config.Readsb.Sources; sources != "" {
+		for _, entry := range strings.Split(sources, ",") {
+			name, url, _ := strings.Cut(strings.TrimSpace(entry), "=")
+			endpoints[strings.TrimSpace(name)] = strings.TrimSpace(url)
+		}
+		return endpoints
+	}
+
+	switch {
+	case config.Readsb.Sbs != "":
+		endpoints[defaultStationName] = "sbs://" + config.Readsb.Sbs
+	case config.Readsb.Beast != "":
+		endpoints[defaultStationName] = "beast://" + config.Readsb.Beast
+	case config.Readsb.AircraftJson != "":
+		endpoints[defaultStationName] = config.Readsb.AircraftJson
+	}
+
+	return endpoints
+}
+
+func (d *doctor) checkReadsb(ctx context.Context) {
+
+	endpoints := readsbEndpoints()
+	if len(endpoints) == 0 {
+		d.report(doctorFail, "readsb", "no source set, set readsb.aircraft_json (READSB_AIRCRAFT_JSON) or readsb.sources (READSB_SOURCES)")
+		return
+	}
+
+	for name, url := range endpoints {
+		check := "readsb " + name
+
+		switch {
+		case strings.HasPrefix(url, "sbs://"), strings.HasPrefix(url, "beast://"):
+			_, addr, _ := strings.Cut(url, "://")
+			conn, err := net.DialTimeout("tcp", addr, doctorTimeout)
+			if err != nil {
+				d.report(doctorFail, check, "unable to connect to %s: %v", url, err)
+				continue
+			}
+			conn.Close()
+			d.report(doctorOk, check, "connected to %s", url)
+
+		default:
+			d.checkAircraftJson(ctx, check, strings.TrimPrefix(url, "uat+"))
+		}
+	}
+}
+
+// Fetches aircraft.json, and compares its now with this host's clock
+func (d *doctor) checkAircraftJson(ctx context.Context, check string, url string) {
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		d.report(doctorFail, check, "invalid url %s: %v", url, err)
+		return
+	}
+
+	client := &http.Client{Timeout: doctorTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		d.report(doctorFail, check, "unable to fetch %s: %v", url, err)
+		return
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		d.report(doctorFail, check, "%s returned %s", url, response.Status)
+		return
+	}
+
+	var snapshot struct {
+		Now      float64           `json:"now"`
+		Aircraft []json.RawMessage `json:"aircraft"`
+	}
+	data, err := io.ReadAll(response.Body)
+	if err == nil {
+		err = json.Unmarshal(data, &snapshot)
+	}
+	if err != nil {
+		d.report(doctorFail, check, "%s is not a readsb aircraft.json: %v", url, err)
+		return
+	}
+
+	d.report(doctorOk, check, "%s has %d aircraft", url, len(snapshot.Aircraft))
+
+	if snapshot.Now == 0 {
+		d.report(doctorWarn, check+" clock", "%s has no now, unable to check clock skew", url)
+		return
+	}
+
+	readsbNow := time.Unix(0, int64(snapshot.Now*float64(time.Second)))
+	skew := time.Since(readsbNow).Round(time.Millisecond)
+	abs := time.Duration(math.Abs(float64(skew)))
+
+	switch {
+	case abs > doctorSkewFail:
+		d.report(doctorFail, check+" clock", "%s, check both are synced with NTP", describeSkew(skew, "readsb"))
+	case abs > doctorSkewWarn:
+		d.report(doctorWarn, check+" clock", "%s", describeSkew(skew, "readsb"))
+	default:
+		d.report(doctorOk, check+" clock", "skew %v", skew)
+	}
+}
+
+// LAT/LON if set, otherwise receiver.json, as resolveReceiverLocation would
+// at startup but without retrying
+func (d *doctor) checkReceiver(ctx context.Context) {
+
+	lat, lon, set, err := configuredLocation()
+	if err != nil {
+		d.report(doctorFail, "receiver location", "%v", err)
+		return
+	}
+	if set {
+		d.report(doctorOk, "receiver location", "%.6f, %.6f from the config", lat, lon)
+		return
+	}
+
+	url := getReceiverJsonUrl()
+	if url == "" {
+		d.report(doctorFail, "receiver location", "not set, set LAT and LON, or READSB_RECEIVER_JSON to the url of readsb's receiver.json")
+		return
+	}
+
+	lat, lon, err = fetchReceiverLocation(ctx, url)
+	if err != nil {
+		d.report(doctorFail, "receiver location", "unable to read %s: %v", url, err)
+		return
+	}
+
+	d.report(doctorOk, "receiver location", "%.6f, %.6f from %s", lat, lon, url)
+}
+
+// Connects, and compares the schema version with the embedded migrations
+func (d *doctor) checkDatabase(ctx context.Context) {
+
+	pg, err := NewPG(ctx, GetConnectionUrl())
+	if err != nil {
+		d.report(doctorFail, "database", "%v", err)
+		return
+	}
+	defer pg.Close()
+	d.report(doctorOk, "database", "connected to %s on %s:%d", config.Database.Name, config.Database.Host, config.Database.Port)
+
+	var clock time.Time
+	if err := pg.db.QueryRow(ctx, "SELECT NOW()").Scan(&clock); err == nil {
+		skew := time.Since(clock).Round(time.Millisecond)
+		if time.Duration(math.Abs(float64(skew))) > doctorSkewWarn {
+			d.report(doctorWarn, "database clock", "%s", describeSkew(skew, "postgres"))
+		}
+	}
+
+	db, err := openMigrationDatabase()
+	if err != nil {
+		d.report(doctorFail, "schema", "%v", err)
+		return
+	}
+	defer db.Close()
+
+	migrator, err := initMigrator(db)
+	if err != nil {
+		d.report(doctorFail, "schema", "%v", err)
+		return
+	}
+
+	latest, err := latestMigration()
+	if err != nil {
+		d.report(doctorFail, "schema", "%v", err)
+		return
+	}
+
+	current, dirty, err := migrator.Version()
+	switch {
+	case err == migrate.ErrNilVersion:
+		d.report(doctorWarn, "schema", "no migrations applied yet, they are run by serve or migrate up")
+	case err != nil:
+		d.report(doctorFail, "schema", "unable to read the version: %v", err)
+	case dirty:
+		d.report(doctorFail, "schema", "version %d is dirty, a migration failed part way, see migrate force", current)
+	case current < latest:
+		d.report(doctorWarn, "schema", "version %d of %d, the rest are run by serve or migrate up", current, latest)
+	case current > latest:
+		d.report(doctorFail, "schema", "version %d is newer than this build knows about (%d)", current, latest)
+	default:
+		d.report(doctorOk, "schema", "version %d, up to date", current)
+	}
+}
+
+func describeSkew(skew time.Duration, other string) string {
+	if skew < 0 {
+		return fmt.Sprintf("this host is %v behind %s", -skew, other)
+	}
+	return fmt.Sprintf("this host is %v ahead of %s", skew, other)
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A session as exported, with its registration and route if they were found
+type exportedSession struct {
+	Id               int       `json:"id"`
+	Hex              string    `json:"hex"`
+	AddressType      *string   `json:"address_type"`
+	Flight           *string   `json:"flight"`
+	Registration     *string   `json:"registration"`
+	Type             *string   `json:"type"`
+	FirstSeen        time.Time `json:"first_seen"`
+	LastSeen         time.Time `json:"last_seen"`
+	LastSeenLat      *float64  `json:"last_seen_lat"`
+	LastSeenLon      *float64  `json:"last_seen_lon"`
+	LastSeenDistance *float64  `json:"last_seen_distance"`
+	AltBaro          *int      `json:"alt_baro"`
+	Gs               *float64  `json:"gs"`
+	Squawk           *string   `json:"squawk"`
+	Stations         []string  `json:"stations"`
+	Datalinks        []string  `json:"datalinks"`
+	Origin           *string   `json:"origin"`
+	Destination      *string   `json:"destination"`
+	RegisteredOwner  *string   `json:"registered_owner"`
+}
+
+var exportColumns = []string{
+	"id", "hex", "address_type", "flight", "registration", "type", "first_seen", "last_seen",
+	"last_seen_lat", "last_seen_lon", "last_seen_distance", "alt_baro", "gs", "squawk",
+	"stations", "datalinks", "origin", "destination", "registered_owner",
+}
+
+func runExport(args []string) int {
+
+	if len(args) == 0 || args[0] != "sessions" {
+		fmt.Fprintf(os.Stderr, "Usage: skystats export sessions [-from date] [-to date] [-station name] [-format csv|json] [-o file]\n")
+		return exitUsage
+	}
+
+	flags := commandFlags("export sessions", "[-from date] [-to date] [-station name] [-format csv|json] [-o file]")
+	from := flags.String("from", "", "only sessions first seen on or after this date (2006-01-02 or RFC 3339)")
+	to := flags.String("to", "", "only sessions first seen on or before this date")
+	station := flags.String("station", "", "only sessions seen by this station")
+	format := flags.String("format", "csv", "csv or json")
+	output := flags.String("o", "", "write to this file rather than stdout")
+	if code, ok := parseCommand(flags, args[1:], 0, 0); !ok {
+		return code
+	}
+
+	if *format != "csv" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "skystats export: unknown format %q, expected csv or json\n", *format)
+		return exitUsage
+	}
+
+	start, end, err := parseDateRange(*from, *to)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "skystats export: %v\n", err)
+		return exitUsage
+	}
+
+	return withDatabase(func(ctx context.Context, pg *postgres) int {
+
+		var out io.Writer = os.Stdout
+		if *output != "" {
+			file, err := os.Create(*output)
+			if err != nil {
+				slog.Error("Error creating export file", "error", err)
+				return exitFailed
+			}
+			defer file.Close()
+			out = file
+		}
+
+		buffered := bufio.NewWriter(out)
+		count, err := exportSessions(ctx, pg, buffered, *format, start, end, *station)
+		if err == nil {
+			err = buffered.Flush()
+		}
+		if err != nil {
+			slog.Error("Error exporting sessions", "error", err)
+			return exitFailed
+		}
+
+		slog.Info("Exported sessions", "count", count)
+		return exitOK
+	})
+}
+
+// Writes every session in the range, oldest first, as csv or json. Returns
+// how many were written.
+func exportSessions(ctx context.Context, pg *postgres, out io.Writer, format string, from sql.NullTime, to sql.NullTime, station string) (int, error) {
+
+	query := `
+		SELECT
+			a.id, a.hex, a.address_type, a.flight, a.r, a.t, a.first_seen, a.last_seen,
+			a.last_seen_lat, a.last_seen_lon, a.last_seen_distance, a.alt_baro, a.gs, a.squawk,
+			a.stations, a.datalinks,
+			route.origin_icao_code, route.destination_icao_code, reg.registered_owner
+		FROM aircraft_data a
+		LEFT JOIN route_data route ON route.route_callsign = a.flight
+		LEFT JOIN registration_data reg ON reg.mode_s = a.hex
+		WHERE
+			($1::timestamptz IS NULL OR a.first_seen >= $1) AND
+			($2::timestamptz IS NULL OR a.first_seen < $2) AND
+			` + stationCondition("a.", 3) + `
+		ORDER BY a.first_seen ASC`
+
+	rows, err := pg.db.Query(ctx, query, from, to, station)
+	if err != nil {
+		return 0, fmt.Errorf("Error querying sessions: %w", err)
+	}
+	defer rows.Close()
+
+	var write func(session exportedSession) error
+	var finish func() error
+
+	switch format {
+	case "json":
+		write, finish = jsonSessionWriter(out)
+	default:
+		write, finish = csvSessionWriter(out)
+	}
+
+	count := 0
+	for rows.Next() {
+
+		var session exportedSession
+		err := rows.Scan(
+			&session.Id,
+			&session.Hex,
+			&session.AddressType,
+			&session.Flight,
+			&session.Registration,
+			&session.Type,
+			&session.FirstSeen,
+			&session.LastSeen,
+			&session.LastSeenLat,
+			&session.LastSeenLon,
+			&session.LastSeenDistance,
+			&session.AltBaro,
+			&session.Gs,
+			&session.Squawk,
+			&session.Stations,
+			&session.Datalinks,
+			&session.Origin,
+			&session.Destination,
+			&session.RegisteredOwner)
+
+		if err != nil {
+			return count, fmt.Errorf("Error scanning sessions: %w", err)
+		}
+
+		if err := write(session); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	if err := rows.Err(); err != nil {
+		return count, fmt.Errorf("Error reading sessions: %w", err)
+	}
+
+	return count, finish()
+}
+
+// Writes a header, then a row per session. Arrays are joined with ;
+func csvSessionWriter(out io.Writer) (func(exportedSession) error, func() error) {
+
+	writer := csv.NewWriter(out)
+	header := false
+
+	write := func(s exportedSession) error {
+		if !header {
+			header = true
+			if err := writer.Write(exportColumns); err != nil {
+				return err
+			}
+		}
+		return writer.Write([]string{
+			strconv.Itoa(s.Id),
+			s.Hex,
+			csvString(s.AddressType),
+			csvString(s.Flight),
+			csvString(s.Registration),
+			csvString(s.Type),
+			s.FirstSeen.Format(time.RFC3339),
+			s.LastSeen.Format(time.RFC3339),
+			csvFloat(s.LastSeenLat),
+			csvFloat(s.LastSeenLon),
+			csvFloat(s.LastSeenDistance),
+			csvInt(s.AltBaro),
+			csvFloat(s.Gs),
+			csvString(s.Squawk),
+			strings.Join(s.Stations, ";"),
+			strings.Join(s.Datalinks, ";"),
+			csvString(s.Origin),
+			csvString(s.Destination),
+			csvString(s.RegisteredOwner),
+		})
+	}
+
+	finish := func() error {
+		// Still write the header if there was nothing to export
+		if !header {
+			if err := writer.Write(exportColumns); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	}
+
+	return write, finish
+}
+
+// Writes a json array, a session at a time so large exports aren't held in
+// memory
+func jsonSessionWriter(out io.Writer) (func(exportedSession) error, func() error) {
+
+	first := true
+
+	write := func(s exportedSession) error {
+		data, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+
+		separator := ",\n"
+		if first {
+			separator = "[\n"
+			first = false
+		}
+		_, err = fmt.Fprintf(out, "%s%s", separator, data)
+		return err
+	}
+
+	finish := func() error {
+		if first {
+			_, err := io.WriteString(out, "[]\n")
+			return err
+		}
+		_, err := io.WriteString(out, "\n]\n")
+		return err
+	}
+
+	return write, finish
+}
+
+func csvString(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+func csvFloat(value *float64) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*value, 'f', -1, 64)
+}
+
+func csvInt(value *int) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.Itoa(*value)
+}
+
+// Dates are given as 2006-01-02 in local time, or as RFC 3339 timestamps. A
+// -to date includes the whole of that day. Either can be left empty.
+func parseDateRange(from string, to string) (sql.NullTime, sql.NullTime, error) {
+
+	var start, end sql.NullTime
+
+	if from != "" {
+		t, err := parseDate(from)
+		if err != nil {
+			return start, end, fmt.Errorf("-from: %w", err)
+		}
+		start = sql.NullTime{Time: t, Valid: true}
+	}
+
+	if to != "" {
+		t, err := parseDate(to)
+		if err != nil {
+			return start, end, fmt.Errorf("-to: %w", err)
+		}
+		if _, err := time.Parse(time.DateOnly, to); err == nil {
+			t = t.AddDate(0, 0, 1)
+		}
+		end = sql.NullTime{Time: t, Valid: true}
+	}
+
+	if start.Valid && end.Valid && !start.Time.Before(end.Time) {
+		return start, end, fmt.Errorf("-from must be before -to")
+	}
+
+	return start, end, nil
+}
+
+func parseDate(value string) (time.Time, error) {
+	if t, err := time.ParseInLocation(time.DateOnly, value, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("%q is not a date, expected 2006-01-02 or RFC 3339", value)
+	}
+	return t, nil
+}
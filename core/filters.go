@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Aircraft can be filtered before they are recorded with a YAML file named by
+// FILTERS_FILE, e.g.
+//
+//	exclude_non_aircraft: true
+//	polygons:
+//	  - name: home
+//	    points: [[51.60, -0.40], [51.60, 0.20], [51.30, 0.20], [51.30, -0.40]]
+//	rules:
+//	  - name: low-mlat
+//	    action: exclude
+//	    sources: [mlat]
+//	    altitude: {max: 2000}
+//	  - name: no-gliders
+//	    action: exclude
+//	    categories: [B1]
+//
+// Every matcher set on a rule has to match for the rule to match, and a list
+// matches when any of its entries does. The first exclude rule to match drops
+// the aircraft. If there are any include rules, an aircraft has to match one
+// of them to be kept. Polygons, when given, replace the RADIUS circle.
+
+const (
+	filterActionInclude = "include"
+	filterActionExclude = "exclude"
+)
+
+// Names the built-in checks are counted under
+const (
+	filterDropNonAircraft = "non-aircraft"
+	filterDropNotIncluded = "not-included"
+	filterDropOutsideArea = "outside-area"
+	filterDropNoPosition  = "no-position"
+)
+
+// Data sources a rule can match, from readsb's type field
+var filterSources = []string{"adsb", "adsr", "adsc", "mlat", "tisb", "mode_s", "other"}
+
+type FilterConfig struct {
+	ExcludeNonAircraft *bool           `yaml:"exclude_non_aircraft" json:"exclude_non_aircraft"`
+	Polygons           []FilterPolygon `yaml:"polygons" json:"polygons"`
+	Rules              []FilterRule    `yaml:"rules" json:"rules"`
+}
+
+// An area to record aircraft in, as [lat, lon] points
+type FilterPolygon struct {
+	Name   string       `yaml:"name" json:"name"`
+	Points [][2]float64 `yaml:"points" json:"points"`
+}
+
+type FilterRule struct {
+	Name          string       `yaml:"name" json:"name"`
+	Action        string       `yaml:"action" json:"action"`
+	Hex           []string     `yaml:"hex" json:"hex,omitempty"`
+	Registrations []string     `yaml:"registrations" json:"registrations,omitempty"`
+	Types         []string     `yaml:"types" json:"types,omitempty"`
+	Callsigns     []string     `yaml:"callsigns" json:"callsigns,omitempty"`
+	Categories    []string     `yaml:"categories" json:"categories,omitempty"`
+	Squawks       []string     `yaml:"squawks" json:"squawks,omitempty"`
+	Altitude      *FilterRange `yaml:"altitude" json:"altitude,omitempty"`
+	Distance      *FilterRange `yaml:"distance" json:"distance,omitempty"`
+	Sources       []string     `yaml:"sources" json:"sources,omitempty"`
+
+	hexRanges [][2]uint64
+	callsigns []*regexp.Regexp
+}
+
+// An altitude band in feet, or a distance ring in km. Either end can be left
+// open.
+type FilterRange struct {
+	Min *float64 `yaml:"min" json:"min,omitempty"`
+	Max *float64 `yaml:"max" json:"max,omitempty"`
+}
+
+// Set once at startup by loadFilters
+var filters = &FilterConfig{}
+
+// Running totals of aircraft dropped, by rule or built-in check name. Counts
+// are per snapshot, so an aircraft dropped for a minute is counted about 30
+// times.
+var filterDrops = struct {
+	mu     sync.Mutex
+	counts map[string]int64
+	kept   int64
+	since  time.Time
+}{counts: make(map[string]int64), since: time.Now()}
+
+func loadFilters() error {
+
+	file := config.Filters.File
+	if file == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("unable to read FILTERS_FILE: %w", err)
+	}
+
+	parsed, err := parseFilters(data)
+	if err != nil {
+		return fmt.Errorf("invalid FILTERS_FILE %s: %w", file, err)
+	}
+	if len(parsed.Polygons) == 0 && config.Receiver.Radius <= 0 {
+		return fmt.Errorf("FILTERS_FILE %s has no polygons, so receiver.radius (RADIUS) must be more than 0", file)
+	}
+
+	filters = parsed
+	slog.Info("Loaded filters", "rules", len(parsed.Rules), "polygons", len(parsed.Polygons), "file", file)
+
+	return nil
+}
+
+func parseFilters(data []byte) (*FilterConfig, error) {
+
+	var config FilterConfig
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+func (f *FilterConfig) validate() error {
+
+	for i := range f.Polygons {
+		polygon := &f.Polygons[i]
+		if polygon.Name == "" {
+			polygon.Name = "polygon " + strconv.Itoa(i+1)
+		}
+		if len(polygon.Points) < 3 {
+			return fmt.Errorf("polygon %q needs at least 3 points", polygon.Name)
+		}
+		for _, point := range polygon.Points {
+			if point[0] < -90 || point[0] > 90 || point[1] < -180 || point[1] > 180 {
+				return fmt.Errorf("polygon %q: %v, %v is not a valid [lat, lon] point", polygon.Name, point[0], point[1])
+			}
+		}
+	}
+
+	names := make(map[string]bool)
+
+	for i := range f.Rules {
+		rule := &f.Rules[i]
+
+		if rule.Name == "" {
+			rule.Name = "rule " + strconv.Itoa(i+1)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("rule name %q is used more than once", rule.Name)
+		}
+		if isBuiltInFilter(rule.Name) {
+			return fmt.Errorf("rule name %q is reserved", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func isBuiltInFilter(name string) bool {
+	return name == filterDropNonAircraft || name == filterDropNotIncluded ||
+		name == filterDropOutsideArea || name == filterDropNoPosition
+}
+
+func (r *FilterRule) compile() error {
+
+	r.Action = strings.ToLower(r.Action)
+	if r.Action != filterActionInclude && r.Action != filterActionExclude {
+		return fmt.Errorf("action must be %q or %q", filterActionInclude, filterActionExclude)
+	}
+
+	if len(r.Hex) == 0 && len(r.Registrations) == 0 && len(r.Types) == 0 &&
+		len(r.Callsigns) == 0 && len(r.Categories) == 0 && len(r.Squawks) == 0 &&
+		r.Altitude == nil && r.Distance == nil && len(r.Sources) == 0 {
+		return fmt.Errorf("nothing to match on")
+	}
+
+	r.hexRanges = nil
+	for _, hex := range r.Hex {
+		from, to, _ := strings.Cut(hex, "-")
+		if to == "" {
+			to = from
+		}
+		start, startErr := strconv.ParseUint(strings.TrimSpace(from), 16, 32)
+		end, endErr := strconv.ParseUint(strings.TrimSpace(to), 16, 32)
+		if startErr != nil || endErr != nil || start > end {
+			return fmt.Errorf("%q is not a hex address or range", hex)
+		}
+		r.hexRanges = append(r.hexRanges, [2]uint64{start, end})
+	}
+
+	r.callsigns = nil
+	for _, pattern := range r.Callsigns {
+		callsign, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("callsign pattern %q: %w", pattern, err)
+		}
+		r.callsigns = append(r.callsigns, callsign)
+	}
+
+	for _, patterns := range [][]string{r.Registrations, r.Types, r.Categories, r.Squawks} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("pattern %q: %w", pattern, err)
+			}
+		}
+	}
+
+	for _, source := range r.Sources {
+		if !containsString(filterSources, strings.ToLower(source)) {
+			return fmt.Errorf("source %q must be one of %s", source, strings.Join(filterSources, ", "))
+		}
+	}
+
+	for _, band := range []*FilterRange{r.Altitude, r.Distance} {
+		if band != nil && band.Min != nil && band.Max != nil && *band.Min > *band.Max {
+			return fmt.Errorf("range min %v is greater than max %v", *band.Min, *band.Max)
+		}
+	}
+
+	return nil
+}
+
+// Keeps the aircraft that pass the filters, counting those that don't
+func filterAircraft(aircrafts []Aircraft) []Aircraft {
+
+	var kept []Aircraft
+	dropped := make(map[string]int64)
+
+	for _, aircraft := range aircrafts {
+		if name := filters.check(aircraft); name != "" {
+			dropped[name]++
+			continue
+		}
+		kept = append(kept, aircraft)
+	}
+
+	filterDrops.mu.Lock()
+	for name, count := range dropped {
+		filterDrops.counts[name] += count
+	}
+	filterDrops.kept += int64(len(kept))
+	filterDrops.mu.Unlock()
+
+	return kept
+}
+
+// Returns the name of the rule or check that drops the aircraft, or "" if
+// it should be recorded
+func (f *FilterConfig) check(aircraft Aircraft) string {
+
+	if name := f.checkRules(aircraft); name != "" {
+		return name
+	}
+
+	// Aircraft without a position would otherwise be measured from 0,0
+	if !aircraft.HasPosition() {
+		if !includeModeSOnly(aircraft) {
+			return filterDropNoPosition
+		}
+		return ""
+	}
+
+	if !f.inArea(aircraft.Lat.Float64, aircraft.Lon.Float64) {
+		return filterDropOutsideArea
+	}
+
+	return ""
+}
+
+// The rules on their own, without the area check
+func (f *FilterConfig) checkRules(aircraft Aircraft) string {
+
+	if (f.ExcludeNonAircraft == nil || *f.ExcludeNonAircraft) && isNonAircraft(aircraft) {
+		return filterDropNonAircraft
+	}
+
+	included := true
+	for i := range f.Rules {
+		rule := &f.Rules[i]
+		if rule.Action == filterActionInclude {
+			included = false
+			break
+		}
+	}
+
+	for i := range f.Rules {
+		rule := &f.Rules[i]
+		if !rule.matches(aircraft) {
+			continue
+		}
+		if rule.Action == filterActionExclude {
+			return rule.Name
+		}
+		included = true
+	}
+
+	if !included {
+		return filterDropNotIncluded
+	}
+
+	return ""
+}
+
+// Inside one of the polygons, or within RADIUS of the receiver without any
+func (f *FilterConfig) inArea(lat float64, lon float64) bool {
+
+	if len(f.Polygons) == 0 {
+		return *getDistance([]float64{lon, lat}) < getRadius()
+	}
+
+	for _, polygon := range f.Polygons {
+		if polygon.contains(lat, lon) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Ray casting, treating lat/lon as flat, which is close enough at the size of
+// a receiver's coverage
+func (p FilterPolygon) contains(lat float64, lon float64) bool {
+
+	inside := false
+	j := len(p.Points) - 1
+
+	for i := range p.Points {
+		latI, lonI := p.Points[i][0], p.Points[i][1]
+		latJ, lonJ := p.Points[j][0], p.Points[j][1]
+		if (latI > lat) != (latJ > lat) && lon < (lonJ-lonI)*(lat-latI)/(latJ-latI)+lonI {
+			inside = !inside
+		}
+		j = i
+	}
+
+	return inside
+}
+
+func (r *FilterRule) matches(aircraft Aircraft) bool {
+
+	if len(r.hexRanges) > 0 {
+		address, err := strconv.ParseUint(aircraft.Hex, 16, 32)
+		if err != nil || !inHexRanges(r.hexRanges, address) {
+			return false
+		}
+	}
+
+	if len(r.Registrations) > 0 && !matchesPattern(r.Registrations, aircraft.R) {
+		return false
+	}
+
+	if len(r.Types) > 0 && !matchesPattern(r.Types, aircraft.T) {
+		return false
+	}
+
+	if len(r.Categories) > 0 && !matchesPattern(r.Categories, aircraft.Category) {
+		return false
+	}
+
+	if len(r.Squawks) > 0 && !matchesPattern(r.Squawks, aircraft.Squawk) {
+		return false
+	}
+
+	if len(r.callsigns) > 0 && !matchesRegexp(r.callsigns, aircraft.Flight) {
+		return false
+	}
+
+	if len(r.Sources) > 0 && !containsString(r.Sources, aircraftSource(aircraft)) {
+		return false
+	}
+
+	if r.Altitude != nil {
+		altitude, ok := aircraftAltitude(aircraft)
+		if !ok || !r.Altitude.contains(altitude) {
+			return false
+		}
+	}
+
+	if r.Distance != nil {
+		distance, ok := aircraftDistance(aircraft)
+		if !ok || !r.Distance.contains(distance) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *FilterRange) contains(value float64) bool {
+	return (r.Min == nil || value >= *r.Min) && (r.Max == nil || value < *r.Max)
+}
+
+func inHexRanges(ranges [][2]uint64, address uint64) bool {
+	for _, hexRange := range ranges {
+		if address >= hexRange[0] && address <= hexRange[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// Shell style patterns, e.g. "G-*" or "C?", ignoring case
+func matchesPattern(patterns []string, value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToUpper(pattern), strings.ToUpper(value)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesRegexp(patterns []*regexp.Regexp, value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// The data source an aircraft was last heard through, from readsb's type,
+// e.g. adsb_icao is "adsb" and tisb_trackfile is "tisb"
+func aircraftSource(aircraft Aircraft) string {
+	for _, source := range filterSources {
+		if aircraft.Type == source || strings.HasPrefix(aircraft.Type, source+"_") {
+			return source
+		}
+	}
+	return "other"
+}
+
+// Barometric altitude where known, falling back to geometric. Aircraft on
+// the ground are at 0.
+func aircraftAltitude(aircraft Aircraft) (float64, bool) {
+	if aircraft.OnGround {
+		return 0, true
+	}
+	if aircraft.AltBaro.Valid {
+		return float64(aircraft.AltBaro.Int64), true
+	}
+	if aircraft.AltGeom.Valid {
+		return float64(aircraft.AltGeom.Int64), true
+	}
+	return 0, false
+}
+
+func aircraftDistance(aircraft Aircraft) (float64, bool) {
+	if aircraft.HasPosition() {
+		return *getDistance([]float64{aircraft.Lon.Float64, aircraft.Lat.Float64}), true
+	}
+	return estimateDistance(aircraft)
+}
+
+type filterRuleStatus struct {
+	FilterRule
+	Dropped int64 `json:"dropped"`
+}
+
+func getFilterStatus() map[string]any {
+
+	filterDrops.mu.Lock()
+	defer filterDrops.mu.Unlock()
+
+	rules := make([]filterRuleStatus, 0, len(filters.Rules))
+	for _, rule := range filters.Rules {
+		rules = append(rules, filterRuleStatus{FilterRule: rule, Dropped: filterDrops.counts[rule.Name]})
+	}
+
+	builtIn := make(map[string]int64)
+	for _, name := range []string{filterDropNonAircraft, filterDropNotIncluded, filterDropOutsideArea, filterDropNoPosition} {
+		builtIn[name] = filterDrops.counts[name]
+	}
+
+	area := "radius"
+	if len(filters.Polygons) > 0 {
+		area = "polygons"
+	}
+
+	polygons := filters.Polygons
+	if polygons == nil {
+		polygons = []FilterPolygon{}
+	}
+
+	return map[string]any{
+		"file":                 config.Filters.File,
+		"since":                filterDrops.since,
+		"exclude_non_aircraft": filters.ExcludeNonAircraft == nil || *filters.ExcludeNonAircraft,
+		"area":                 area,
+		"radius":               getRadius(),
+		"mode_s_only":          getModeSOnly(),
+		"polygons":             polygons,
+		"rules":                rules,
+		"dropped":              builtIn,
+		"kept":                 filterDrops.kept,
+	}
+}
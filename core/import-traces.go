@@ -0,0 +1,596 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const tracePrefix = "trace_full_"
+
+// A readsb trace_full_<hex>.json file. Each point in the trace is an array of
+//
+//	[seconds after timestamp, lat, lon, altitude or "ground", ground speed,
+//	 track, flags, vertical rate, aircraft details or null, source type,
+//	 geometric altitude, geometric vertical rate, ias, roll]
+//
+// where the aircraft details are only included when something changed.
+type traceFile struct {
+	Icao      string            `json:"icao"`
+	R         string            `json:"r"`
+	T         string            `json:"t"`
+	DbFlags   int               `json:"dbFlags"`
+	Timestamp float64           `json:"timestamp"`
+	Trace     []json.RawMessage `json:"trace"`
+}
+
+type tracePoint struct {
+	epoch    float64
+	lat      float64
+	lon      float64
+	altBaro  *float64
+	gs       *float64
+	track    *float64
+	baroRate *float64
+	details  *traceDetails
+	source   string
+	altGeom  *float64
+	ias      *float64
+	onGround bool
+}
+
+// A rebuilt session, with its thinned track
+type traceSession struct {
+	Aircraft
+	positions []trackPoint
+}
+
+type traceDetails struct {
+	Flight   string   `json:"flight"`
+	Squawk   string   `json:"squawk"`
+	Category string   `json:"category"`
+	Tas      *float64 `json:"tas"`
+}
+
+// Rebuilds aircraft_data sessions from readsb trace files, e.g. a
+// globe_history directory. Points are split into sessions with the same gap
+// rule as live traffic, and sessions that overlap ones already in the
+// database are skipped, so an import can safely be re-run.
+//
+// The imported rows are left unprocessed, and are picked up by the route,
+// registration, interesting and statistics jobs as normal.
+func ImportTraces(ctx context.Context, pg *postgres, dir string, station string) error {
+
+	filesByHex, err := findTraceFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	if len(filesByHex) == 0 {
+		return fmt.Errorf("no %s*.json files found in %s", tracePrefix, dir)
+	}
+
+	hexes := make([]string, 0, len(filesByHex))
+	for hex := range filesByHex {
+		hexes = append(hexes, hex)
+	}
+	sort.Strings(hexes)
+
+	imported, skipped := 0, 0
+
+	for i, hex := range hexes {
+
+		if ctx.Err() != nil {
+			ingestLog.Info("Import stopped", "imported", imported, "skipped", skipped)
+			return ctx.Err()
+		}
+
+		aircraft, points := readTraces(filesByHex[hex])
+		if len(points) == 0 {
+			continue
+		}
+		aircraft.Hex = hex
+		aircraft.Stations = []string{station}
+
+		sessions := buildTraceSessions(aircraft, points)
+
+		existing, err := getSessionRanges(ctx, pg, hex)
+		if err != nil {
+			return err
+		}
+
+		var sessionsToInsert []traceSession
+		for _, session := range sessions {
+			if overlapsSession(session.Aircraft, existing) {
+				skipped++
+				continue
+			}
+			sessionsToInsert = append(sessionsToInsert, session)
+		}
+
+		if err := insertTraceSessions(writeContext(ctx), pg, sessionsToInsert); err != nil {
+			ingestLog.Info("Import stopped", "imported", imported, "skipped", skipped)
+			return fmt.Errorf("Error importing %s: %w", hex, err)
+		}
+		imported += len(sessionsToInsert)
+
+		if (i+1)%1000 == 0 {
+			ingestLog.Info("Importing traces", "aircraft", i+1, "of", len(hexes), "imported", imported)
+		}
+	}
+
+	ingestLog.Info("Import complete", "imported", imported, "skipped", skipped)
+
+	return nil
+}
+
+// Returns the trace files under dir grouped by hex, so that flights spanning
+// several days of globe_history are stitched back together
+func findTraceFiles(dir string) (map[string][]string, error) {
+
+	filesByHex := make(map[string][]string)
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name := d.Name()
+		if d.IsDir() || !strings.HasPrefix(name, tracePrefix) {
+			return nil
+		}
+
+		hex := strings.TrimPrefix(name, tracePrefix)
+		hex = strings.TrimSuffix(strings.TrimSuffix(hex, ".gz"), ".json")
+		hex = strings.ToLower(hex)
+
+		filesByHex[hex] = append(filesByHex[hex], path)
+		return nil
+	})
+
+	return filesByHex, err
+}
+
+// Reads every trace file for one aircraft, returning the aircraft details and
+// all of its points in time order
+func readTraces(files []string) (Aircraft, []tracePoint) {
+
+	var aircraft Aircraft
+	var points []tracePoint
+
+	for _, file := range files {
+
+		trace, err := readTraceFile(file)
+		if err != nil {
+			ingestLog.Warn("Skipping unreadable trace file", "file", file, "error", err)
+			continue
+		}
+
+		if trace.R != "" {
+			aircraft.R = trace.R
+		}
+		if trace.T != "" {
+			aircraft.T = trace.T
+		}
+		if trace.DbFlags != 0 {
+			aircraft.DbFlags = trace.DbFlags
+		}
+
+		for _, raw := range trace.Trace {
+			point, ok := parseTracePoint(trace.Timestamp, raw)
+			if ok {
+				points = append(points, point)
+			}
+		}
+	}
+
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].epoch < points[j].epoch
+	})
+
+	return aircraft, points
+}
+
+// readsb gzips trace files but still names them .json
+func readTraceFile(file string) (*traceFile, error) {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var r io.Reader = reader
+
+	if magic, err := reader.Peek(2); err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var trace traceFile
+	if err := json.NewDecoder(r).Decode(&trace); err != nil {
+		return nil, err
+	}
+
+	return &trace, nil
+}
+
+func parseTracePoint(timestamp float64, raw json.RawMessage) (tracePoint, bool) {
+
+	var fields []json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil || len(fields) < 3 {
+		return tracePoint{}, false
+	}
+
+	offset := traceNumber(fields, 0)
+	lat := traceNumber(fields, 1)
+	lon := traceNumber(fields, 2)
+	if offset == nil || lat == nil || lon == nil {
+		return tracePoint{}, false
+	}
+
+	point := tracePoint{
+		epoch:    timestamp + *offset,
+		lat:      *lat,
+		lon:      *lon,
+		altBaro:  traceNumber(fields, 3),
+		gs:       traceNumber(fields, 4),
+		track:    traceNumber(fields, 5),
+		baroRate: traceNumber(fields, 7),
+		altGeom:  traceNumber(fields, 10),
+		ias:      traceNumber(fields, 12),
+		onGround: len(fields) > 3 && string(fields[3]) == `"ground"`,
+	}
+
+	// Altitude and vertical rate are geometric rather than barometric when
+	// flagged as such
+	if flags := traceNumber(fields, 6); flags != nil {
+		if int(*flags)&8 != 0 {
+			if point.altGeom == nil {
+				point.altGeom = point.altBaro
+			}
+			point.altBaro = nil
+		}
+		if int(*flags)&4 != 0 {
+			point.baroRate = nil
+		}
+	}
+
+	if len(fields) > 8 && string(fields[8]) != "null" {
+		var details traceDetails
+		if err := json.Unmarshal(fields[8], &details); err == nil {
+			details.Flight = strings.TrimSpace(details.Flight)
+			point.details = &details
+		}
+	}
+
+	if len(fields) > 9 {
+		json.Unmarshal(fields[9], &point.source)
+	}
+
+	return point, true
+}
+
+// Returns nil for missing, null or non-numeric fields, e.g. "ground"
+func traceNumber(fields []json.RawMessage, i int) *float64 {
+
+	if i >= len(fields) || string(fields[i]) == "null" {
+		return nil
+	}
+
+	var value float64
+	if err := json.Unmarshal(fields[i], &value); err != nil {
+		return nil
+	}
+
+	return &value
+}
+
+// Splits an aircraft's points into sessions wherever it went unseen for more
+// than sessionGapSeconds, ignoring points outside RADIUS or the filter polygons
+func buildTraceSessions(aircraft Aircraft, points []tracePoint) []traceSession {
+
+	var sessions []traceSession
+	var session *traceSession
+
+	for _, point := range points {
+
+		if !filters.inArea(point.lat, point.lon) {
+			continue
+		}
+		distance := *getDistance([]float64{point.lon, point.lat})
+
+		if session != nil && point.epoch-session.LastSeenEpoch > sessionGapSeconds {
+			sessions = append(sessions, *session)
+			// Details are only traced when they change, the category won't have
+			aircraft.Category = session.Category
+			session = nil
+		}
+
+		if session == nil {
+			session = &traceSession{Aircraft: Aircraft{
+				Hex:            aircraft.Hex,
+				R:              aircraft.R,
+				T:              aircraft.T,
+				DbFlags:        aircraft.DbFlags,
+				Stations:       aircraft.Stations,
+				Type:           point.source,
+				Category:       aircraft.Category,
+				Lat:            validFloat(point.lat),
+				Lon:            validFloat(point.lon),
+				FirstSeenEpoch: point.epoch,
+			}}
+		}
+
+		applyTracePoint(&session.Aircraft, point, distance)
+
+		// Positions are thinned the same way as live traffic
+		position := trackPoint{
+			time:    time.UnixMilli(int64(point.epoch * 1000)),
+			lat:     point.lat,
+			lon:     point.lon,
+			altBaro: nullIntFromTrace(point.altBaro),
+			altGeom: nullIntFromTrace(point.altGeom),
+			gs:      nullFloatFromTrace(point.gs),
+			track:   nullFloatFromTrace(point.track),
+			source:  point.source,
+		}
+		if len(session.positions) == 0 || isNextTrackPoint(session.positions[len(session.positions)-1], position) {
+			session.positions = append(session.positions, position)
+		}
+	}
+
+	if session != nil {
+		sessions = append(sessions, *session)
+	}
+
+	// Drop sessions that would have been filtered out when received live
+	var aircraftSessions []traceSession
+	for _, s := range sessions {
+		if filters.checkRules(s.Aircraft) == "" {
+			aircraftSessions = append(aircraftSessions, s)
+		}
+	}
+
+	return aircraftSessions
+}
+
+// Folds a point into a session, keeping the highest altitudes and speeds as
+// updateExistingAircrafts does
+func applyTracePoint(session *Aircraft, point tracePoint, distance float64) {
+
+	session.LastSeenEpoch = point.epoch
+	session.LastSeenLat.Float64, session.LastSeenLat.Valid = point.lat, true
+	session.LastSeenLon.Float64, session.LastSeenLon.Valid = point.lon, true
+	session.LastSeenDistance.Float64, session.LastSeenDistance.Valid = math.Round(distance*100)/100, true
+	session.Messages++
+
+	if session.Type == "" {
+		session.Type = point.source
+	}
+	session.OnGround = point.onGround
+	if point.track != nil {
+		session.Track = validFloat(*point.track)
+	}
+	if point.baroRate != nil {
+		session.BaroRate = validInt(int(*point.baroRate))
+	}
+	if point.altBaro != nil {
+		session.AltBaro = maxNullInt(session.AltBaro, validInt(int(*point.altBaro)))
+	}
+	if point.altGeom != nil {
+		session.AltGeom = maxNullInt(session.AltGeom, validInt(int(*point.altGeom)))
+	}
+	if point.gs != nil {
+		session.Gs = maxNullFloat(session.Gs, validFloat(*point.gs))
+	}
+	if point.ias != nil {
+		session.Ias = maxNullInt(session.Ias, validInt(int(*point.ias)))
+	}
+
+	if point.details != nil {
+		if session.Flight == "" {
+			session.Flight = point.details.Flight
+		}
+		if point.details.Squawk != "" {
+			session.Squawk = point.details.Squawk
+		}
+		if point.details.Category != "" {
+			session.Category = point.details.Category
+		}
+		if point.details.Tas != nil {
+			session.Tas = maxNullInt(session.Tas, validInt(int(*point.details.Tas)))
+		}
+	}
+}
+
+type sessionRange struct {
+	firstSeen float64
+	lastSeen  float64
+}
+
+func getSessionRanges(ctx context.Context, pg *postgres, hex string) ([]sessionRange, error) {
+
+	query := `
+		SELECT first_seen_epoch, last_seen_epoch
+		FROM aircraft_data
+		WHERE hex = $1`
+
+	rows, err := pg.db.Query(ctx, query, hex)
+	if err != nil {
+		return nil, fmt.Errorf("getSessionRanges() - Error querying db: %w", err)
+	}
+	defer rows.Close()
+
+	var ranges []sessionRange
+	for rows.Next() {
+		var r sessionRange
+		if err := rows.Scan(&r.firstSeen, &r.lastSeen); err != nil {
+			ingestLog.Error("Error scanning existing sessions", "hex", hex, "error", err)
+			continue
+		}
+		ranges = append(ranges, r)
+	}
+
+	return ranges, rows.Err()
+}
+
+// A session overlaps an existing one if live ingestion would have merged them
+func overlapsSession(session Aircraft, existing []sessionRange) bool {
+	for _, r := range existing {
+		if session.FirstSeenEpoch <= r.lastSeen+sessionGapSeconds &&
+			session.LastSeenEpoch >= r.firstSeen-sessionGapSeconds {
+			return true
+		}
+	}
+	return false
+}
+
+// Inserts the sessions and their positions in one transaction, so either all
+// of them are imported or none are
+func insertTraceSessions(ctx context.Context, pg *postgres, sessions []traceSession) error {
+
+	if len(sessions) == 0 {
+		return nil
+	}
+
+	tx, err := pg.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	batch := &pgx.Batch{}
+
+	for _, session := range sessions {
+
+		insertStatement := `
+			INSERT INTO aircraft_data (
+				hex,
+				flight,
+				first_seen,
+				first_seen_epoch,
+				last_seen,
+				last_seen_epoch,
+				last_seen_lat,
+				last_seen_lon,
+				last_seen_distance,
+				type,
+				r,
+				t,
+				alt_baro,
+				alt_geom,
+				gs,
+				ias,
+				tas,
+				track,
+				baro_rate,
+				squawk,
+				lat,
+				lon,
+				messages,
+				db_flags,
+				stations,
+				on_ground,
+				address_type
+			) VALUES (
+				$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13,
+				$14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25,
+				$26, $27
+			)
+			RETURNING id`
+
+		batch.Queue(insertStatement,
+			session.Hex,
+			session.Flight,
+			time.Unix(int64(session.FirstSeenEpoch), 0),
+			int64(session.FirstSeenEpoch),
+			time.Unix(int64(session.LastSeenEpoch), 0),
+			int64(session.LastSeenEpoch),
+			session.LastSeenLat,
+			session.LastSeenLon,
+			session.LastSeenDistance,
+			session.Type,
+			session.R,
+			session.T,
+			session.AltBaro,
+			session.AltGeom,
+			session.Gs,
+			session.Ias,
+			session.Tas,
+			session.Track,
+			session.BaroRate,
+			session.Squawk,
+			session.Lat,
+			session.Lon,
+			session.Messages,
+			session.DbFlags,
+			session.Stations,
+			session.OnGround,
+			addressType(session.Aircraft))
+	}
+
+	br := tx.SendBatch(ctx, batch)
+
+	var positionIds []int
+	var positions []trackPoint
+
+	for _, session := range sessions {
+		var id int
+		if err := br.QueryRow().Scan(&id); err != nil {
+			br.Close()
+			return fmt.Errorf("unable to insert session: %w", err)
+		}
+		for _, position := range session.positions {
+			positionIds = append(positionIds, id)
+			positions = append(positions, position)
+		}
+	}
+
+	if err := br.Close(); err != nil {
+		return fmt.Errorf("unable to insert sessions: %w", err)
+	}
+
+	if err := copyPositions(ctx, tx, positionIds, positions); err != nil {
+		return fmt.Errorf("unable to insert positions: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("unable to commit sessions: %w", err)
+	}
+
+	return nil
+}
+
+func nullIntFromTrace(value *float64) sql.NullInt64 {
+	if value == nil {
+		return sql.NullInt64{}
+	}
+	return validInt(int(*value))
+}
+
+func nullFloatFromTrace(value *float64) sql.NullFloat64 {
+	if value == nil {
+		return sql.NullFloat64{}
+	}
+	return validFloat(*value)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ingestMaxBodySize = 16 * 1024 * 1024
+	// Allowance for the feeder's clock running ahead of ours
+	ingestMaxClockSkew = 30 * time.Second
+)
+
+// A remote receiver pushing its aircraft.json to POST /api/ingest, for sites
+// that can't be polled, e.g. behind NAT
+type ingestFeeder struct {
+	name  string
+	token string
+
+	// Held while a snapshot is checked and stored, so lastNow only moves on
+	// once the snapshot it is from has been written or spooled
+	storeMu sync.Mutex
+
+	mu         sync.Mutex
+	lastNow    float64
+	lastSeen   time.Time
+	lastLag    time.Duration
+	aircraft   int
+	accepted   int64
+	rejected   int64
+	lastReject string
+}
+
+type ingestFeederStatus struct {
+	Feeder     string     `json:"feeder"`
+	LastSeen   *time.Time `json:"last_seen"`
+	LastNow    *time.Time `json:"last_now"`
+	LagSeconds *float64   `json:"lag_seconds"`
+	Aircraft   int        `json:"aircraft"`
+	Accepted   int64      `json:"accepted"`
+	Rejected   int64      `json:"rejected"`
+	LastReject string     `json:"last_reject,omitempty"`
+}
+
+// Set once at startup by loadIngestFeeders
+var ingestFeeders = make(map[string]*ingestFeeder)
+
+// Reads INGEST_FEEDERS, a comma separated list of feeder=token pairs, e.g.
+//
+//	remote=8c1f0e...,boat=51d2a9...
+//
+// Feeders are recorded as stations under their name, so can't share a name
+// with a station in READSB_SOURCES.
+func loadIngestFeeders(stations []string) error {
+
+	feeders := config.Ingest.Feeders
+	if feeders == "" {
+		return nil
+	}
+
+	for _, entry := range strings.Split(feeders, ",") {
+
+		name, token, found := strings.Cut(strings.TrimSpace(entry), "=")
+		name = strings.TrimSpace(name)
+		token = strings.TrimSpace(token)
+
+		if !found || name == "" || token == "" {
+			return fmt.Errorf("invalid INGEST_FEEDERS entry, expected feeder=token")
+		}
+		if _, ok := ingestFeeders[name]; ok {
+			return fmt.Errorf("duplicate feeder name %q in INGEST_FEEDERS", name)
+		}
+		for _, station := range stations {
+			if station == name {
+				return fmt.Errorf("feeder name %q in INGEST_FEEDERS is already a station", name)
+			}
+		}
+
+		ingestFeeders[name] = &ingestFeeder{name: name, token: token}
+	}
+
+	ingestLog.Info("Accepting pushed snapshots", "feeders", len(ingestFeeders))
+
+	return nil
+}
+
+func ingestFeederNames() []string {
+	names := make([]string, 0, len(ingestFeeders))
+	for name := range ingestFeeders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Accepts an aircraft.json payload, optionally gzipped, from a feeder. The
+// feeder is named by the X-Feeder-Id header and authenticated with its token
+// as "Authorization: Bearer <token>".
+//
+// Each payload's "now" must be later than the last one accepted from the
+// feeder, and recent, so a captured request can't be replayed.
+func (s *APIServer) ingest(c *gin.Context) {
+
+	feeder, ok := ingestFeeders[c.GetHeader("X-Feeder-Id")]
+	if !ok || !feeder.authorized(c.GetHeader("Authorization")) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unknown feeder or invalid token"})
+		return
+	}
+
+	data, err := readIngestBody(c)
+	if err != nil {
+		feeder.reject(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	response, err := parseResponse(data)
+	if err != nil {
+		feeder.reject(err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	feeder.storeMu.Lock()
+	defer feeder.storeMu.Unlock()
+
+	received := time.Now()
+	lag, status, err := feeder.check(response.Now, received)
+	if err != nil {
+		feeder.reject(err.Error())
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	response.TrimFlightStrings()
+	for i := range response.Aircraft {
+		response.Aircraft[i].Stations = []string{feeder.name}
+	}
+
+	// Not accepted, so the feeder can send the same snapshot again
+	if err := storeSnapshot(c.Request.Context(), s.pg, response.Now, filterAircraft(response.Aircraft)); err != nil {
+		ingestLog.Error("Unable to store snapshot", "feeder", feeder.name, "error", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Unable to store the snapshot, try again later"})
+		return
+	}
+
+	feeder.accept(response.Now, received, lag, len(response.Aircraft))
+
+	c.JSON(http.StatusOK, gin.H{"feeder": feeder.name, "aircraft": len(response.Aircraft)})
+}
+
+func (s *APIServer) getIngestFeeders(c *gin.Context) {
+
+	statuses := make([]ingestFeederStatus, 0, len(ingestFeeders))
+	for _, name := range ingestFeederNames() {
+		statuses = append(statuses, ingestFeeders[name].status())
+	}
+
+	c.JSON(http.StatusOK, statuses)
+}
+
+func readIngestBody(c *gin.Context) ([]byte, error) {
+
+	data, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, ingestMaxBodySize))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read body: %w", err)
+	}
+
+	// Content-Encoding isn't always set by feeders posting a .gz file
+	if c.GetHeader("Content-Encoding") == "gzip" || bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %w", err)
+		}
+		defer reader.Close()
+
+		data, err = io.ReadAll(io.LimitReader(reader, ingestMaxBodySize+1))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %w", err)
+		}
+		if len(data) > ingestMaxBodySize {
+			return nil, fmt.Errorf("body is larger than %d bytes", ingestMaxBodySize)
+		}
+	}
+
+	return data, nil
+}
+
+func (f *ingestFeeder) authorized(header string) bool {
+	token, found := strings.CutPrefix(header, "Bearer ")
+	return found && subtle.ConstantTimeCompare([]byte(token), []byte(f.token)) == 1
+}
+
+// Checks a payload's "now" against the last accepted, returning how far
+// behind it is
+func (f *ingestFeeder) check(now float64, received time.Time) (time.Duration, int, error) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	lag := received.Sub(time.UnixMilli(int64(now * 1000)))
+	maxLag := time.Duration(config.Ingest.MaxLagSeconds * float64(time.Second))
+
+	switch {
+	case now <= 0:
+		return 0, http.StatusBadRequest, fmt.Errorf("payload has no now")
+	case now <= f.lastNow:
+		return 0, http.StatusConflict, fmt.Errorf("now %.1f is not later than the last accepted %.1f", now, f.lastNow)
+	// Older snapshots would be recorded as the aircraft's latest position
+	case lag > maxLag:
+		return 0, http.StatusConflict, fmt.Errorf("now is %s old, the limit is %s", lag.Round(time.Second), maxLag)
+	case lag < -ingestMaxClockSkew:
+		return 0, http.StatusConflict, fmt.Errorf("now is %s in the future, check the feeder's clock", (-lag).Round(time.Second))
+	}
+
+	return lag, http.StatusOK, nil
+}
+
+// Records a payload that has been stored
+func (f *ingestFeeder) accept(now float64, received time.Time, lag time.Duration, aircraft int) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.lastNow = now
+	f.lastSeen = received
+	f.lastLag = lag
+	f.aircraft = aircraft
+	f.accepted++
+}
+
+func (f *ingestFeeder) reject(reason string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rejected++
+	f.lastReject = reason
+	ingestLog.Warn("Rejected snapshot", "feeder", f.name, "reason", reason)
+}
+
+func (f *ingestFeeder) status() ingestFeederStatus {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	status := ingestFeederStatus{
+		Feeder:     f.name,
+		Aircraft:   f.aircraft,
+		Accepted:   f.accepted,
+		Rejected:   f.rejected,
+		LastReject: f.lastReject,
+	}
+
+	if !f.lastSeen.IsZero() {
+		lastSeen := f.lastSeen
+		lastNow := time.UnixMilli(int64(f.lastNow * 1000))
+		lag := f.lastLag.Seconds()
+		status.LastSeen = &lastSeen
+		status.LastNow = &lastNow
+		status.LagSeconds = &lag
+	}
+
+	return status
+}
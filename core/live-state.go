@@ -0,0 +1,575 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// A session being tracked. aircraft is its state as it will be in
+// aircraft_data, update holds the readings from the snapshots since it was
+// last written, nil if there haven't been any.
+type liveSession struct {
+	aircraft  *Aircraft
+	update    *Aircraft
+	modeSOnly bool
+}
+
+// The sessions seen within the session gap, by hex, so each snapshot doesn't
+// have to look them up in aircraft_data. Changes are written in batches every
+// LIVE_FLUSH_SECONDS rather than on every snapshot. ended holds sessions that
+// were replaced by a new session for the same hex before their readings were
+// written, until the next flush writes them.
+var liveSessions = struct {
+	mu        sync.Mutex
+	sessions  map[string]*liveSession
+	ended     []*liveSession
+	lastFlush float64
+}{sessions: make(map[string]*liveSession)}
+
+// Destinations by callsign, nil where route_data doesn't have one
+type cachedRoute struct {
+	route   *RouteData
+	fetched time.Time
+}
+
+var routeCache = struct {
+	mu     sync.Mutex
+	routes map[string]cachedRoute
+}{routes: make(map[string]cachedRoute)}
+
+type RouteData struct {
+	DestinationLatitude  sql.NullFloat64
+	DestinationLongitude sql.NullFloat64
+}
+
+// LIVE_FLUSH_SECONDS sets how often tracked sessions are written to
+// aircraft_data, default 10
+func getLiveFlushSeconds() float64 {
+	return config.Sessions.FlushSeconds
+}
+
+// Loads the sessions still within the session gap, and the route
+// destinations, so the first snapshots after a restart don't have to
+func warmLiveState(ctx context.Context, pg *postgres) error {
+
+	nowEpoch := float64(time.Now().Unix())
+
+	sessions, err := loadRecentSessions(ctx, pg, nowEpoch, nil)
+	if err != nil {
+		return err
+	}
+
+	liveSessions.mu.Lock()
+	for hex, aircraft := range sessions {
+		liveSessions.sessions[hex] = &liveSession{aircraft: aircraft}
+	}
+	liveSessions.lastFlush = nowEpoch
+	liveSessions.mu.Unlock()
+
+	routes, err := loadRoutes(ctx, pg, nil)
+	if err != nil {
+		return err
+	}
+
+	routeCache.mu.Lock()
+	fetched := time.Now()
+	for flight, route := range routes {
+		routeCache.routes[flight] = cachedRoute{route: route, fetched: fetched}
+	}
+	routeCache.mu.Unlock()
+
+	ingestLog.Info("Loaded active sessions", "sessions", len(sessions), "routes", len(routes))
+
+	return nil
+}
+
+// Returns the tracked sessions for the aircraft in a snapshot, looking up any
+// hex that isn't already tracked in aircraft_data, e.g. when replaying
+func getLiveSessions(ctx context.Context, pg *postgres, nowEpoch float64, aircrafts []Aircraft) (map[string]*Aircraft, error) {
+
+	existingAircrafts := make(map[string]*Aircraft)
+
+	liveSessions.mu.Lock()
+	defer liveSessions.mu.Unlock()
+
+	var missing []string
+	for _, aircraft := range aircrafts {
+		session, ok := liveSessions.sessions[aircraft.Hex]
+		if !ok {
+			missing = append(missing, aircraft.Hex)
+			continue
+		}
+		if nowEpoch-session.aircraft.LastSeenEpoch > sessionGapSeconds {
+			continue
+		}
+		existingAircrafts[aircraft.Hex] = session.aircraft
+	}
+
+	if len(missing) == 0 {
+		return existingAircrafts, nil
+	}
+
+	// Without these, sessions already in aircraft_data would be inserted again
+	sessions, err := loadRecentSessions(ctx, pg, nowEpoch, missing)
+	if err != nil {
+		return nil, err
+	}
+
+	for hex, aircraft := range sessions {
+		liveSessions.sessions[hex] = &liveSession{aircraft: aircraft}
+		existingAircrafts[hex] = aircraft
+	}
+
+	return existingAircrafts, nil
+}
+
+// Merges a snapshot's readings into a tracked session, to be written on the
+// next flush
+func updateLiveSession(existingAircraft *Aircraft, aircraft Aircraft) {
+
+	liveSessions.mu.Lock()
+	defer liveSessions.mu.Unlock()
+
+	session, ok := liveSessions.sessions[aircraft.Hex]
+	if !ok || session.aircraft != existingAircraft {
+		return
+	}
+
+	if session.update == nil {
+		update := aircraft
+		update.Stations = append([]string{}, aircraft.Stations...)
+		update.Datalinks = aircraftDatalinks(aircraft)
+		session.update = &update
+		session.modeSOnly = !aircraft.HasPosition()
+		return
+	}
+
+	session.update = mergeLiveUpdate(session.update, aircraft)
+	session.modeSOnly = session.modeSOnly && !aircraft.HasPosition()
+}
+
+// Starts tracking the sessions inserted for a snapshot. They were written
+// with the snapshot's readings, so have nothing to flush yet. Readings still
+// waiting for the session a new one replaces are kept for the next flush.
+func trackLiveSessions(nowEpoch float64, aircrafts []Aircraft, sessionIds map[string]int) {
+
+	liveSessions.mu.Lock()
+	defer liveSessions.mu.Unlock()
+
+	for _, aircraft := range aircrafts {
+
+		id, ok := sessionIds[aircraft.Hex]
+		if !ok {
+			continue
+		}
+		session, ok := liveSessions.sessions[aircraft.Hex]
+		if ok && session.aircraft.Id == id {
+			continue
+		}
+		if ok && session.update != nil {
+			liveSessions.ended = append(liveSessions.ended, session)
+		}
+
+		tracked := Aircraft{
+			Id:               id,
+			Hex:              aircraft.Hex,
+			Flight:           aircraft.Flight,
+			LastSeen:         time.Unix(int64(nowEpoch), 0),
+			LastSeenEpoch:    nowEpoch,
+			LastSeenLat:      sightingCoordinate(aircraft, aircraft.Lat),
+			LastSeenLon:      sightingCoordinate(aircraft, aircraft.Lon),
+			LastSeenDistance: sightingDistance(aircraft),
+			AltBaro:          aircraft.AltBaro,
+			AltGeom:          aircraft.AltGeom,
+			Gs:               aircraft.Gs,
+			Ias:              aircraft.Ias,
+			Tas:              aircraft.Tas,
+			Track:            aircraft.Track,
+			OnGround:         aircraft.OnGround,
+		}
+
+		liveSessions.sessions[aircraft.Hex] = &liveSession{aircraft: &tracked}
+	}
+}
+
+// Merges the readings from a later snapshot the same way the UPDATE in
+// flushLiveSessions merges them into aircraft_data, so that flushing once
+// gives the same row as writing every snapshot
+func mergeLiveUpdate(pending *Aircraft, aircraft Aircraft) *Aircraft {
+
+	merged := aircraft
+
+	merged.Stations = mergeDatalinks(pending.Stations, aircraft.Stations)
+	merged.Datalinks = mergeDatalinks(pending.Datalinks, aircraftDatalinks(aircraft))
+
+	if merged.Squawk == "" {
+		merged.Squawk = pending.Squawk
+	}
+	// An emergency isn't cleared once declared
+	if pending.Emergency != "" && pending.Emergency != "none" && (merged.Emergency == "" || merged.Emergency == "none") {
+		merged.Emergency = pending.Emergency
+	} else if merged.Emergency == "" {
+		merged.Emergency = pending.Emergency
+	}
+
+	merged.Mach = maxNullFloat(pending.Mach, aircraft.Mach)
+	merged.Roll = coalesceFloat(aircraft.Roll, pending.Roll)
+	merged.MagHeading = coalesceFloat(aircraft.MagHeading, pending.MagHeading)
+	merged.TrueHeading = coalesceFloat(aircraft.TrueHeading, pending.TrueHeading)
+	merged.TrackRate = coalesceFloat(aircraft.TrackRate, pending.TrackRate)
+	merged.GeomRate = coalesceInt(aircraft.GeomRate, pending.GeomRate)
+	if merged.NavModes == nil {
+		merged.NavModes = pending.NavModes
+	}
+	merged.NavAltitudeFms = coalesceInt(aircraft.NavAltitudeFms, pending.NavAltitudeFms)
+	merged.Gva = coalesceInt(aircraft.Gva, pending.Gva)
+	merged.Sda = coalesceInt(aircraft.Sda, pending.Sda)
+	merged.Oat = coalesceInt(aircraft.Oat, pending.Oat)
+	merged.Tat = coalesceInt(aircraft.Tat, pending.Tat)
+	merged.Wd = coalesceInt(aircraft.Wd, pending.Wd)
+	merged.Ws = coalesceInt(aircraft.Ws, pending.Ws)
+	merged.RrLat = coalesceFloat(aircraft.RrLat, pending.RrLat)
+	merged.RrLon = coalesceFloat(aircraft.RrLon, pending.RrLon)
+	merged.LastPosition.Lat = coalesceFloat(aircraft.LastPosition.Lat, pending.LastPosition.Lat)
+	merged.LastPosition.Lon = coalesceFloat(aircraft.LastPosition.Lon, pending.LastPosition.Lon)
+	merged.LastPosition.Nic = coalesceInt(aircraft.LastPosition.Nic, pending.LastPosition.Nic)
+	merged.LastPosition.Rc = coalesceInt(aircraft.LastPosition.Rc, pending.LastPosition.Rc)
+	merged.LastPosition.SeenPos = coalesceFloat(aircraft.LastPosition.SeenPos, pending.LastPosition.SeenPos)
+
+	return &merged
+}
+
+// Writes the sessions when LIVE_FLUSH_SECONDS have passed since the last
+// flush, going by the snapshot times so replays flush at the same rate
+func flushLiveSessionsIfDue(ctx context.Context, pg *postgres, nowEpoch float64) {
+
+	liveSessions.mu.Lock()
+	due := nowEpoch-liveSessions.lastFlush >= getLiveFlushSeconds()
+	liveSessions.mu.Unlock()
+
+	if due {
+		flushLiveSessions(ctx, pg, nowEpoch)
+	}
+}
+
+// Writes every session with readings waiting in one batch, then stops
+// tracking sessions that have ended. Sessions that fail to write keep their
+// readings, and are tried again on the next flush.
+func flushLiveSessions(ctx context.Context, pg *postgres, nowEpoch float64) {
+
+	liveSessions.mu.Lock()
+	defer liveSessions.mu.Unlock()
+
+	liveSessions.lastFlush = nowEpoch
+
+	pending := append([]*liveSession{}, liveSessions.ended...)
+	for _, session := range liveSessions.sessions {
+		if session.update != nil {
+			pending = append(pending, session)
+		}
+	}
+
+	batch := &pgx.Batch{}
+	var flushed []*liveSession
+
+	for _, session := range pending {
+
+		existingAircraft := session.aircraft
+		aircraft := session.update
+
+		updateStatement := `UPDATE aircraft_data
+							SET last_seen = $1,
+								last_seen_epoch = $2,
+								last_seen_lat = COALESCE($3, last_seen_lat),
+								last_seen_lon = COALESCE($4, last_seen_lon),
+								last_seen_distance = COALESCE($5, last_seen_distance),
+								destination_distance = COALESCE($6, destination_distance),
+								track = COALESCE($7, track),
+								alt_baro = $8,
+								alt_geom = $9,
+								gs = $10,
+								ias = $11,
+								tas = $12,
+								flight = $13,
+								stations = ARRAY(SELECT DISTINCT unnest(stations || $14::text[])),
+								on_ground = $15,
+								squawk = COALESCE(NULLIF($16, ''), squawk),
+								emergency = COALESCE(NULLIF(NULLIF($17, ''), 'none'), emergency, NULLIF($17, '')),
+								mach = GREATEST(mach, $18),
+								roll = COALESCE($19, roll),
+								mag_heading = COALESCE($20, mag_heading),
+								true_heading = COALESCE($21, true_heading),
+								track_rate = COALESCE($22, track_rate),
+								geom_rate = COALESCE($23, geom_rate),
+								nav_modes = COALESCE($24, nav_modes),
+								nav_altitude_fms = COALESCE($25, nav_altitude_fms),
+								gva = COALESCE($26, gva),
+								sda = COALESCE($27, sda),
+								oat = COALESCE($28, oat),
+								tat = COALESCE($29, tat),
+								wd = COALESCE($30, wd),
+								ws = COALESCE($31, ws),
+								rr_lat = COALESCE($32, rr_lat),
+								rr_lon = COALESCE($33, rr_lon),
+								last_position_lat = COALESCE($34, last_position_lat),
+								last_position_lon = COALESCE($35, last_position_lon),
+								last_position_nic = COALESCE($36, last_position_nic),
+								last_position_rc = COALESCE($37, last_position_rc),
+								last_position_seen_pos = COALESCE($38, last_position_seen_pos),
+								mode_s_only = mode_s_only AND $39,
+								lat = COALESCE(lat, $40),
+								lon = COALESCE(lon, $41),
+								datalinks = ARRAY(SELECT DISTINCT unnest(datalinks || $42::text[]))
+							WHERE id = $43`
+
+		batch.Queue(
+			updateStatement,
+			existingAircraft.LastSeen,
+			existingAircraft.LastSeenEpoch,
+			existingAircraft.LastSeenLat,
+			existingAircraft.LastSeenLon,
+			existingAircraft.LastSeenDistance,
+			existingAircraft.DestinationDistance,
+			existingAircraft.Track,
+			existingAircraft.AltBaro,
+			existingAircraft.AltGeom,
+			existingAircraft.Gs,
+			existingAircraft.Ias,
+			existingAircraft.Tas,
+			existingAircraft.Flight,
+			aircraft.Stations,
+			existingAircraft.OnGround,
+			aircraft.Squawk,
+			aircraft.Emergency,
+			aircraft.Mach,
+			aircraft.Roll,
+			aircraft.MagHeading,
+			aircraft.TrueHeading,
+			aircraft.TrackRate,
+			aircraft.GeomRate,
+			aircraft.NavModes,
+			aircraft.NavAltitudeFms,
+			aircraft.Gva,
+			aircraft.Sda,
+			aircraft.Oat,
+			aircraft.Tat,
+			aircraft.Wd,
+			aircraft.Ws,
+			aircraft.RrLat,
+			aircraft.RrLon,
+			aircraft.LastPosition.Lat,
+			aircraft.LastPosition.Lon,
+			aircraft.LastPosition.Nic,
+			aircraft.LastPosition.Rc,
+			aircraft.LastPosition.SeenPos,
+			session.modeSOnly,
+			existingAircraft.LastSeenLat,
+			existingAircraft.LastSeenLon,
+			aircraft.Datalinks,
+			existingAircraft.Id,
+		)
+		flushed = append(flushed, session)
+	}
+
+	if len(flushed) > 0 {
+		br := pg.db.SendBatch(ctx, batch)
+
+		for _, session := range flushed {
+			_, err := br.Exec()
+			if err != nil {
+				ingestLog.Error("Unable to update session", "hex", session.aircraft.Hex, "flight", session.aircraft.Flight, "error", err)
+				continue
+			}
+			session.update = nil
+		}
+
+		br.Close()
+	}
+
+	// Forget sessions that have ended
+	var ended []*liveSession
+	for _, session := range liveSessions.ended {
+		if session.update != nil {
+			ended = append(ended, session)
+		}
+	}
+	liveSessions.ended = ended
+
+	for hex, session := range liveSessions.sessions {
+		if session.update == nil && nowEpoch-session.aircraft.LastSeenEpoch > sessionGapSeconds {
+			delete(liveSessions.sessions, hex)
+		}
+	}
+}
+
+// Returns the destinations for the given callsigns, looking up the ones that
+// aren't cached, or were cached more than routeCacheSeconds ago, in one query
+func getCachedRoutes(ctx context.Context, pg *postgres, flights []string) map[string]*RouteData {
+
+	routes := make(map[string]*RouteData)
+
+	routeCache.mu.Lock()
+	defer routeCache.mu.Unlock()
+
+	var missing []string
+	for _, flight := range flights {
+		cached, ok := routeCache.routes[flight]
+		if !ok || time.Since(cached.fetched).Seconds() > config.Routes.CacheSeconds {
+			missing = append(missing, flight)
+			continue
+		}
+		routes[flight] = cached.route
+	}
+
+	if len(missing) == 0 {
+		return routes
+	}
+
+	found, err := loadRoutes(ctx, pg, missing)
+	if err != nil {
+		ingestLog.Error("Error querying routes", "error", err)
+		return routes
+	}
+
+	fetched := time.Now()
+	for _, flight := range missing {
+		routeCache.routes[flight] = cachedRoute{route: found[flight], fetched: fetched}
+		routes[flight] = found[flight]
+	}
+
+	return routes
+}
+
+// Forgets the cached destinations for newly looked up routes, so that
+// callsigns cached without one pick it up on the next snapshot
+func forgetCachedRoutes(routes []RouteInfo) {
+
+	routeCache.mu.Lock()
+	defer routeCache.mu.Unlock()
+
+	for _, route := range routes {
+		delete(routeCache.routes, route.Callsign)
+	}
+}
+
+// Loads the latest session for each hex, or for every hex if hexes is nil,
+// that was seen within the session gap of nowEpoch
+func loadRecentSessions(ctx context.Context, pg *postgres, nowEpoch float64, hexes []string) (map[string]*Aircraft, error) {
+
+	query := `
+		SELECT DISTINCT ON (hex)
+			id,
+			hex,
+			COALESCE(flight, ''),
+			last_seen,
+			last_seen_epoch,
+			last_seen_lat,
+			last_seen_lon,
+			last_seen_distance,
+			destination_distance,
+			track,
+			alt_baro,
+			alt_geom,
+			gs,
+			ias,
+			tas,
+			COALESCE(on_ground, false)
+		FROM aircraft_data
+		WHERE ($1::text[] IS NULL OR hex = ANY($1::text[]))
+		AND last_seen_epoch >= $2
+		ORDER BY hex, last_seen DESC;
+    `
+
+	rows, err := pg.db.Query(ctx, query, hexes, int64(nowEpoch)-sessionGapSeconds)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make(map[string]*Aircraft)
+
+	for rows.Next() {
+		var existingAircraft Aircraft
+		err := rows.Scan(
+			&existingAircraft.Id,
+			&existingAircraft.Hex,
+			&existingAircraft.Flight,
+			&existingAircraft.LastSeen,
+			&existingAircraft.LastSeenEpoch,
+			&existingAircraft.LastSeenLat,
+			&existingAircraft.LastSeenLon,
+			&existingAircraft.LastSeenDistance,
+			&existingAircraft.DestinationDistance,
+			&existingAircraft.Track,
+			&existingAircraft.AltBaro,
+			&existingAircraft.AltGeom,
+			&existingAircraft.Gs,
+			&existingAircraft.Ias,
+			&existingAircraft.Tas,
+			&existingAircraft.OnGround)
+
+		if err != nil {
+			ingestLog.Error("Error scanning sessions", "error", err)
+			continue
+		}
+
+		sessions[existingAircraft.Hex] = &existingAircraft
+	}
+
+	return sessions, rows.Err()
+}
+
+// Loads the destination for each callsign, or every callsign if flights is
+// nil
+func loadRoutes(ctx context.Context, pg *postgres, flights []string) (map[string]*RouteData, error) {
+
+	query := `
+		SELECT DISTINCT ON (route_callsign)
+			route_callsign,
+			destination_latitude,
+			destination_longitude
+		FROM route_data
+		WHERE ($1::text[] IS NULL OR route_callsign = ANY($1::text[]))
+		AND destination_latitude IS NOT NULL
+		AND destination_longitude IS NOT NULL
+		ORDER BY route_callsign
+	`
+
+	rows, err := pg.db.Query(ctx, query, flights)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	routes := make(map[string]*RouteData)
+
+	for rows.Next() {
+		var flight string
+		var route RouteData
+		if err := rows.Scan(&flight, &route.DestinationLatitude, &route.DestinationLongitude); err != nil {
+			ingestLog.Error("Error scanning routes", "error", err)
+			continue
+		}
+		routes[flight] = &route
+	}
+
+	return routes, rows.Err()
+}
+
+func coalesceFloat(latest sql.NullFloat64, previous sql.NullFloat64) sql.NullFloat64 {
+	if latest.Valid {
+		return latest
+	}
+	return previous
+}
+
+func coalesceInt(latest sql.NullInt64, previous sql.NullInt64) sql.NullInt64 {
+	if latest.Valid {
+		return latest
+	}
+	return previous
+}
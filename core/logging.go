@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A logger per subsystem, each tagged with subsystem=<name> and given its own
+// level by log.levels. Anything else logs through slog's default logger.
+// They write through the standard log package until setupLogging is called.
+var (
+	ingestLog        = slog.Default().With("subsystem", "ingest")
+	routesLog        = slog.Default().With("subsystem", "routes")
+	registrationsLog = slog.Default().With("subsystem", "registrations")
+	interestingLog   = slog.Default().With("subsystem", "interesting")
+	motionLog        = slog.Default().With("subsystem", "motion")
+	correlationLog   = slog.Default().With("subsystem", "correlation")
+	acarsLog         = slog.Default().With("subsystem", "acars")
+	jobsLog          = slog.Default().With("subsystem", "jobs")
+	dbLog            = slog.Default().With("subsystem", "db")
+	apiLog           = slog.Default().With("subsystem", "api")
+)
+
+var subsystemLogs = map[string]**slog.Logger{
+	"ingest":        &ingestLog,
+	"routes":        &routesLog,
+	"registrations": &registrationsLog,
+	"interesting":   &interestingLog,
+	"motion":        &motionLog,
+	"correlation":   &correlationLog,
+	"acars":         &acarsLog,
+	"jobs":          &jobsLog,
+	"db":            &dbLog,
+	"api":           &apiLog,
+}
+
+// Set by serve -foreground, see setupLogging
+var foreground bool
+
+// Points every logger at stderr, as text or json at the levels in the config.
+// Called once the config is loaded. The standard log package, used by some
+// dependencies, is sent to the default logger too.
+func setupLogging() {
+
+	options := func(level slog.Level) *slog.HandlerOptions {
+		opts := &slog.HandlerOptions{Level: level}
+
+		// journald timestamps every line already
+		if foreground && os.Getenv("JOURNAL_STREAM") != "" && config.Log.Format != "json" {
+			opts.ReplaceAttr = func(groups []string, attr slog.Attr) slog.Attr {
+				if attr.Key == slog.TimeKey && len(groups) == 0 {
+					return slog.Attr{}
+				}
+				return attr
+			}
+		}
+
+		return opts
+	}
+
+	handler := func(level slog.Level) slog.Handler {
+		if config.Log.Format == "json" {
+			return slog.NewJSONHandler(os.Stderr, options(level))
+		}
+		return slog.NewTextHandler(os.Stderr, options(level))
+	}
+
+	// Checked by validate, so can't fail here
+	level, _ := parseLogLevel(config.Log.Level)
+	levels, _ := parseLogLevels(config.Log.Levels)
+
+	slog.SetDefault(slog.New(handler(level)))
+
+	for name, logger := range subsystemLogs {
+		subsystemLevel := level
+		if l, ok := levels[name]; ok {
+			subsystemLevel = l
+		}
+		*logger = slog.New(handler(subsystemLevel)).With("subsystem", name)
+	}
+
+	// gin's own output is only route listings and warnings meant for
+	// development, shown when the api is logging at debug
+	if !apiLog.Enabled(context.Background(), slog.LevelDebug) {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	gin.DebugPrintFunc = func(format string, values ...any) {
+		apiLog.Debug(strings.TrimSpace(fmt.Sprintf(format, values...)))
+	}
+}
+
+func parseLogLevel(value string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return level, fmt.Errorf("must be debug, info, warn or error, got %q", value)
+	}
+	return level, nil
+}
+
+// log.levels is a comma separated list of subsystem=level, e.g.
+// routes=debug,api=warn
+func parseLogLevels(value string) (map[string]slog.Level, error) {
+
+	levels := make(map[string]slog.Level)
+	if value == "" {
+		return levels, nil
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		name, levelName, found := strings.Cut(strings.TrimSpace(entry), "=")
+		name = strings.TrimSpace(name)
+		if !found {
+			return nil, fmt.Errorf("expected subsystem=level, got %q", entry)
+		}
+		if _, ok := subsystemLogs[name]; !ok {
+			return nil, fmt.Errorf("unknown subsystem %q", name)
+		}
+		level, err := parseLogLevel(strings.TrimSpace(levelName))
+		if err != nil {
+			return nil, fmt.Errorf("%s %w", name, err)
+		}
+		levels[name] = level
+	}
+
+	return levels, nil
+}
+
+// Logs each request once it has been handled, in place of gin's logger
+func requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+
+		attrs := []any{
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", status,
+			"duration", time.Since(start),
+			"client", c.ClientIP(),
+		}
+		if errs := c.Errors.String(); errs != "" {
+			attrs = append(attrs, "error", strings.TrimSpace(errs))
+		}
+
+		apiLog.Log(c.Request.Context(), level, "Request", attrs...)
+	}
+}
+
+// Logs a panic in a handler with its stack, in place of gin's recovery
+func requestRecovery() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, err any) {
+		apiLog.Error("Panic handling request",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"error", err,
+			"stack", string(debug.Stack()))
+		c.AbortWithStatus(http.StatusInternalServerError)
+	})
+}
@@ -13,44 +13,65 @@ type Response struct {
 }
 type Aircraft struct {
 	Id                  int
-	Hex                 string  `json:"hex"`
-	Type                string  `json:"type"`
-	Flight              string  `json:"flight"`
-	R                   string  `json:"r"`
-	T                   string  `json:"t"`
-	AltBaro             int     `json:"alt_baro"`
-	AltGeom             int     `json:"alt_geom"`
-	Gs                  float64 `json:"gs"`
-	Ias                 int     `json:"ias"`
-	Tas                 int     `json:"tas"`
-	Track               float64 `json:"track"`
-	BaroRate            int     `json:"baro_rate"`
-	NavQnh              float64 `json:"nav_qnh"`
-	NavAltitudeMcp      int     `json:"nav_altitude_mcp"`
-	NavHeading          float64 `json:"nav_heading"`
-	Lat                 float64 `json:"lat"`
-	Lon                 float64 `json:"lon"`
-	Nic                 int     `json:"nic"`
-	Rc                  int     `json:"rc"`
-	SeenPos             float64 `json:"seen_pos"`
-	RDst                float64 `json:"r_dst"`
-	RDir                float64 `json:"r_dir"`
-	Version             int     `json:"version"`
-	NicBaro             int     `json:"nic_baro"`
-	NacP                int     `json:"nac_p"`
-	NacV                int     `json:"nac_v"`
-	Sil                 int     `json:"sil"`
-	SilType             string  `json:"sil_type"`
-	Alert               int     `json:"alert"`
-	Spi                 int     `json:"spi"`
-	Mlat                []any   `json:"mlat"`
-	Tisb                []any   `json:"tisb"`
-	Messages            int     `json:"messages"`
-	Seen                float64 `json:"seen"`
-	Rssi                int     `json:"rssi"`
-	DbFlags             int     `json:"dbFlags"`
-	Squawk              string  `json:"squawk"`
-	Category            string  `json:"category"`
+	Hex                 string          `json:"hex"`
+	Type                string          `json:"type"`
+	Flight              string          `json:"flight"`
+	R                   string          `json:"r"`
+	T                   string          `json:"t"`
+	AltBaro             sql.NullInt64   `json:"alt_baro"`
+	AltGeom             sql.NullInt64   `json:"alt_geom"`
+	Gs                  sql.NullFloat64 `json:"gs"`
+	Ias                 sql.NullInt64   `json:"ias"`
+	Tas                 sql.NullInt64   `json:"tas"`
+	Track               sql.NullFloat64 `json:"track"`
+	BaroRate            sql.NullInt64   `json:"baro_rate"`
+	NavQnh              sql.NullFloat64 `json:"nav_qnh"`
+	NavAltitudeMcp      sql.NullInt64   `json:"nav_altitude_mcp"`
+	NavHeading          sql.NullFloat64 `json:"nav_heading"`
+	Lat                 sql.NullFloat64 `json:"lat"`
+	Lon                 sql.NullFloat64 `json:"lon"`
+	Nic                 sql.NullInt64   `json:"nic"`
+	Rc                  sql.NullInt64   `json:"rc"`
+	SeenPos             float64         `json:"seen_pos"`
+	RDst                sql.NullFloat64 `json:"r_dst"`
+	RDir                sql.NullFloat64 `json:"r_dir"`
+	Version             sql.NullInt64   `json:"version"`
+	NicBaro             sql.NullInt64   `json:"nic_baro"`
+	NacP                sql.NullInt64   `json:"nac_p"`
+	NacV                sql.NullInt64   `json:"nac_v"`
+	Sil                 sql.NullInt64   `json:"sil"`
+	SilType             string          `json:"sil_type"`
+	Alert               int             `json:"alert"`
+	Spi                 int             `json:"spi"`
+	Mlat                []any           `json:"mlat"`
+	Tisb                []any           `json:"tisb"`
+	Messages            int             `json:"messages"`
+	Seen                float64         `json:"seen"`
+	Rssi                float64         `json:"rssi"`
+	DbFlags             int             `json:"dbFlags"`
+	Squawk              string          `json:"squawk"`
+	Category            string          `json:"category"`
+	Mach                sql.NullFloat64 `json:"mach"`
+	Roll                sql.NullFloat64 `json:"roll"`
+	MagHeading          sql.NullFloat64 `json:"mag_heading"`
+	TrueHeading         sql.NullFloat64 `json:"true_heading"`
+	TrackRate           sql.NullFloat64 `json:"track_rate"`
+	GeomRate            sql.NullInt64   `json:"geom_rate"`
+	Emergency           string          `json:"emergency"`
+	NavModes            []string        `json:"nav_modes"`
+	NavAltitudeFms      sql.NullInt64   `json:"nav_altitude_fms"`
+	Gva                 sql.NullInt64   `json:"gva"`
+	Sda                 sql.NullInt64   `json:"sda"`
+	Oat                 sql.NullInt64   `json:"oat"`
+	Tat                 sql.NullInt64   `json:"tat"`
+	Wd                  sql.NullInt64   `json:"wd"`
+	Ws                  sql.NullInt64   `json:"ws"`
+	RrLat               sql.NullFloat64 `json:"rr_lat"`
+	RrLon               sql.NullFloat64 `json:"rr_lon"`
+	LastPosition        LastPosition    `json:"lastPosition"`
+	OnGround            bool
+	Stations            []string
+	Datalinks           []string
 	FirstSeen           time.Time
 	FirstSeenEpoch      float64
 	LastSeen            time.Time
@@ -65,6 +86,16 @@ type Aircraft struct {
 	SlowestProcessed    bool
 }
 
+// The last known position, which readsb keeps reporting for a while after
+// the position itself has gone stale
+type LastPosition struct {
+	Lat     sql.NullFloat64
+	Lon     sql.NullFloat64
+	Nic     sql.NullInt64
+	Rc      sql.NullInt64
+	SeenPos sql.NullFloat64
+}
+
 type InterestingAircraft struct {
 	Icao         string
 	Registration sql.NullString
@@ -85,21 +116,49 @@ type InterestingAircraft struct {
 	Flight       string
 	R            string
 	T            string
-	AltBaro      int
-	AltGeom      int
-	Gs           float64
-	Ias          int
-	Tas          int
-	Track        float64
-	BaroRate     int
-	Lat          float64
-	Lon          float64
+	AltBaro      sql.NullInt64
+	AltGeom      sql.NullInt64
+	Gs           sql.NullFloat64
+	Ias          sql.NullInt64
+	Tas          sql.NullInt64
+	Track        sql.NullFloat64
+	BaroRate     sql.NullInt64
+	Lat          sql.NullFloat64
+	Lon          sql.NullFloat64
 	Alert        int
 	DbFlags      int
 	Seen         time.Time
 	SeenEpoch    float64
 }
 
+func validInt(v int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(v), Valid: true}
+}
+
+func validFloat(v float64) sql.NullFloat64 {
+	return sql.NullFloat64{Float64: v, Valid: true}
+}
+
+// Empty strings are stored as NULL
+func nonEmptyString(v string) sql.NullString {
+	return sql.NullString{String: v, Valid: v != ""}
+}
+
+// Keeps the higher of two readings, ignoring missing ones
+func maxNullInt(a sql.NullInt64, b sql.NullInt64) sql.NullInt64 {
+	if !a.Valid || (b.Valid && b.Int64 > a.Int64) {
+		return b
+	}
+	return a
+}
+
+func maxNullFloat(a sql.NullFloat64, b sql.NullFloat64) sql.NullFloat64 {
+	if !a.Valid || (b.Valid && b.Float64 > a.Float64) {
+		return b
+	}
+	return a
+}
+
 // Flight string sometimes has trailing whitespace
 func (r *Response) TrimFlightStrings() {
 	for i := range r.Aircraft {
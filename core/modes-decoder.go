@@ -0,0 +1,489 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	modesShortLength = 7
+	modesLongLength  = 14
+	modesCrcPoly     = 0xFFF409
+	metersToFeet     = 3.28084
+)
+
+var modesCharset = "#ABCDEFGHIJKLMNOPQRSTUVWXYZ##### ###############0123456789######"
+
+// A single decoded Mode S message. Fields that were not present in the
+// message are left nil / empty.
+type modesMessage struct {
+	df       int
+	hex      string
+	addrType string
+	callsign string
+	category string
+	altBaro  *int
+	altGeom  *int
+	squawk   string
+	gs       *float64
+	track    *float64
+	ias      *int
+	tas      *int
+	heading  *float64
+	baroRate *int
+	cpr      *cprFrame
+}
+
+// An undecoded airborne CPR position
+type cprFrame struct {
+	odd bool
+	lat int
+	lon int
+}
+
+// Decodes a raw Mode S message. DF17/18 (extended squitter) and DF11 carry
+// their own CRC and are trusted as-is. DF4/5/20/21 have the address overlaid
+// on the parity, so are only accepted for addresses already known through
+// isKnown, in the same way readsb does.
+func decodeModeS(msg []byte, isKnown func(hex string) bool) (*modesMessage, error) {
+
+	if len(msg) == 0 {
+		return nil, fmt.Errorf("empty message")
+	}
+
+	df := int(msg[0] >> 3)
+	if df > 24 {
+		df = 24
+	}
+
+	if len(msg) != modesMessageLength(df) {
+		return nil, fmt.Errorf("invalid length %d for DF%d", len(msg), df)
+	}
+
+	m := &modesMessage{df: df}
+	residual := modesChecksum(msg)
+
+	switch df {
+	case 11:
+		if residual&0xFFFF80 != 0 {
+			return nil, fmt.Errorf("DF11 failed CRC")
+		}
+		m.hex = modesAddress(msg[1:4])
+		m.addrType = "mode_s"
+
+	case 17, 18:
+		if residual != 0 {
+			return nil, fmt.Errorf("DF%d failed CRC", df)
+		}
+		m.hex = modesAddress(msg[1:4])
+		m.addrType = "adsb_icao"
+		if df == 18 {
+			// CF 0 is an ICAO address from a non-transponder device, anything
+			// else is TIS-B / ADS-R or an anonymous address
+			if cf := msg[0] & 7; cf == 0 {
+				m.addrType = "adsb_icao_nt"
+			} else {
+				m.hex = "~" + m.hex
+				m.addrType = "adsb_other"
+				if cf == 2 || cf == 3 || cf == 5 {
+					m.addrType = "tisb_other"
+				} else if cf == 6 {
+					m.addrType = "adsr_other"
+				}
+			}
+		}
+		decodeExtendedSquitter(msg[4:11], m)
+
+	case 4, 20:
+		m.hex = fmt.Sprintf("%06x", residual)
+		if !isKnown(m.hex) {
+			return nil, fmt.Errorf("DF%d from unknown address %s", df, m.hex)
+		}
+		if altitude, ok := decodeAC13(int(msg[2]&0x1F)<<8 | int(msg[3])); ok {
+			m.altBaro = &altitude
+		}
+
+	case 5, 21:
+		m.hex = fmt.Sprintf("%06x", residual)
+		if !isKnown(m.hex) {
+			return nil, fmt.Errorf("DF%d from unknown address %s", df, m.hex)
+		}
+		m.squawk = fmt.Sprintf("%04x", decodeID13(int(msg[2]&0x1F)<<8|int(msg[3])))
+
+	default:
+		return nil, fmt.Errorf("DF%d not supported", df)
+	}
+
+	return m, nil
+}
+
+// DF0-15 are 56 bit, DF16 and above are 112 bit
+func modesMessageLength(df int) int {
+	if df >= 16 {
+		return modesLongLength
+	}
+	return modesShortLength
+}
+
+// Returns the CRC remainder of the message. For DF11/17/18 this is zero (or
+// the interrogator ID) on a good message, for DF4/5/20/21 it is the address.
+func modesChecksum(msg []byte) uint32 {
+
+	var crc uint32
+
+	for _, b := range msg[:len(msg)-3] {
+		crc ^= uint32(b) << 16
+		for i := 0; i < 8; i++ {
+			if crc&0x800000 != 0 {
+				crc = (crc << 1) ^ modesCrcPoly
+			} else {
+				crc <<= 1
+			}
+		}
+		crc &= 0xFFFFFF
+	}
+
+	parity := uint32(msg[len(msg)-3])<<16 | uint32(msg[len(msg)-2])<<8 | uint32(msg[len(msg)-1])
+
+	return crc ^ parity
+}
+
+func modesAddress(b []byte) string {
+	return fmt.Sprintf("%02x%02x%02x", b[0], b[1], b[2])
+}
+
+// Decodes the 56 bit ME field of an extended squitter
+func decodeExtendedSquitter(me []byte, m *modesMessage) {
+
+	typeCode := int(me[0] >> 3)
+
+	switch {
+	case typeCode >= 1 && typeCode <= 4:
+		decodeIdentification(me, typeCode, m)
+	case typeCode >= 9 && typeCode <= 18:
+		decodeAirbornePosition(me, m, false)
+	case typeCode == 19:
+		decodeAirborneVelocity(me, m)
+	case typeCode >= 20 && typeCode <= 22:
+		decodeAirbornePosition(me, m, true)
+	}
+}
+
+func decodeIdentification(me []byte, typeCode int, m *modesMessage) {
+
+	// Category set A-D maps to type code 4-1
+	m.category = fmt.Sprintf("%c%d", 'A'+(4-typeCode), me[0]&7)
+
+	bits := uint64(0)
+	for _, b := range me[1:7] {
+		bits = bits<<8 | uint64(b)
+	}
+
+	callsign := make([]byte, 8)
+	for i := 0; i < 8; i++ {
+		callsign[i] = modesCharset[(bits>>(42-6*i))&0x3F]
+	}
+
+	m.callsign = string(callsign)
+}
+
+func decodeAirbornePosition(me []byte, m *modesMessage, gnss bool) {
+
+	ac12 := int(me[1])<<4 | int(me[2])>>4
+
+	if gnss {
+		if ac12 != 0 {
+			altitude := int(math.Round(float64(ac12) * metersToFeet))
+			m.altGeom = &altitude
+		}
+	} else if altitude, ok := decodeAC12(ac12); ok {
+		m.altBaro = &altitude
+	}
+
+	m.cpr = &cprFrame{
+		odd: me[2]&0x04 != 0,
+		lat: int(me[2]&0x03)<<15 | int(me[3])<<7 | int(me[4])>>1,
+		lon: int(me[4]&0x01)<<16 | int(me[5])<<8 | int(me[6]),
+	}
+}
+
+func decodeAirborneVelocity(me []byte, m *modesMessage) {
+
+	subtype := me[0] & 7
+	multiplier := 1
+	if subtype == 2 || subtype == 4 {
+		multiplier = 4
+	}
+
+	switch subtype {
+	case 1, 2:
+		ewRaw := int(me[1]&0x03)<<8 | int(me[2])
+		nsRaw := int(me[3]&0x7F)<<3 | int(me[4])>>5
+		if ewRaw != 0 && nsRaw != 0 {
+			vx := float64((ewRaw - 1) * multiplier)
+			vy := float64((nsRaw - 1) * multiplier)
+			if me[1]&0x04 != 0 {
+				vx = -vx
+			}
+			if me[3]&0x80 != 0 {
+				vy = -vy
+			}
+
+			gs := math.Round(math.Hypot(vx, vy)*10) / 10
+			track := math.Atan2(vx, vy) * 180 / math.Pi
+			if track < 0 {
+				track += 360
+			}
+			track = math.Round(track*100) / 100
+
+			m.gs = &gs
+			m.track = &track
+		}
+
+	case 3, 4:
+		if me[1]&0x04 != 0 {
+			heading := float64(int(me[1]&0x03)<<8|int(me[2])) * 360 / 1024
+			heading = math.Round(heading*100) / 100
+			m.heading = &heading
+		}
+		if airspeedRaw := int(me[3]&0x7F)<<3 | int(me[4])>>5; airspeedRaw != 0 {
+			airspeed := (airspeedRaw - 1) * multiplier
+			if me[3]&0x80 != 0 {
+				m.tas = &airspeed
+			} else {
+				m.ias = &airspeed
+			}
+		}
+
+	default:
+		return
+	}
+
+	// Only the barometric vertical rate is kept, GNSS rate is ignored
+	rateRaw := int(me[4]&0x07)<<6 | int(me[5])>>2
+	if rateRaw != 0 && me[4]&0x10 != 0 {
+		rate := (rateRaw - 1) * 64
+		if me[4]&0x08 != 0 {
+			rate = -rate
+		}
+		m.baroRate = &rate
+	}
+}
+
+// 13 bit altitude code used by DF0/4/16/20
+func decodeAC13(ac13 int) (int, bool) {
+
+	if ac13 == 0 {
+		return 0, false
+	}
+
+	// Metric altitudes (M bit) are not supported
+	if ac13&0x0040 != 0 {
+		return 0, false
+	}
+
+	if ac13&0x0010 != 0 {
+		n := (ac13&0x1F80)>>2 | (ac13&0x0020)>>1 | ac13&0x000F
+		return n*25 - 1000, true
+	}
+
+	return gillhamToAltitude(decodeID13(ac13))
+}
+
+// 12 bit altitude code used by extended squitter airborne positions, which
+// is the 13 bit code with the M bit removed
+func decodeAC12(ac12 int) (int, bool) {
+
+	if ac12 == 0 {
+		return 0, false
+	}
+
+	return decodeAC13((ac12&0x0FC0)<<1 | ac12&0x003F)
+}
+
+// Rearranges the 13 bit identity / altitude field into ABCD ordering (as a
+// hex number, each digit being one octal Mode A digit)
+func decodeID13(id13 int) int {
+
+	gillham := 0
+	bits := []struct{ from, to int }{
+		{0x1000, 0x0010}, // C1
+		{0x0800, 0x1000}, // A1
+		{0x0400, 0x0020}, // C2
+		{0x0200, 0x2000}, // A2
+		{0x0100, 0x0040}, // C4
+		{0x0080, 0x4000}, // A4
+		{0x0020, 0x0100}, // B1
+		{0x0010, 0x0001}, // D1
+		{0x0008, 0x0200}, // B2
+		{0x0004, 0x0002}, // D2
+		{0x0002, 0x0400}, // B4
+		{0x0001, 0x0004}, // D4
+	}
+
+	for _, bit := range bits {
+		if id13&bit.from != 0 {
+			gillham |= bit.to
+		}
+	}
+
+	return gillham
+}
+
+// Converts a Gillham (Mode C) coded altitude into feet
+func gillhamToAltitude(modeA int) (int, bool) {
+
+	if modeA&0xFFFF8889 != 0 || modeA&0x000000F0 == 0 {
+		return 0, false
+	}
+
+	oneHundreds := 0
+	if modeA&0x0010 != 0 {
+		oneHundreds ^= 0x007 // C1
+	}
+	if modeA&0x0020 != 0 {
+		oneHundreds ^= 0x003 // C2
+	}
+	if modeA&0x0040 != 0 {
+		oneHundreds ^= 0x001 // C4
+	}
+	if oneHundreds&5 == 5 {
+		oneHundreds ^= 2
+	}
+	if oneHundreds > 5 {
+		return 0, false
+	}
+
+	fiveHundreds := 0
+	for _, bit := range []struct{ mask, value int }{
+		{0x0002, 0x0FF}, // D2
+		{0x0004, 0x07F}, // D4
+		{0x1000, 0x03F}, // A1
+		{0x2000, 0x01F}, // A2
+		{0x4000, 0x00F}, // A4
+		{0x0100, 0x007}, // B1
+		{0x0200, 0x003}, // B2
+		{0x0400, 0x001}, // B4
+	} {
+		if modeA&bit.mask != 0 {
+			fiveHundreds ^= bit.value
+		}
+	}
+
+	if fiveHundreds&1 != 0 {
+		oneHundreds = 6 - oneHundreds
+	}
+
+	return (fiveHundreds*5 + oneHundreds - 13) * 100, true
+}
+
+// Globally unambiguous airborne CPR decoding from an even and odd frame pair,
+// using the most recent of the two for the resulting position.
+func cprGlobalDecode(even cprFrame, odd cprFrame, oddIsLatest bool) (lat float64, lon float64, ok bool) {
+
+	const cprMax = 131072.0
+
+	latEven := float64(even.lat) / cprMax
+	lonEven := float64(even.lon) / cprMax
+	latOdd := float64(odd.lat) / cprMax
+	lonOdd := float64(odd.lon) / cprMax
+
+	j := math.Floor(59*latEven - 60*latOdd + 0.5)
+
+	rlatEven := 360.0 / 60 * (cprMod(j, 60) + latEven)
+	rlatOdd := 360.0 / 59 * (cprMod(j, 59) + latOdd)
+
+	if rlatEven >= 270 {
+		rlatEven -= 360
+	}
+	if rlatOdd >= 270 {
+		rlatOdd -= 360
+	}
+
+	if rlatEven < -90 || rlatEven > 90 || rlatOdd < -90 || rlatOdd > 90 {
+		return 0, 0, false
+	}
+
+	// Both frames must be in the same longitude zone
+	nl := cprNL(rlatEven)
+	if nl != cprNL(rlatOdd) {
+		return 0, 0, false
+	}
+
+	m := math.Floor(lonEven*float64(nl-1) - lonOdd*float64(nl) + 0.5)
+
+	if oddIsLatest {
+		ni := math.Max(float64(nl-1), 1)
+		lat = rlatOdd
+		lon = 360 / ni * (cprMod(m, ni) + lonOdd)
+	} else {
+		ni := math.Max(float64(nl), 1)
+		lat = rlatEven
+		lon = 360 / ni * (cprMod(m, ni) + lonEven)
+	}
+
+	if lon >= 180 {
+		lon -= 360
+	}
+
+	return lat, lon, true
+}
+
+// Locally unambiguous airborne CPR decoding relative to a reference position
+// within 180 NM, e.g. the last known position or the receiver.
+func cprLocalDecode(frame cprFrame, refLat float64, refLon float64) (lat float64, lon float64) {
+
+	const cprMax = 131072.0
+
+	i := 0.0
+	if frame.odd {
+		i = 1
+	}
+
+	latCpr := float64(frame.lat) / cprMax
+	lonCpr := float64(frame.lon) / cprMax
+
+	dLat := 360 / (60 - i)
+	j := math.Floor(refLat/dLat) + math.Floor(0.5+cprMod(refLat, dLat)/dLat-latCpr)
+	lat = dLat * (j + latCpr)
+
+	dLon := 360 / math.Max(float64(cprNL(lat))-i, 1)
+	m := math.Floor(refLon/dLon) + math.Floor(0.5+cprMod(refLon, dLon)/dLon-lonCpr)
+	lon = dLon * (m + lonCpr)
+
+	if lon >= 180 {
+		lon -= 360
+	}
+
+	return lat, lon
+}
+
+func cprMod(a float64, b float64) float64 {
+	res := math.Mod(a, b)
+	if res < 0 {
+		res += b
+	}
+	return res
+}
+
+// Number of longitude zones at a given latitude
+func cprNL(lat float64) int {
+
+	lat = math.Abs(lat)
+
+	if lat == 0 {
+		return 59
+	}
+	if lat == 87 {
+		return 2
+	}
+	if lat > 87 {
+		return 1
+	}
+
+	const nz = 15.0
+	a := 1 - math.Cos(math.Pi/(2*nz))
+	b := math.Pow(math.Cos(math.Pi/180*lat), 2)
+
+	return int(math.Floor(2 * math.Pi / math.Acos(1-a/b)))
+}
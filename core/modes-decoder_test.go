@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/hex"
+	"math"
+	"testing"
+)
+
+// Sample frames from "The 1090MHz Riddle" (Sun), as used by dump1090 and
+// pyModeS, with the values they decode to
+
+func decodeHexMessage(t *testing.T, message string) []byte {
+	t.Helper()
+	msg, err := hex.DecodeString(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func anyAddress(hex string) bool {
+	return true
+}
+
+func TestModesChecksum(t *testing.T) {
+
+	for _, message := range []string{
+		"8D406B902015A678D4D220AA4BDA",
+		"8D4840D6202CC371C32CE0576098",
+		"8D40621D58C382D690C8AC2863A7",
+		"8D485020994409940838175B284F",
+	} {
+		msg := decodeHexMessage(t, message)
+
+		if residual := modesChecksum(msg); residual != 0 {
+			t.Errorf("%s: residual %06x, want 0", message, residual)
+		}
+
+		// Any single flipped bit must be caught
+		for bit := 0; bit < len(msg)*8; bit++ {
+			corrupt := append([]byte{}, msg...)
+			corrupt[bit/8] ^= 0x80 >> (bit % 8)
+			if modesChecksum(corrupt) == 0 {
+				t.Errorf("%s: flipping bit %d wasn't caught", message, bit)
+			}
+			if _, err := decodeModeS(corrupt, anyAddress); err == nil && corrupt[0]>>3 == 17 {
+				t.Errorf("%s: decoded with bit %d flipped", message, bit)
+			}
+		}
+	}
+}
+
+func TestDecodeIdentification(t *testing.T) {
+
+	m, err := decodeModeS(decodeHexMessage(t, "8D4840D6202CC371C32CE0576098"), anyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.df != 17 || m.hex != "4840d6" || m.addrType != "adsb_icao" {
+		t.Errorf("df, hex, type = %d, %s, %s, want 17, 4840d6, adsb_icao", m.df, m.hex, m.addrType)
+	}
+	if m.callsign != "KLM1023 " {
+		t.Errorf("callsign = %q, want \"KLM1023 \"", m.callsign)
+	}
+	if m.category != "A0" {
+		t.Errorf("category = %q, want A0", m.category)
+	}
+}
+
+func TestDecodeAirbornePosition(t *testing.T) {
+
+	even, err := decodeModeS(decodeHexMessage(t, "8D40621D58C382D690C8AC2863A7"), anyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	odd, err := decodeModeS(decodeHexMessage(t, "8D40621D58C386435CC412692AD6"), anyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range []*modesMessage{even, odd} {
+		if m.altBaro == nil || *m.altBaro != 38000 {
+			t.Errorf("alt_baro = %v, want 38000", m.altBaro)
+		}
+		if m.cpr == nil {
+			t.Fatal("no CPR position")
+		}
+	}
+
+	if *even.cpr != (cprFrame{odd: false, lat: 93000, lon: 51372}) {
+		t.Errorf("even frame = %+v, want lat 93000, lon 51372", *even.cpr)
+	}
+	if *odd.cpr != (cprFrame{odd: true, lat: 74158, lon: 50194}) {
+		t.Errorf("odd frame = %+v, want lat 74158, lon 50194", *odd.cpr)
+	}
+
+	// The even frame is the later of the two
+	lat, lon, ok := cprGlobalDecode(*even.cpr, *odd.cpr, false)
+	if !ok || !near(lat, 52.25720214843750) || !near(lon, 3.91937255859375) {
+		t.Errorf("global decode = %v, %v, %v, want 52.2572, 3.91937", lat, lon, ok)
+	}
+
+	lat, lon = cprLocalDecode(*even.cpr, 52.258, 3.918)
+	if !near(lat, 52.25720214843750) || !near(lon, 3.91937255859375) {
+		t.Errorf("local decode = %v, %v, want 52.2572, 3.91937", lat, lon)
+	}
+}
+
+func TestCprNL(t *testing.T) {
+
+	for _, test := range []struct {
+		lat float64
+		nl  int
+	}{
+		{0, 59},
+		{10.4704713, 58},
+		{52.2572, 36},
+		{-52.2572, 36},
+		{86.5353700, 2},
+		{87, 2},
+		{89.9, 1},
+	} {
+		if nl := cprNL(test.lat); nl != test.nl {
+			t.Errorf("NL(%v) = %d, want %d", test.lat, nl, test.nl)
+		}
+	}
+}
+
+func TestDecodeAirborneVelocity(t *testing.T) {
+
+	// Ground speed, with a GNSS vertical rate, which isn't kept
+	m, err := decodeModeS(decodeHexMessage(t, "8D485020994409940838175B284F"), anyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.gs == nil || *m.gs != 159.2 {
+		t.Errorf("gs = %v, want 159.2", m.gs)
+	}
+	if m.track == nil || *m.track != 182.88 {
+		t.Errorf("track = %v, want 182.88", m.track)
+	}
+	if m.baroRate != nil {
+		t.Errorf("baro_rate = %d, want none for a GNSS rate", *m.baroRate)
+	}
+
+	// Airspeed and heading, with a barometric vertical rate
+	m, err = decodeModeS(decodeHexMessage(t, "8DA05F219B06B6AF189400CBC33F"), anyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.heading == nil || *m.heading != 243.98 {
+		t.Errorf("heading = %v, want 243.98", m.heading)
+	}
+	if m.tas == nil || *m.tas != 375 || m.ias != nil {
+		t.Errorf("tas, ias = %v, %v, want 375, none", m.tas, m.ias)
+	}
+	if m.baroRate == nil || *m.baroRate != -2304 {
+		t.Errorf("baro_rate = %v, want -2304", m.baroRate)
+	}
+}
+
+func TestDecodeSurveillanceReplies(t *testing.T) {
+
+	// DF4 altitude, 25 ft coding
+	m, err := decodeModeS(decodeHexMessage(t, "2000171806A983"), anyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.altBaro == nil || *m.altBaro != 36000 {
+		t.Errorf("DF4 alt_baro = %v, want 36000", m.altBaro)
+	}
+
+	// DF5 identity
+	m, err = decodeModeS(decodeHexMessage(t, "2A00516D492B80"), anyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.squawk != "0356" {
+		t.Errorf("DF5 squawk = %q, want 0356", m.squawk)
+	}
+
+	// The address is overlaid on the parity, so is what the CRC leaves
+	msg := decodeHexMessage(t, "2A00516D000000")
+	parity := modesChecksum(msg) ^ 0x4ca1b2
+	msg[4], msg[5], msg[6] = byte(parity>>16), byte(parity>>8), byte(parity)
+
+	m, err = decodeModeS(msg, anyAddress)
+	if err != nil || m.hex != "4ca1b2" {
+		t.Errorf("DF5 hex = %v, %v, want 4ca1b2", m, err)
+	}
+	if _, err := decodeModeS(msg, func(hex string) bool { return false }); err == nil {
+		t.Error("DF5 from an unknown address was accepted")
+	}
+}
+
+// Builds the ABCD (hex digit per octal Mode A digit) Gillham code for an
+// altitude, from its definition: 500 ft steps in Gray code on D2 D4 A1 A2 A4
+// B1 B2 B4, and 100 ft steps as 1-5 on C1 C2 C4, counting down in odd steps
+func gillhamCode(altitude int) int {
+
+	n := (altitude + 1300) / 100
+	fiveHundreds := (n - 1) / 5
+	oneHundreds := (n-1)%5 + 1
+	if fiveHundreds%2 == 1 {
+		oneHundreds = 6 - oneHundreds
+	}
+
+	code := 0
+
+	gray := fiveHundreds ^ fiveHundreds>>1
+	for i, bit := range []int{0x0002, 0x0004, 0x1000, 0x2000, 0x4000, 0x0100, 0x0200, 0x0400} {
+		if gray&(0x80>>i) != 0 {
+			code |= bit
+		}
+	}
+
+	// C1 C2 C4
+	code |= []int{0, 0x0040, 0x0060, 0x0020, 0x0030, 0x0010}[oneHundreds]
+
+	return code
+}
+
+func TestGillhamToAltitude(t *testing.T) {
+
+	for _, test := range []struct {
+		code     int
+		altitude int
+	}{
+		{0x0040, -1200}, // C4
+		{0x0060, -1100}, // C2 C4
+		{0x0020, -1000}, // C2
+		{0x0030, -900},  // C1 C2
+		{0x0010, -800},  // C1
+		{0x0410, -700},  // B4 C1, counting down in an odd 500 ft step
+		{0x0620, 0},     // B2 B4 C2
+	} {
+		altitude, ok := gillhamToAltitude(test.code)
+		if !ok || altitude != test.altitude {
+			t.Errorf("gillham %04x = %d, %v, want %d", test.code, altitude, ok, test.altitude)
+		}
+	}
+
+	// Every 100 ft step the code can carry
+	for altitude := -1200; altitude <= 126700; altitude += 100 {
+		code := gillhamCode(altitude)
+		if decoded, ok := gillhamToAltitude(code); !ok || decoded != altitude {
+			t.Fatalf("gillham %04x = %d, %v, want %d", code, decoded, ok, altitude)
+		}
+	}
+
+	// No C bits, or D1 set, isn't a valid altitude
+	for _, code := range []int{0x0000, 0x0600, 0x0621} {
+		if altitude, ok := gillhamToAltitude(code); ok {
+			t.Errorf("gillham %04x = %d, want invalid", code, altitude)
+		}
+	}
+}
+
+func TestDecodeAC13(t *testing.T) {
+
+	// The ID13 field order is C1 A1 C2 A2 C4 A4 M B1 Q B2 D2 B4 D4
+	ac13 := func(code int) int {
+		field := 0
+		for _, bit := range []struct{ from, to int }{
+			{0x0010, 0x1000}, {0x1000, 0x0800}, {0x0020, 0x0400}, {0x2000, 0x0200},
+			{0x0040, 0x0100}, {0x4000, 0x0080}, {0x0100, 0x0020}, {0x0001, 0x0010},
+			{0x0200, 0x0008}, {0x0002, 0x0004}, {0x0400, 0x0002}, {0x0004, 0x0001},
+		} {
+			if code&bit.from != 0 {
+				field |= bit.to
+			}
+		}
+		return field
+	}
+
+	for _, altitude := range []int{-1000, 0, 2500, 18300, 50100, 126700} {
+		decoded, ok := decodeAC13(ac13(gillhamCode(altitude)))
+		if !ok || decoded != altitude {
+			t.Errorf("AC13 Gillham %d = %d, %v", altitude, decoded, ok)
+		}
+	}
+
+	// Q bit set, 25 ft steps
+	if altitude, ok := decodeAC13(0x1718); !ok || altitude != 36000 {
+		t.Errorf("AC13 0x1718 = %d, %v, want 36000", altitude, ok)
+	}
+
+	// M bit set, metric, isn't decoded
+	if _, ok := decodeAC13(0x1758); ok {
+		t.Error("metric AC13 was decoded")
+	}
+
+	// AC12 drops the M bit
+	if altitude, ok := decodeAC12(0xC38); !ok || altitude != 38000 {
+		t.Errorf("AC12 0xC38 = %d, %v, want 38000", altitude, ok)
+	}
+}
+
+func near(a float64, b float64) bool {
+	return math.Abs(a-b) < 1e-6
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+)
+
+const nauticalMilesToKm = 1.852
+
+// How aircraft without a position (Mode S only, or ADS-B aircraft that
+// haven't sent a position yet) are handled, set with MODE_S_ONLY
+const (
+	// Recorded, unless a range estimate puts them outside RADIUS or the
+	// filter polygons (default)
+	modeSOnlyInclude = "include"
+	// Only recorded when a range estimate puts them inside RADIUS or the
+	// filter polygons
+	modeSOnlyRanged = "ranged"
+	// Dropped, as they were before
+	modeSOnlyExclude = "exclude"
+)
+
+func (a Aircraft) HasPosition() bool {
+	return a.Lat.Valid && a.Lon.Valid
+}
+
+func getModeSOnly() string {
+	return config.Receiver.ModeSOnly
+}
+
+// Whether a position-less aircraft should be recorded
+func includeModeSOnly(aircraft Aircraft) bool {
+
+	mode := getModeSOnly()
+	if mode == modeSOnlyExclude {
+		return false
+	}
+
+	// Polygons need somewhere to test, so only the rough position can be used
+	if len(filters.Polygons) > 0 {
+		if aircraft.RrLat.Valid && aircraft.RrLon.Valid {
+			return filters.inArea(aircraft.RrLat.Float64, aircraft.RrLon.Float64)
+		}
+		return mode == modeSOnlyInclude
+	}
+
+	distance, ok := estimateDistance(aircraft)
+	if !ok {
+		return mode == modeSOnlyInclude
+	}
+
+	return distance < getRadius()
+}
+
+// A rough distance from the receiver in km for an aircraft without a
+// position, from readsb's r_dst (nm) or its rough rr_lat/rr_lon estimate
+func estimateDistance(aircraft Aircraft) (float64, bool) {
+
+	if aircraft.RDst.Valid {
+		return aircraft.RDst.Float64 * nauticalMilesToKm, true
+	}
+
+	if aircraft.RrLat.Valid && aircraft.RrLon.Valid {
+		return *getDistance([]float64{aircraft.RrLon.Float64, aircraft.RrLat.Float64}), true
+	}
+
+	return 0, false
+}
+
+// The distance to store against a sighting, NULL if it can't be worked out
+func sightingDistance(aircraft Aircraft) sql.NullFloat64 {
+
+	if aircraft.HasPosition() {
+		return validFloat(*getDistance([]float64{aircraft.Lon.Float64, aircraft.Lat.Float64}))
+	}
+
+	if distance, ok := estimateDistance(aircraft); ok {
+		return validFloat(math.Round(distance*100) / 100)
+	}
+
+	return sql.NullFloat64{}
+}
+
+// The lat or lon to store against a sighting, NULL unless both were reported
+func sightingCoordinate(aircraft Aircraft, coordinate sql.NullFloat64) sql.NullFloat64 {
+	if !aircraft.HasPosition() {
+		return sql.NullFloat64{}
+	}
+	return coordinate
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// A point on an aircraft's track, as stored in aircraft_positions
+type trackPoint struct {
+	time    time.Time
+	lat     float64
+	lon     float64
+	altBaro sql.NullInt64
+	altGeom sql.NullInt64
+	gs      sql.NullFloat64
+	track   sql.NullFloat64
+	source  string
+}
+
+// The last point recorded for each session, used for thinning
+var recordedPositions = struct {
+	mu     sync.Mutex
+	points map[int]trackPoint
+}{points: make(map[int]trackPoint)}
+
+// Records the position of each aircraft against its aircraft_data session.
+// Points are thinned so that consecutive points are at least
+// POSITION_MIN_INTERVAL seconds and POSITION_MIN_DISTANCE metres apart, and
+// positions that haven't changed since the last point are skipped.
+func recordPositions(ctx context.Context, pg *postgres, nowEpoch float64, aircrafts []Aircraft, sessionIds map[string]int) error {
+
+	var positions []int
+	var points []trackPoint
+
+	recordedPositions.mu.Lock()
+
+	for _, aircraft := range aircrafts {
+
+		id, ok := sessionIds[aircraft.Hex]
+		if !ok || !aircraft.HasPosition() {
+			continue
+		}
+
+		point := trackPoint{
+			time:    time.UnixMilli(int64((nowEpoch - aircraft.SeenPos) * 1000)),
+			lat:     aircraft.Lat.Float64,
+			lon:     aircraft.Lon.Float64,
+			altBaro: aircraft.AltBaro,
+			altGeom: aircraft.AltGeom,
+			gs:      aircraft.Gs,
+			track:   aircraft.Track,
+			source:  aircraft.Type,
+		}
+
+		if last, ok := recordedPositions.points[id]; ok && !isNextTrackPoint(last, point) {
+			continue
+		}
+
+		recordedPositions.points[id] = point
+		positions = append(positions, id)
+		points = append(points, point)
+	}
+
+	// Forget sessions that have ended
+	for id, point := range recordedPositions.points {
+		if nowEpoch-float64(point.time.Unix()) > sessionGapSeconds {
+			delete(recordedPositions.points, id)
+		}
+	}
+
+	recordedPositions.mu.Unlock()
+
+	return insertPositions(ctx, pg, positions, points)
+}
+
+func isNextTrackPoint(last trackPoint, point trackPoint) bool {
+
+	if point.lat == last.lat && point.lon == last.lon {
+		return false
+	}
+
+	if point.time.Sub(last.time).Seconds() < getPositionMinInterval() {
+		return false
+	}
+
+	if minDistance := getPositionMinDistance(); minDistance > 0 {
+		distance := getRuler().Distance([]float64{last.lon, last.lat}, []float64{point.lon, point.lat})
+		if distance*1000 < minDistance {
+			return false
+		}
+	}
+
+	return true
+}
+
+func insertPositions(ctx context.Context, pg *postgres, aircraftIds []int, points []trackPoint) error {
+	return copyPositions(ctx, pg.db, aircraftIds, points)
+}
+
+// The pool, or a transaction when the positions have to go in with the
+// sessions they belong to
+type positionCopier interface {
+	CopyFrom(ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource) (int64, error)
+}
+
+func copyPositions(ctx context.Context, db positionCopier, aircraftIds []int, points []trackPoint) error {
+
+	if len(points) == 0 {
+		return nil
+	}
+
+	rows := make([][]any, 0, len(points))
+	for i, point := range points {
+		rows = append(rows, []any{
+			aircraftIds[i],
+			point.time,
+			point.lat,
+			point.lon,
+			point.altBaro,
+			point.altGeom,
+			point.gs,
+			point.track,
+			point.source,
+		})
+	}
+
+	_, err := db.CopyFrom(
+		ctx,
+		pgx.Identifier{"aircraft_positions"},
+		[]string{"aircraft_id", "time", "lat", "lon", "alt_baro", "alt_geom", "gs", "track", "source"},
+		pgx.CopyFromRows(rows))
+
+	return err
+}
+
+func getSessionTrack(ctx context.Context, pg *postgres, aircraftId int) ([]trackPoint, error) {
+
+	query := `
+		SELECT time, lat, lon, alt_baro, alt_geom, gs, track, COALESCE(source, '')
+		FROM aircraft_positions
+		WHERE aircraft_id = $1
+		ORDER BY time ASC`
+
+	rows, err := pg.db.Query(ctx, query, aircraftId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []trackPoint
+	for rows.Next() {
+		var point trackPoint
+		err := rows.Scan(
+			&point.time,
+			&point.lat,
+			&point.lon,
+			&point.altBaro,
+			&point.altGeom,
+			&point.gs,
+			&point.track,
+			&point.source)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+	}
+
+	return points, rows.Err()
+}
+
+func getPositionMinInterval() float64 {
+	return config.Positions.MinInterval
+}
+
+func getPositionMinDistance() float64 {
+	return config.Positions.MinDistance
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	beastEscape       = 0x1a
+	beastClockHz      = 12_000_000
+	beastRssiSamples  = 8
+	cprPairMaxAge     = 10 * time.Second
+	cprLocalMaxAge    = 10 * time.Minute
+	cprReceiverMaxKm  = 333.0
+	cprMaxSpeedKmPerS = 1.0
+)
+
+// BeastSource keeps an in-memory picture of the aircraft being received on a
+// readsb / dump1090 Beast binary output, usually port 30005.
+type BeastSource struct {
+	addr     string
+	mu       sync.Mutex
+	aircraft map[string]*beastAircraft
+	messages int
+
+	// Receiver clock of the most recent frame, and when it arrived
+	lastTimestamp uint64
+	lastReceived  time.Time
+}
+
+type beastAircraft struct {
+	Aircraft
+	lastSeen      time.Time
+	lastSeenPos   time.Time
+	lastTimestamp uint64
+	rssi          []float64
+	cprEven       *cprFrame
+	cprEvenTime   time.Time
+	cprOdd        *cprFrame
+	cprOddTime    time.Time
+}
+
+type beastFrame struct {
+	timestamp uint64
+	signal    byte
+	message   []byte
+}
+
+func NewBeastSource(addr string) *BeastSource {
+	return &BeastSource{
+		addr:     addr,
+		aircraft: make(map[string]*beastAircraft),
+	}
+}
+
+func (s *BeastSource) Run(ctx context.Context) {
+	runStream(ctx, "Beast", s.addr, s.consume)
+}
+
+func (s *BeastSource) consume(conn net.Conn) error {
+
+	reader := bufio.NewReader(conn)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(streamReadTimeout))
+
+		frame, err := readBeastFrame(reader)
+		if err == io.EOF {
+			return fmt.Errorf("connection closed by remote")
+		}
+		if err != nil {
+			return err
+		}
+
+		s.handleFrame(frame, time.Now())
+	}
+}
+
+// Reads the next Mode S frame from a Beast stream. Frames are
+//
+//	<1a> <type> <6 byte 12MHz timestamp> <1 byte signal> <message>
+//
+// with any 1a inside the frame doubled up. Mode A/C and status frames are
+// skipped, and a lone 1a part way through a frame resyncs on the next frame.
+func readBeastFrame(r *bufio.Reader) (*beastFrame, error) {
+
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != beastEscape {
+			continue
+		}
+
+		frameType, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		var messageLength int
+		switch frameType {
+		case '2':
+			messageLength = modesShortLength
+		case '3':
+			messageLength = modesLongLength
+		default:
+			continue
+		}
+
+		body, err := readBeastBytes(r, 7+messageLength)
+		if err != nil {
+			return nil, err
+		}
+		if body == nil {
+			continue
+		}
+
+		var timestamp uint64
+		for _, b := range body[:6] {
+			timestamp = timestamp<<8 | uint64(b)
+		}
+
+		return &beastFrame{
+			timestamp: timestamp,
+			signal:    body[6],
+			message:   body[7:],
+		}, nil
+	}
+}
+
+// Reads n unescaped bytes. Returns nil (without consuming the escape) if a
+// new frame starts before n bytes have been read.
+func readBeastBytes(r *bufio.Reader, n int) ([]byte, error) {
+
+	buf := make([]byte, 0, n)
+
+	for len(buf) < n {
+		peek, err := r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+
+		if peek[0] == beastEscape {
+			pair, err := r.Peek(2)
+			if err != nil {
+				return nil, err
+			}
+			if pair[1] != beastEscape {
+				return nil, nil
+			}
+			r.Discard(1)
+		}
+
+		b, _ := r.ReadByte()
+		buf = append(buf, b)
+	}
+
+	return buf, nil
+}
+
+func (s *BeastSource) handleFrame(frame *beastFrame, now time.Time) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	isKnown := func(hex string) bool {
+		_, ok := s.aircraft[hex]
+		return ok
+	}
+
+	m, err := decodeModeS(frame.message, isKnown)
+	if err != nil {
+		return
+	}
+
+	aircraft, exists := s.aircraft[m.hex]
+	if !exists {
+		aircraft = &beastAircraft{Aircraft: Aircraft{Hex: m.hex, Type: m.addrType}}
+		s.aircraft[m.hex] = aircraft
+	}
+
+	applyModeSMessage(aircraft, m, now)
+
+	aircraft.rssi = append(aircraft.rssi, beastRssi(frame.signal))
+	if len(aircraft.rssi) > beastRssiSamples {
+		aircraft.rssi = aircraft.rssi[1:]
+	}
+
+	aircraft.Messages++
+	aircraft.lastSeen = now
+	aircraft.lastTimestamp = frame.timestamp
+
+	s.messages++
+	s.lastTimestamp = frame.timestamp
+	s.lastReceived = now
+}
+
+func applyModeSMessage(aircraft *beastAircraft, m *modesMessage, now time.Time) {
+
+	// Upgrade the source type once extended squitters are heard
+	if m.df == 17 || m.df == 18 {
+		aircraft.Type = m.addrType
+	}
+
+	if m.callsign != "" {
+		aircraft.Flight = m.callsign
+	}
+	if m.category != "" {
+		aircraft.Category = m.category
+	}
+	if m.altBaro != nil {
+		aircraft.AltBaro = validInt(*m.altBaro)
+	}
+	if m.altGeom != nil {
+		aircraft.AltGeom = validInt(*m.altGeom)
+	}
+	if m.squawk != "" {
+		aircraft.Squawk = m.squawk
+	}
+	if m.gs != nil {
+		aircraft.Gs = validFloat(*m.gs)
+	}
+	if m.track != nil {
+		aircraft.Track = validFloat(*m.track)
+	}
+	if m.ias != nil {
+		aircraft.Ias = validInt(*m.ias)
+	}
+	if m.tas != nil {
+		aircraft.Tas = validInt(*m.tas)
+	}
+	if m.heading != nil {
+		aircraft.NavHeading = validFloat(*m.heading)
+	}
+	if m.baroRate != nil {
+		aircraft.BaroRate = validInt(*m.baroRate)
+	}
+
+	if m.cpr != nil {
+		updatePosition(aircraft, *m.cpr, now)
+	}
+}
+
+// Resolves a CPR frame into a position. A recent even/odd pair is decoded
+// globally, otherwise the frame is decoded locally against the aircraft's
+// last position, or the receiver location for a first fix.
+func updatePosition(aircraft *beastAircraft, frame cprFrame, now time.Time) {
+
+	if frame.odd {
+		aircraft.cprOdd, aircraft.cprOddTime = &frame, now
+	} else {
+		aircraft.cprEven, aircraft.cprEvenTime = &frame, now
+	}
+
+	var lat, lon float64
+	var ok bool
+
+	if aircraft.cprEven != nil && aircraft.cprOdd != nil &&
+		aircraft.cprEvenTime.Sub(aircraft.cprOddTime).Abs() <= cprPairMaxAge {
+		lat, lon, ok = cprGlobalDecode(*aircraft.cprEven, *aircraft.cprOdd, frame.odd)
+	}
+
+	hasRecentPosition := !aircraft.lastSeenPos.IsZero() && now.Sub(aircraft.lastSeenPos) <= cprLocalMaxAge
+
+	if ok && hasRecentPosition {
+		// Reject global decodes that would need an impossible speed
+		elapsed := math.Max(now.Sub(aircraft.lastSeenPos).Seconds(), 1)
+		ruler := getRuler()
+		if ruler != nil && ruler.Distance([]float64{aircraft.Lon.Float64, aircraft.Lat.Float64}, []float64{lon, lat}) > elapsed*cprMaxSpeedKmPerS {
+			ok = false
+		}
+	}
+
+	if !ok && hasRecentPosition {
+		lat, lon = cprLocalDecode(frame, aircraft.Lat.Float64, aircraft.Lon.Float64)
+		ok = true
+	}
+
+	if !ok {
+		lat, lon = cprLocalDecode(frame, getLat(), getLon())
+		ok = *getDistance([]float64{lon, lat}) <= cprReceiverMaxKm
+	}
+
+	if !ok || lat < -90 || lat > 90 {
+		return
+	}
+
+	aircraft.Lat = validFloat(math.Round(lat*1e6) / 1e6)
+	aircraft.Lon = validFloat(math.Round(lon*1e6) / 1e6)
+	aircraft.lastSeenPos = now
+}
+
+// Converts the Beast signal byte into dBFS, as readsb does
+func beastRssi(signal byte) float64 {
+
+	level := math.Pow(float64(signal)/255, 2)
+	if level < 1e-5 {
+		return -49.5
+	}
+
+	return 10 * math.Log10(level)
+}
+
+// Returns the aircraft heard within the last minute, and forgets the rest.
+// Seen is worked out from the receiver's 12MHz clock where available, so it
+// is not affected by network buffering between readsb and skystats.
+func (s *BeastSource) Snapshot(ctx context.Context) (*Response, error) {
+
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	response := &Response{
+		Now:      float64(now.UnixMilli()) / 1000,
+		Messages: s.messages,
+	}
+
+	for hex, aircraft := range s.aircraft {
+
+		if now.Sub(aircraft.lastSeen) > streamStaleAfter {
+			delete(s.aircraft, hex)
+			continue
+		}
+
+		snapshot := aircraft.Aircraft
+
+		snapshot.Seen = now.Sub(aircraft.lastSeen).Seconds()
+		if aircraft.lastTimestamp != 0 && s.lastTimestamp >= aircraft.lastTimestamp {
+			sinceLastFrame := now.Sub(s.lastReceived).Seconds()
+			snapshot.Seen = sinceLastFrame + float64(s.lastTimestamp-aircraft.lastTimestamp)/beastClockHz
+		}
+		snapshot.Seen = math.Round(snapshot.Seen*10) / 10
+
+		if !aircraft.lastSeenPos.IsZero() {
+			snapshot.SeenPos = math.Round(now.Sub(aircraft.lastSeenPos).Seconds()*10) / 10
+		}
+
+		if len(aircraft.rssi) > 0 {
+			var total float64
+			for _, rssi := range aircraft.rssi {
+				total += rssi
+			}
+			snapshot.Rssi = math.Round(total/float64(len(aircraft.rssi))*10) / 10
+		}
+
+		response.Aircraft = append(response.Aircraft, snapshot)
+	}
+
+	return response, nil
+}
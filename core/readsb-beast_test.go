@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+// Escapes a frame body as it is sent on the wire, doubling every 1a
+func beastEscapeBytes(body []byte) []byte {
+	return bytes.ReplaceAll(body, []byte{beastEscape}, []byte{beastEscape, beastEscape})
+}
+
+func beastFrameBytes(frameType byte, timestamp []byte, signal byte, message []byte) []byte {
+	body := append(append(append([]byte{}, timestamp...), signal), message...)
+	return append([]byte{beastEscape, frameType}, beastEscapeBytes(body)...)
+}
+
+func TestReadBeastFrame(t *testing.T) {
+
+	identification := decodeHexMessage(t, "8D4840D6202CC371C32CE0576098")
+	// Not a valid message, but every other byte needs escaping
+	escaped := []byte{0x5d, 0x1a, 0x2b, 0x1a, 0x1a, 0x3c, 0x1a}
+
+	var stream bytes.Buffer
+
+	// Noise before the first frame
+	stream.Write([]byte{0x00, 0xff, 0x42})
+
+	// A Mode S long frame, with 1a in the timestamp and signal
+	stream.Write(beastFrameBytes('3', []byte{0x00, 0x00, 0x1a, 0x00, 0x00, 0x01}, 0x1a, identification))
+
+	// Mode A/C and status frames are skipped
+	stream.Write(beastFrameBytes('1', []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x02}, 0x40, []byte{0x12, 0x34}))
+	stream.Write(beastFrameBytes('4', []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x03}, 0x00, []byte{0x00, 0x00}))
+
+	// A frame cut short by the start of the next
+	stream.Write([]byte{beastEscape, '3', 0x00, 0x00, 0x00})
+
+	// A Mode S short frame full of 1a
+	stream.Write(beastFrameBytes('2', []byte{0x1a, 0x1a, 0x00, 0x00, 0x00, 0x04}, 0x80, escaped))
+
+	reader := bufio.NewReader(&stream)
+
+	frame, err := readBeastFrame(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.timestamp != 0x00001a000001 || frame.signal != 0x1a || !bytes.Equal(frame.message, identification) {
+		t.Errorf("first frame = %x %x %x, want 1a000001 1a %x", frame.timestamp, frame.signal, frame.message, identification)
+	}
+
+	frame, err = readBeastFrame(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.timestamp != 0x1a1a00000004 || frame.signal != 0x80 || !bytes.Equal(frame.message, escaped) {
+		t.Errorf("second frame = %x %x %x, want 1a1a00000004 80 %x", frame.timestamp, frame.signal, frame.message, escaped)
+	}
+
+	if _, err := readBeastFrame(reader); err != io.EOF {
+		t.Errorf("after the last frame got %v, want EOF", err)
+	}
+}
+
+func TestBeastSourceHandleFrame(t *testing.T) {
+
+	source := NewBeastSource("")
+	now := time.Now()
+
+	for _, message := range []string{
+		"8D4840D6202CC371C32CE0576098",
+		// CRC failures are dropped
+		"8D4840D6202CC371C32CE0576099",
+		// DF5 from an address that hasn't been heard yet
+		"2A00516D492B80",
+	} {
+		source.handleFrame(&beastFrame{timestamp: 1, signal: 0x80, message: decodeHexMessage(t, message)}, now)
+	}
+
+	response, err := source.Snapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Aircraft) != 1 || response.Messages != 1 {
+		t.Fatalf("got %d aircraft from %d messages, want 1 from 1", len(response.Aircraft), response.Messages)
+	}
+
+	aircraft := response.Aircraft[0]
+	if aircraft.Hex != "4840d6" || aircraft.Flight != "KLM1023 " || aircraft.Category != "A0" || aircraft.Type != "adsb_icao" {
+		t.Errorf("aircraft = %s %q %s %s, want 4840d6 \"KLM1023 \" A0 adsb_icao", aircraft.Hex, aircraft.Flight, aircraft.Category, aircraft.Type)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// readsb leaves out anything it doesn't currently know, and uses "ground" in
+// place of alt_baro for aircraft on the ground, so aircraft.json is decoded a
+// field at a time. A field that can't be decoded is left NULL and counted,
+// rather than spoiling the rest of the aircraft or the whole snapshot.
+
+type rawResponse struct {
+	Now      float64           `json:"now"`
+	Messages int               `json:"messages"`
+	Aircraft []json.RawMessage `json:"aircraft"`
+}
+
+// Running totals of fields that failed to decode, by field name
+var decodeFailures = struct {
+	mu     sync.Mutex
+	counts map[string]int
+}{counts: make(map[string]int)}
+
+func parseResponse(data []byte) (*Response, error) {
+
+	var raw rawResponse
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid aircraft.json: %w", err)
+	}
+
+	response := &Response{
+		Now:      raw.Now,
+		Messages: raw.Messages,
+		Aircraft: make([]Aircraft, 0, len(raw.Aircraft)),
+	}
+
+	failures := make(map[string]int)
+
+	for _, data := range raw.Aircraft {
+		aircraft, ok := decodeAircraft(data, failures)
+		if ok {
+			response.Aircraft = append(response.Aircraft, aircraft)
+		}
+	}
+
+	if len(failures) > 0 {
+		logDecodeFailures(failures)
+	}
+
+	return response, nil
+}
+
+// Any json.Unmarshal of an Aircraft gets the same tolerant decoding
+func (a *Aircraft) UnmarshalJSON(data []byte) error {
+	aircraft, ok := decodeAircraft(data, make(map[string]int))
+	if !ok {
+		return fmt.Errorf("aircraft is not a json object")
+	}
+	*a = aircraft
+	return nil
+}
+
+type aircraftDecoder struct {
+	fields   map[string]json.RawMessage
+	failures map[string]int
+}
+
+func decodeAircraft(data []byte, failures map[string]int) (Aircraft, bool) {
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		failures["aircraft"]++
+		return Aircraft{}, false
+	}
+
+	d := aircraftDecoder{fields: fields, failures: failures}
+	return d.aircraft(), true
+}
+
+func (d *aircraftDecoder) aircraft() Aircraft {
+
+	var a Aircraft
+
+	d.stringField("hex", &a.Hex)
+	d.stringField("type", &a.Type)
+	d.stringField("flight", &a.Flight)
+	d.stringField("r", &a.R)
+	d.stringField("t", &a.T)
+	d.stringField("squawk", &a.Squawk)
+	d.stringField("category", &a.Category)
+	d.stringField("sil_type", &a.SilType)
+
+	if d.isString("alt_baro", "ground") {
+		a.OnGround = true
+	} else {
+		d.nullIntField("alt_baro", &a.AltBaro)
+	}
+	d.nullIntField("alt_geom", &a.AltGeom)
+	d.nullFloatField("gs", &a.Gs)
+	d.nullIntField("ias", &a.Ias)
+	d.nullIntField("tas", &a.Tas)
+	d.nullFloatField("track", &a.Track)
+	d.nullIntField("baro_rate", &a.BaroRate)
+	d.nullFloatField("nav_qnh", &a.NavQnh)
+	d.nullIntField("nav_altitude_mcp", &a.NavAltitudeMcp)
+	d.nullFloatField("nav_heading", &a.NavHeading)
+	d.nullFloatField("r_dst", &a.RDst)
+	d.nullFloatField("r_dir", &a.RDir)
+	d.nullIntField("nic", &a.Nic)
+	d.nullIntField("rc", &a.Rc)
+	d.nullIntField("version", &a.Version)
+	d.nullIntField("nic_baro", &a.NicBaro)
+	d.nullIntField("nac_p", &a.NacP)
+	d.nullIntField("nac_v", &a.NacV)
+	d.nullIntField("sil", &a.Sil)
+
+	d.nullFloatField("mach", &a.Mach)
+	d.nullFloatField("roll", &a.Roll)
+	d.nullFloatField("mag_heading", &a.MagHeading)
+	d.nullFloatField("true_heading", &a.TrueHeading)
+	d.nullFloatField("track_rate", &a.TrackRate)
+	d.nullIntField("geom_rate", &a.GeomRate)
+	d.stringField("emergency", &a.Emergency)
+	d.stringListField("nav_modes", &a.NavModes)
+	d.nullIntField("nav_altitude_fms", &a.NavAltitudeFms)
+	d.nullIntField("gva", &a.Gva)
+	d.nullIntField("sda", &a.Sda)
+	d.nullIntField("oat", &a.Oat)
+	d.nullIntField("tat", &a.Tat)
+	d.nullIntField("wd", &a.Wd)
+	d.nullIntField("ws", &a.Ws)
+	d.nullFloatField("rr_lat", &a.RrLat)
+	d.nullFloatField("rr_lon", &a.RrLon)
+
+	if lastPosition, ok := d.fields["lastPosition"]; ok {
+		p := aircraftDecoder{fields: make(map[string]json.RawMessage), failures: make(map[string]int)}
+		if string(lastPosition) != "null" && json.Unmarshal(lastPosition, &p.fields) != nil {
+			d.failures["lastPosition"]++
+		}
+		p.nullFloatField("lat", &a.LastPosition.Lat)
+		p.nullFloatField("lon", &a.LastPosition.Lon)
+		p.nullIntField("nic", &a.LastPosition.Nic)
+		p.nullIntField("rc", &a.LastPosition.Rc)
+		p.nullFloatField("seen_pos", &a.LastPosition.SeenPos)
+		for key, count := range p.failures {
+			d.failures["lastPosition."+key] += count
+		}
+	}
+
+	d.nullFloatField("lat", &a.Lat)
+	d.nullFloatField("lon", &a.Lon)
+	d.floatField("seen_pos", &a.SeenPos)
+	d.floatField("seen", &a.Seen)
+	d.floatField("rssi", &a.Rssi)
+	d.intField("alert", &a.Alert)
+	d.intField("spi", &a.Spi)
+	d.intField("messages", &a.Messages)
+	d.intField("dbFlags", &a.DbFlags)
+	d.listField("mlat", &a.Mlat)
+	d.listField("tisb", &a.Tisb)
+
+	return a
+}
+
+// Decodes a field into dst, returning false if it is missing, null or could
+// not be decoded
+func (d *aircraftDecoder) decode(key string, dst any) bool {
+
+	raw, ok := d.fields[key]
+	if !ok || string(raw) == "null" {
+		return false
+	}
+
+	if err := json.Unmarshal(raw, dst); err != nil {
+		d.failures[key]++
+		return false
+	}
+
+	return true
+}
+
+func (d *aircraftDecoder) isString(key string, value string) bool {
+	var s string
+	raw, ok := d.fields[key]
+	return ok && json.Unmarshal(raw, &s) == nil && s == value
+}
+
+func (d *aircraftDecoder) stringField(key string, dst *string) {
+	d.decode(key, dst)
+}
+
+func (d *aircraftDecoder) floatField(key string, dst *float64) {
+	d.decode(key, dst)
+}
+
+// Integers are read as floats, as readsb is not always consistent about
+// writing whole numbers
+func (d *aircraftDecoder) intField(key string, dst *int) {
+	var value float64
+	if d.decode(key, &value) {
+		*dst = int(value)
+	}
+}
+
+func (d *aircraftDecoder) nullIntField(key string, dst *sql.NullInt64) {
+	var value float64
+	if d.decode(key, &value) {
+		*dst = sql.NullInt64{Int64: int64(value), Valid: true}
+	}
+}
+
+func (d *aircraftDecoder) nullFloatField(key string, dst *sql.NullFloat64) {
+	var value float64
+	if d.decode(key, &value) {
+		*dst = sql.NullFloat64{Float64: value, Valid: true}
+	}
+}
+
+func (d *aircraftDecoder) stringListField(key string, dst *[]string) {
+	d.decode(key, dst)
+}
+
+func (d *aircraftDecoder) listField(key string, dst *[]any) {
+	d.decode(key, dst)
+}
+
+func logDecodeFailures(failures map[string]int) {
+
+	decodeFailures.mu.Lock()
+	defer decodeFailures.mu.Unlock()
+
+	keys := make([]string, 0, len(failures))
+	for key, count := range failures {
+		decodeFailures.counts[key] += count
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var summary []string
+	for _, key := range keys {
+		summary = append(summary, fmt.Sprintf("%s=%d (total %d)", key, failures[key], decodeFailures.counts[key]))
+	}
+
+	ingestLog.Warn("Unable to decode fields, stored as NULL", "fields", strings.Join(summary, ", "))
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SBS-1 (BaseStation) field positions
+const (
+	sbsFieldMessageType      = 0
+	sbsFieldTransmissionType = 1
+	sbsFieldHex              = 4
+	sbsFieldCallsign         = 10
+	sbsFieldAltitude         = 11
+	sbsFieldGroundSpeed      = 12
+	sbsFieldTrack            = 13
+	sbsFieldLat              = 14
+	sbsFieldLon              = 15
+	sbsFieldVerticalRate     = 16
+	sbsFieldSquawk           = 17
+	sbsFieldAlert            = 18
+	sbsFieldEmergency        = 19
+	sbsFieldSpi              = 20
+	sbsFieldIsOnGround       = 21
+)
+
+// SBSSource keeps an in-memory picture of the aircraft being received on a
+// readsb / dump1090 SBS-1 (BaseStation) output, usually port 30003.
+type SBSSource struct {
+	addr     string
+	mu       sync.Mutex
+	aircraft map[string]*sbsAircraft
+	messages int
+}
+
+type sbsAircraft struct {
+	Aircraft
+	lastSeen    time.Time
+	lastSeenPos time.Time
+}
+
+func NewSBSSource(addr string) *SBSSource {
+	return &SBSSource{
+		addr:     addr,
+		aircraft: make(map[string]*sbsAircraft),
+	}
+}
+
+func (s *SBSSource) Run(ctx context.Context) {
+	runStream(ctx, "SBS", s.addr, s.consume)
+}
+
+func (s *SBSSource) consume(conn net.Conn) error {
+
+	scanner := bufio.NewScanner(conn)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(streamReadTimeout))
+		if !scanner.Scan() {
+			break
+		}
+		s.handleLine(scanner.Text(), time.Now())
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("connection closed by remote")
+}
+
+func (s *SBSSource) handleLine(line string, now time.Time) {
+
+	fields := strings.Split(strings.TrimSpace(line), ",")
+
+	if len(fields) <= sbsFieldCallsign || fields[sbsFieldMessageType] != "MSG" {
+		return
+	}
+
+	transmissionType, err := strconv.Atoi(fields[sbsFieldTransmissionType])
+	if err != nil || transmissionType < 1 || transmissionType > 8 {
+		return
+	}
+
+	hex := strings.ToLower(strings.TrimSpace(fields[sbsFieldHex]))
+	if hex == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	aircraft, exists := s.aircraft[hex]
+	if !exists {
+		aircraft = &sbsAircraft{Aircraft: Aircraft{Hex: hex}}
+		s.aircraft[hex] = aircraft
+	}
+
+	applySBSMessage(aircraft, fields, now)
+	s.messages++
+}
+
+// Every message type (1-8) carries a subset of the fields below, and the
+// rest are left empty, so any field that is present is applied.
+func applySBSMessage(aircraft *sbsAircraft, fields []string, now time.Time) {
+
+	field := func(i int) string {
+		if i < len(fields) {
+			return strings.TrimSpace(fields[i])
+		}
+		return ""
+	}
+
+	if callsign := field(sbsFieldCallsign); callsign != "" {
+		aircraft.Flight = callsign
+	}
+
+	if altitude, err := strconv.Atoi(field(sbsFieldAltitude)); err == nil {
+		aircraft.AltBaro = validInt(altitude)
+	}
+
+	if gs, err := strconv.ParseFloat(field(sbsFieldGroundSpeed), 64); err == nil {
+		aircraft.Gs = validFloat(gs)
+	}
+
+	if track, err := strconv.ParseFloat(field(sbsFieldTrack), 64); err == nil {
+		aircraft.Track = validFloat(track)
+	}
+
+	lat, latErr := strconv.ParseFloat(field(sbsFieldLat), 64)
+	lon, lonErr := strconv.ParseFloat(field(sbsFieldLon), 64)
+	if latErr == nil && lonErr == nil {
+		aircraft.Lat = validFloat(lat)
+		aircraft.Lon = validFloat(lon)
+		aircraft.lastSeenPos = now
+	}
+
+	if verticalRate, err := strconv.Atoi(field(sbsFieldVerticalRate)); err == nil {
+		aircraft.BaroRate = validInt(verticalRate)
+	}
+
+	if squawk := field(sbsFieldSquawk); squawk != "" {
+		aircraft.Squawk = squawk
+	}
+
+	if alert := field(sbsFieldAlert); alert != "" {
+		aircraft.Alert = sbsFlag(alert)
+	}
+
+	if spi := field(sbsFieldSpi); spi != "" {
+		aircraft.Spi = sbsFlag(spi)
+	}
+
+	if onGround := field(sbsFieldIsOnGround); onGround != "" {
+		aircraft.OnGround = sbsFlag(onGround) == 1
+	}
+
+	aircraft.Messages++
+	aircraft.lastSeen = now
+}
+
+// BaseStation flags are "-1" for true and "0" for false, some feeders use "1"
+func sbsFlag(value string) int {
+	if value == "-1" || value == "1" {
+		return 1
+	}
+	return 0
+}
+
+// Returns the aircraft heard within the last minute, and forgets the rest
+func (s *SBSSource) Snapshot(ctx context.Context) (*Response, error) {
+
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	response := &Response{
+		Now:      float64(now.UnixMilli()) / 1000,
+		Messages: s.messages,
+	}
+
+	for hex, aircraft := range s.aircraft {
+
+		if now.Sub(aircraft.lastSeen) > streamStaleAfter {
+			delete(s.aircraft, hex)
+			continue
+		}
+
+		snapshot := aircraft.Aircraft
+		snapshot.Seen = now.Sub(aircraft.lastSeen).Seconds()
+		if !aircraft.lastSeenPos.IsZero() {
+			snapshot.SeenPos = now.Sub(aircraft.lastSeenPos).Seconds()
+		}
+
+		response.Aircraft = append(response.Aircraft, snapshot)
+	}
+
+	return response, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A BaseStation line of the given transmission type, with the fields that
+// type carries set and the rest left empty
+func sbsLine(transmissionType int, hex string, values map[int]string) string {
+
+	fields := make([]string, sbsFieldIsOnGround+1)
+	fields[sbsFieldMessageType] = "MSG"
+	fields[sbsFieldTransmissionType] = fmt.Sprint(transmissionType)
+	fields[2] = "1"
+	fields[3] = "1"
+	fields[sbsFieldHex] = hex
+	fields[5] = "1"
+	fields[6], fields[7] = "2024/06/01", "12:00:00.000"
+	fields[8], fields[9] = "2024/06/01", "12:00:00.000"
+
+	for i, value := range values {
+		fields[i] = value
+	}
+
+	return strings.Join(fields, ",") + "\r\n"
+}
+
+// MSG 1-8 for one aircraft, ending airborne, plus lines that are ignored
+var sbsTestLines = []string{
+	sbsLine(1, "4CA1B2", map[int]string{sbsFieldCallsign: "BAW123  "}),
+	sbsLine(2, "4CA1B2", map[int]string{sbsFieldAltitude: "0", sbsFieldGroundSpeed: "12", sbsFieldTrack: "90", sbsFieldLat: "51.47", sbsFieldLon: "-0.45", sbsFieldIsOnGround: "-1"}),
+	sbsLine(3, "4CA1B2", map[int]string{sbsFieldAltitude: "35000", sbsFieldLat: "51.5123", sbsFieldLon: "-0.1234", sbsFieldAlert: "0", sbsFieldEmergency: "0", sbsFieldSpi: "0", sbsFieldIsOnGround: "0"}),
+	sbsLine(4, "4CA1B2", map[int]string{sbsFieldGroundSpeed: "451.5", sbsFieldTrack: "270.3", sbsFieldVerticalRate: "-64"}),
+	sbsLine(5, "4CA1B2", map[int]string{sbsFieldAltitude: "35025", sbsFieldAlert: "0", sbsFieldSpi: "0", sbsFieldIsOnGround: "0"}),
+	sbsLine(6, "4CA1B2", map[int]string{sbsFieldAltitude: "35050", sbsFieldSquawk: "1234", sbsFieldAlert: "-1", sbsFieldEmergency: "0", sbsFieldSpi: "-1", sbsFieldIsOnGround: "0"}),
+	sbsLine(7, "4CA1B2", map[int]string{sbsFieldAltitude: "36000", sbsFieldIsOnGround: "0"}),
+	sbsLine(8, "4CA1B2", map[int]string{sbsFieldIsOnGround: "0"}),
+	sbsLine(9, "4CA1B2", map[int]string{sbsFieldAltitude: "1"}),
+	"STA,,5,179,400AE7,10103,2024/06/01,12:00:00.000,2024/06/01,12:00:00.000,RM\r\n",
+	sbsLine(3, "", map[int]string{sbsFieldAltitude: "1000"}),
+}
+
+// Serves each connection's lines from a local listener, closing the
+// connection and the listener once they are written
+func serveSBS(t *testing.T, addr string, lines []string) net.Listener {
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		for _, line := range lines {
+			conn.Write([]byte(line))
+		}
+		// Give the source time to read them before the connection drops
+		time.Sleep(200 * time.Millisecond)
+		conn.Close()
+		listener.Close()
+	}()
+
+	return listener
+}
+
+// Polls the source until check passes on the only aircraft, or times out
+func waitForSBSAircraft(t *testing.T, source *SBSSource, check func(aircraft Aircraft) bool) Aircraft {
+
+	deadline := time.Now().Add(10 * time.Second)
+
+	for {
+		response, err := source.Snapshot(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Aircraft) == 1 && check(response.Aircraft[0]) {
+			return response.Aircraft[0]
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the aircraft, last snapshot: %+v", response.Aircraft)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestSBSSource(t *testing.T) {
+
+	listener := serveSBS(t, "127.0.0.1:0", sbsTestLines)
+	addr := listener.Addr().String()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source := NewSBSSource(addr)
+	stopped := make(chan struct{})
+	go func() {
+		source.Run(ctx)
+		close(stopped)
+	}()
+
+	aircraft := waitForSBSAircraft(t, source, func(aircraft Aircraft) bool {
+		return aircraft.Messages == 8
+	})
+
+	if aircraft.Hex != "4ca1b2" {
+		t.Errorf("hex = %q, want 4ca1b2", aircraft.Hex)
+	}
+	if aircraft.Flight != "BAW123" {
+		t.Errorf("flight = %q, want BAW123", aircraft.Flight)
+	}
+	if !aircraft.AltBaro.Valid || aircraft.AltBaro.Int64 != 36000 {
+		t.Errorf("alt_baro = %v, want 36000", aircraft.AltBaro)
+	}
+	if !aircraft.Gs.Valid || aircraft.Gs.Float64 != 451.5 {
+		t.Errorf("gs = %v, want 451.5", aircraft.Gs)
+	}
+	if !aircraft.Track.Valid || aircraft.Track.Float64 != 270.3 {
+		t.Errorf("track = %v, want 270.3", aircraft.Track)
+	}
+	if aircraft.Lat != validFloat(51.5123) || aircraft.Lon != validFloat(-0.1234) {
+		t.Errorf("position = %v, %v, want 51.5123, -0.1234", aircraft.Lat, aircraft.Lon)
+	}
+	if !aircraft.BaroRate.Valid || aircraft.BaroRate.Int64 != -64 {
+		t.Errorf("baro_rate = %v, want -64", aircraft.BaroRate)
+	}
+	if aircraft.Squawk != "1234" {
+		t.Errorf("squawk = %q, want 1234", aircraft.Squawk)
+	}
+	if aircraft.Alert != 1 || aircraft.Spi != 1 {
+		t.Errorf("alert, spi = %d, %d, want 1, 1", aircraft.Alert, aircraft.Spi)
+	}
+	if aircraft.OnGround {
+		t.Errorf("on_ground = true, want false after MSG 3-8")
+	}
+
+	response, _ := source.Snapshot(context.Background())
+	if response.Messages != 8 {
+		t.Errorf("messages = %d, want 8, the other lines aren't messages", response.Messages)
+	}
+
+	// Once the first listener has gone, the source should reconnect to a new
+	// one on the same address and carry on with the same aircraft
+	for {
+		if _, err := net.Dial("tcp", addr); err != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	serveSBS(t, addr, []string{
+		sbsLine(3, "4CA1B2", map[int]string{sbsFieldAltitude: "37000", sbsFieldLat: "51.6", sbsFieldLon: "-0.2", sbsFieldIsOnGround: "0"}),
+	})
+
+	aircraft = waitForSBSAircraft(t, source, func(aircraft Aircraft) bool {
+		return aircraft.Messages == 9
+	})
+
+	if aircraft.Lat != validFloat(51.6) || aircraft.Lon != validFloat(-0.2) {
+		t.Errorf("position after reconnecting = %v, %v, want 51.6, -0.2", aircraft.Lat, aircraft.Lon)
+	}
+	if !aircraft.AltBaro.Valid || aircraft.AltBaro.Int64 != 37000 {
+		t.Errorf("alt_baro after reconnecting = %v, want 37000", aircraft.AltBaro)
+	}
+	if aircraft.Flight != "BAW123" {
+		t.Errorf("flight after reconnecting = %q, want BAW123 kept", aircraft.Flight)
+	}
+
+	// Once cancelled, the source stops instead of waiting out its backoff and
+	// reconnecting
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("source still running after its context was cancelled")
+	}
+}
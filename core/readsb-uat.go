@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// The datalink an aircraft was heard on
+const (
+	datalink1090 = "1090"
+	datalinkUat  = "uat"
+)
+
+// Polls the aircraft.json written by dump978-fa / skyaware978 for UAT
+// (978 MHz) traffic. It is close enough to readsb's to share its decoding,
+// apart from the address type and air/ground state.
+type uatSource struct {
+	url      string
+	station  string
+	recorder *Recorder
+}
+
+func (s *uatSource) Snapshot(ctx context.Context) (*Response, error) {
+
+	responseData, err := Fetch(ctx, s.url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if s.recorder != nil {
+		if err := s.recorder.Record(s.station, recordedUat, responseData); err != nil {
+			ingestLog.Error("Error recording data", "station", s.station, "error", err)
+		}
+	}
+
+	return parseUatResponse(responseData)
+}
+
+func parseUatResponse(data []byte) (*Response, error) {
+
+	var raw rawResponse
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid dump978 aircraft.json: %w", err)
+	}
+
+	response := &Response{
+		Now:      raw.Now,
+		Messages: raw.Messages,
+		Aircraft: make([]Aircraft, 0, len(raw.Aircraft)),
+	}
+
+	failures := make(map[string]int)
+
+	for _, data := range raw.Aircraft {
+
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			failures["aircraft"]++
+			continue
+		}
+
+		d := aircraftDecoder{fields: fields, failures: failures}
+		aircraft := d.aircraft()
+
+		// dump978 writes addr_type where readsb writes type, and keeps
+		// alt_baro numeric with the air/ground state alongside
+		d.stringField("addr_type", &aircraft.Type)
+		aircraft.OnGround = d.isString("airground_state", "ground")
+		if !aircraft.Version.Valid {
+			d.nullIntField("uat_version", &aircraft.Version)
+		}
+
+		aircraft.Datalinks = []string{datalinkUat}
+		response.Aircraft = append(response.Aircraft, aircraft)
+	}
+
+	if len(failures) > 0 {
+		logDecodeFailures(failures)
+	}
+
+	return response, nil
+}
+
+// The datalinks an aircraft was heard on, anything not tagged came in on 1090
+func aircraftDatalinks(aircraft Aircraft) []string {
+	if len(aircraft.Datalinks) == 0 {
+		return []string{datalink1090}
+	}
+	return aircraft.Datalinks
+}
+
+func mergeDatalinks(existing []string, other []string) []string {
+
+	merged := append([]string{}, existing...)
+	for _, datalink := range other {
+		if !containsString(merged, datalink) {
+			merged = append(merged, datalink)
+		}
+	}
+	sort.Strings(merged)
+
+	return merged
+}
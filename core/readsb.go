@@ -1,21 +1,117 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
-	"os"
+	"time"
 )
 
-func Fetch() ([]byte, error) {
+const (
+	streamDialTimeout = 10 * time.Second
+	streamReadTimeout = 60 * time.Second
+	streamStaleAfter  = 60 * time.Second
+	streamMinBackoff  = 1 * time.Second
+	streamMaxBackoff  = 60 * time.Second
 
-	url := os.Getenv("READSB_AIRCRAFT_JSON")
+	// A readsb that accepts the connection but never answers would otherwise
+	// hold up the aircraft job until it is cancelled
+	fetchTimeout = 10 * time.Second
+)
+
+var fetchClient = &http.Client{Timeout: fetchTimeout}
+
+// AircraftSource produces snapshots of the aircraft currently being received,
+// in the same shape as the readsb aircraft.json file. Sources that fetch over
+// the network give up once ctx is done.
+type AircraftSource interface {
+	Snapshot(ctx context.Context) (*Response, error)
+}
 
-	response, err := http.Get(url)
+// Polls the readsb aircraft.json file over HTTP, optionally archiving every
+// payload with the recorder
+type aircraftJsonSource struct {
+	url      string
+	station  string
+	recorder *Recorder
+}
+
+func (s *aircraftJsonSource) Snapshot(ctx context.Context) (*Response, error) {
+
+	responseData, err := Fetch(ctx, s.url)
 
 	if err != nil {
 		return nil, err
 	}
 
+	if s.recorder != nil {
+		if err := s.recorder.Record(s.station, recordedReadsb, responseData); err != nil {
+			ingestLog.Error("Error recording data", "station", s.station, "error", err)
+		}
+	}
+
+	return parseResponse(responseData)
+}
+
+// Connects to a streaming TCP output of readsb and keeps reconnecting, with
+// exponential backoff, whenever the connection drops, until ctx is done.
+func runStream(ctx context.Context, label string, addr string, consume func(conn net.Conn) error) {
+
+	backoff := streamMinBackoff
+	dialer := net.Dialer{Timeout: streamDialTimeout}
+
+	for {
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			ingestLog.Info("Connected", "source", label, "addr", addr)
+			// Closing the connection stops consume in the middle of a read
+			stop := context.AfterFunc(ctx, func() { conn.Close() })
+			err = consume(conn)
+			stop()
+			conn.Close()
+			backoff = streamMinBackoff
+		}
+
+		if ctx.Err() != nil {
+			ingestLog.Info("Disconnected", "source", label, "addr", addr)
+			return
+		}
+
+		ingestLog.Warn("Connection lost, reconnecting", "source", label, "addr", addr, "error", err, "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > streamMaxBackoff {
+			backoff = streamMaxBackoff
+		}
+	}
+}
+
+// GETs url, giving up after fetchTimeout or once ctx is done
+func Fetch(ctx context.Context, url string) ([]byte, error) {
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := fetchClient.Do(request)
+
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, fmt.Errorf("%s returned %s", url, response.Status)
+	}
+
 	data, err := io.ReadAll(response.Body)
 
 	if err != nil {
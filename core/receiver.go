@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const (
+	receiverFetchAttempts = 5
+	receiverRetryDelay    = 5 * time.Second
+)
+
+// Where the receiver is, and where that was read from
+type ReceiverLocation struct {
+	Lat    float64 `json:"lat"`
+	Lon    float64 `json:"lon"`
+	Source string  `json:"source"`
+}
+
+// Set once at startup by resolveReceiverLocation
+var receiverLocation ReceiverLocation
+
+type receiverJson struct {
+	Lat *float64 `json:"lat"`
+	Lon *float64 `json:"lon"`
+}
+
+// Works out the receiver location, from LAT/LON if set, otherwise from the
+// receiver.json served next to aircraft.json. Retrying receiver.json stops
+// once ctx is done.
+//
+// Every distance is measured from this location, so an error is returned
+// rather than carrying on without one.
+func resolveReceiverLocation(ctx context.Context) error {
+
+	lat, lon, set, err := configuredLocation()
+	if err != nil {
+		return err
+	}
+	if set {
+		receiverLocation = ReceiverLocation{Lat: lat, Lon: lon, Source: "config"}
+		return nil
+	}
+
+	url := getReceiverJsonUrl()
+	if url == "" {
+		return fmt.Errorf("no receiver location: set LAT and LON, or READSB_RECEIVER_JSON to the url of readsb's receiver.json")
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= receiverFetchAttempts; attempt++ {
+
+		lat, lon, err := fetchReceiverLocation(ctx, url)
+		if err == nil {
+			receiverLocation = ReceiverLocation{Lat: lat, Lon: lon, Source: url}
+			slog.Info("Using receiver location", "lat", lat, "lon", lon, "url", url)
+			return nil
+		}
+
+		lastErr = err
+		if attempt < receiverFetchAttempts {
+			slog.Warn("Unable to read receiver location, retrying", "url", url, "error", err, "delay", receiverRetryDelay)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(receiverRetryDelay):
+			}
+		}
+	}
+
+	return fmt.Errorf("no receiver location: LAT and LON are not set, and %s could not be used: %w", url, lastErr)
+}
+
+// LAT and LON from the config, if set. Either both or neither must be given,
+// rather than silently using 0 for the other, though either can be 0 on the
+// equator or prime meridian. Both being 0 is treated as not set, as that is
+// what the example .env ships with. The range is checked by loadConfig.
+func configuredLocation() (float64, float64, bool, error) {
+
+	lat, lon := config.Receiver.Lat, config.Receiver.Lon
+
+	switch {
+	case lat == nil && lon == nil:
+		return 0, 0, false, nil
+	case lon == nil:
+		return 0, 0, false, fmt.Errorf("LAT is set but LON isn't, set both or neither")
+	case lat == nil:
+		return 0, 0, false, fmt.Errorf("LON is set but LAT isn't, set both or neither")
+	case *lat == 0 && *lon == 0:
+		return 0, 0, false, nil
+	}
+
+	return *lat, *lon, true, nil
+}
+
+func fetchReceiverLocation(ctx context.Context, url string) (float64, float64, error) {
+
+	data, err := Fetch(ctx, url)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var receiver receiverJson
+	if err := json.Unmarshal(data, &receiver); err != nil {
+		return 0, 0, fmt.Errorf("invalid receiver.json: %w", err)
+	}
+
+	// readsb leaves these out unless started with --lat and --lon
+	if receiver.Lat == nil || receiver.Lon == nil {
+		return 0, 0, fmt.Errorf("receiver.json has no lat/lon, readsb needs to be started with --lat and --lon")
+	}
+
+	if err := validateLocation(*receiver.Lat, *receiver.Lon); err != nil {
+		return 0, 0, err
+	}
+
+	return *receiver.Lat, *receiver.Lon, nil
+}
+
+func validateLocation(lat float64, lon float64) error {
+	if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return fmt.Errorf("%v, %v is not a valid location", lat, lon)
+	}
+	if lat == 0 && lon == 0 {
+		return fmt.Errorf("0, 0 is not a valid location")
+	}
+	return nil
+}
+
+// READSB_RECEIVER_JSON if set, otherwise receiver.json alongside the first
+// aircraft.json being polled
+func getReceiverJsonUrl() string {
+
+	if url := config.Readsb.ReceiverJson; url != "" {
+		return url
+	}
+
+	aircraftJsonUrl := config.Readsb.AircraftJson
+
+	if sources := config.Readsb.Sources; sources != "" {
+		aircraftJsonUrl = ""
+		for _, entry := range strings.Split(sources, ",") {
+			_, url, _ := strings.Cut(strings.TrimSpace(entry), "=")
+			url = strings.TrimSpace(url)
+			if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+				aircraftJsonUrl = url
+				break
+			}
+		}
+	}
+
+	if !strings.HasSuffix(aircraftJsonUrl, "aircraft.json") {
+		return ""
+	}
+
+	return strings.TrimSuffix(aircraftJsonUrl, "aircraft.json") + "receiver.json"
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestConfiguredLocation(t *testing.T) {
+
+	saved := config
+	t.Cleanup(func() { config = saved })
+
+	for _, test := range []struct {
+		lat, lon string
+		wantLat  float64
+		wantLon  float64
+		wantSet  bool
+		wantErr  bool
+	}{
+		{"", "", 0, 0, false, false},
+		{"51.4700", "-0.4543", 51.47, -0.4543, true, false},
+		// On the prime meridian and the equator
+		{"51.4779", "0", 51.4779, 0, true, false},
+		{"0", "32.5825", 0, 32.5825, true, false},
+		// As the example .env ships
+		{"0.000000", "0.000000", 0, 0, false, false},
+		{"51.4700", "", 0, 0, false, true},
+		{"", "0", 0, 0, false, true},
+	} {
+		cfg := defaultConfig()
+		for _, field := range configFields(&cfg) {
+			value := map[string]string{"receiver.lat": test.lat, "receiver.lon": test.lon}[field.path]
+			if value == "" {
+				continue
+			}
+			if err := field.set(value); err != nil {
+				t.Fatalf("%s = %q: %v", field.path, value, err)
+			}
+		}
+		config = cfg
+
+		lat, lon, set, err := configuredLocation()
+		if (err != nil) != test.wantErr || set != test.wantSet || lat != test.wantLat || lon != test.wantLon {
+			t.Errorf("LAT=%q LON=%q gives %v, %v, set %v, error %v, want %v, %v, set %v, error %v",
+				test.lat, test.lon, lat, lon, set, err, test.wantLat, test.wantLon, test.wantSet, test.wantErr)
+		}
+	}
+}
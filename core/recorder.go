@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	recordingPrefix = "aircraft-"
+	recordingSuffix = ".jsonl.gz"
+	recordingLayout = "2006-01-02T15"
+)
+
+// Recorder archives every aircraft.json payload fetched from readsb, so the
+// database can be rebuilt or an ingestion bug reproduced later with replay.
+//
+// Payloads are written one per line, gzipped, into a new file every hour
+// (UTC), e.g. aircraft-2025-01-31T14.jsonl.gz. Files older than the
+// retention period are deleted, a retention of 0 keeps everything.
+type Recorder struct {
+	dir       string
+	retention time.Duration
+	mu        sync.Mutex
+	file      *os.File
+	gz        *gzip.Writer
+	hour      time.Time
+}
+
+type recordedSnapshot struct {
+	Station string          `json:"station"`
+	Source  string          `json:"source,omitempty"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// The kind of source a payload was fetched from, which decides how it is
+// decoded when replayed. Recordings without one are from readsb.
+const (
+	recordedReadsb = "readsb"
+	recordedUat    = "uat"
+)
+
+func NewRecorder(dir string, retention time.Duration) (*Recorder, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Error creating recording directory: %w", err)
+	}
+
+	return &Recorder{dir: dir, retention: retention}, nil
+}
+
+func (r *Recorder) Record(station string, source string, payload []byte) error {
+
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, payload); err != nil {
+		return fmt.Errorf("payload is not valid json: %w", err)
+	}
+
+	line, err := json.Marshal(recordedSnapshot{Station: station, Source: source, Payload: compact.Bytes()})
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.rotate(time.Now().UTC()); err != nil {
+		return err
+	}
+
+	if _, err := r.gz.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	// Flush so that a crash only loses the current payload
+	return r.gz.Flush()
+}
+
+func (r *Recorder) rotate(now time.Time) error {
+
+	hour := now.Truncate(time.Hour)
+	if r.gz != nil && hour.Equal(r.hour) {
+		return nil
+	}
+
+	if err := r.closeFile(); err != nil {
+		ingestLog.Error("Error closing archive", "error", err)
+	}
+
+	name := filepath.Join(r.dir, recordingPrefix+hour.Format(recordingLayout)+recordingSuffix)
+
+	// Appending after a restart adds a second gzip member, which readers
+	// handle transparently
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Error opening archive %s: %w", name, err)
+	}
+
+	r.file = file
+	r.gz = gzip.NewWriter(file)
+	r.hour = hour
+
+	r.pruneArchives(now)
+
+	return nil
+}
+
+func (r *Recorder) pruneArchives(now time.Time) {
+
+	if r.retention <= 0 {
+		return
+	}
+
+	files, err := listRecordings(r.dir)
+	if err != nil {
+		ingestLog.Error("Error listing archives", "error", err)
+		return
+	}
+
+	for _, file := range files {
+		hour, err := recordingHour(file)
+		if err != nil || now.Sub(hour) <= r.retention {
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			ingestLog.Error("Error removing archive", "error", err)
+		}
+	}
+}
+
+func (r *Recorder) closeFile() error {
+
+	if r.gz == nil {
+		return nil
+	}
+
+	err := r.gz.Close()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	r.gz = nil
+	r.file = nil
+
+	return err
+}
+
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closeFile()
+}
+
+// Returns the archives in a directory, oldest first
+func listRecordings(dir string) ([]string, error) {
+
+	files, err := filepath.Glob(filepath.Join(dir, recordingPrefix+"*"+recordingSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(files)
+
+	return files, nil
+}
+
+func recordingHour(file string) (time.Time, error) {
+	name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), recordingPrefix), recordingSuffix)
+	return time.Parse(recordingLayout, name)
+}
@@ -7,37 +7,43 @@ import (
 	"io"
 	"net/http"
 	"strings"
-
-	"github.com/jackc/pgx/v5"
 )
 
-func updateRegistrations(pg *postgres) {
+func updateRegistrations(ctx context.Context, pg *postgres) error {
 
-	aircrafts := unprocessedRegistrations(pg)
+	aircrafts, err := unprocessedRegistrations(ctx, pg)
+	if err != nil {
+		return err
+	}
 
 	if len(aircrafts) == 0 {
-		return
+		return nil
 	}
 
-	existing, new := checkRegistrationExists(pg, aircrafts)
+	existing, new := checkRegistrationExists(ctx, pg, aircrafts)
 
-	if len(new) > 50 {
-		new = new[:50]
+	if len(new) > config.Registrations.BatchSize {
+		new = new[:config.Registrations.BatchSize]
 	}
 
 	var registrations []RegistrationInfo
 
 	for _, aircraft := range new {
 
-		registration, err := getRegistration(aircraft)
+		// Stop looking up more when shutting down, and write what we have
+		if ctx.Err() != nil {
+			break
+		}
+
+		registration, err := getRegistration(ctx, aircraft)
 
 		if err != nil {
-			fmt.Println("Error getting registration: ", err)
+			registrationsLog.Warn("Error getting registration", "hex", aircraft.Hex, "error", err)
 			continue
 		}
 
 		if registration.Response.Aircraft.ModeS == "" {
-			fmt.Printf("No registration found for %s \n", aircraft.Hex)
+			registrationsLog.Debug("No registration found", "hex", aircraft.Hex)
 			existing = append(existing, aircraft)
 			continue
 		}
@@ -48,46 +54,38 @@ func updateRegistrations(pg *postgres) {
 
 	}
 
-	insertRegistrations(pg, registrations)
+	ctx = writeContext(ctx)
 
-	MarkProcessed(pg, "registration_processed", existing)
+	insertRegistrations(ctx, pg, registrations)
 
+	MarkProcessed(ctx, pg, "registration_processed", existing)
+
+	return nil
 }
 
-func insertRegistrations(pg *postgres, registrations []RegistrationInfo) {
+func insertRegistrations(ctx context.Context, pg *postgres, registrations []RegistrationInfo) {
 
-	batch := &pgx.Batch{}
+	if len(registrations) == 0 {
+		return
+	}
 
+	columns := []string{
+		"type",
+		"icao_type",
+		"manufacturer",
+		"mode_s",
+		"registration",
+		"registered_owner_country_iso_name",
+		"registered_owner_country_name",
+		"registered_owner_operator_flag_code",
+		"registered_owner",
+		"url_photo",
+		"url_photo_thumbnail",
+	}
+
+	rows := make([][]any, 0, len(registrations))
 	for _, registration := range registrations {
-		insertStatement := `
-			INSERT INTO registration_data (
-				type,
-				icao_type,
-				manufacturer,
-				mode_s,
-				registration,
-				registered_owner_country_iso_name,
-				registered_owner_country_name,
-				registered_owner_operator_flag_code,
-				registered_owner,
-				url_photo,
-				url_photo_thumbnail) 
-			VALUES ( 
-				$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
-			ON CONFLICT (mode_s)
-			DO UPDATE SET
-				type = EXCLUDED.type,
-				icao_type = EXCLUDED.icao_type,
-				manufacturer = EXCLUDED.manufacturer,
-				registration = EXCLUDED.registration,
-				registered_owner_country_iso_name = EXCLUDED.registered_owner_country_iso_name,
-				registered_owner_country_name = EXCLUDED.registered_owner_country_name,
-				registered_owner_operator_flag_code = EXCLUDED.registered_owner_operator_flag_code,
-				registered_owner = EXCLUDED.registered_owner,
-				url_photo = EXCLUDED.url_photo,
-				url_photo_thumbnail = EXCLUDED.url_photo_thumbnail`
-
-		batch.Queue(insertStatement,
+		rows = append(rows, []any{
 			registration.Response.Aircraft.Type,
 			registration.Response.Aircraft.IcaoType,
 			registration.Response.Aircraft.Manufacturer,
@@ -98,31 +96,69 @@ func insertRegistrations(pg *postgres, registrations []RegistrationInfo) {
 			registration.Response.Aircraft.RegisteredOwnerOperatorFlagCode,
 			registration.Response.Aircraft.RegisteredOwner,
 			registration.Response.Aircraft.URLPhoto,
-			registration.Response.Aircraft.URLPhotoThumbnail)
+			registration.Response.Aircraft.URLPhotoThumbnail,
+		})
+	}
+
+	tx, err := pg.db.Begin(ctx)
+	if err != nil {
+		registrationsLog.Error("Unable to begin transaction for registrations", "error", err)
+		return
 	}
+	defer tx.Rollback(ctx)
 
-	br := pg.db.SendBatch(context.Background(), batch)
-	defer br.Close()
+	staging, err := copyToStaging(ctx, tx, "registration_data", columns, rows)
+	if err != nil {
+		registrationsLog.Error("Unable to insert registrations", "error", err)
+		return
+	}
 
-	for i := 0; i < len(registrations); i++ {
-		_, err := br.Exec()
-		if err != nil {
-			fmt.Println("insertRegistrations() - Unable to insert data: ", err)
-		}
+	// The same aircraft can be looked up twice in a batch, and a row can
+	// only be merged once per statement
+	insertStatement := `
+		INSERT INTO registration_data (` + strings.Join(columns, ", ") + `)
+		SELECT DISTINCT ON (mode_s) ` + strings.Join(columns, ", ") + `
+		FROM ` + staging + `
+		ORDER BY mode_s
+		ON CONFLICT (mode_s)
+		DO UPDATE SET
+			type = EXCLUDED.type,
+			icao_type = EXCLUDED.icao_type,
+			manufacturer = EXCLUDED.manufacturer,
+			registration = EXCLUDED.registration,
+			registered_owner_country_iso_name = EXCLUDED.registered_owner_country_iso_name,
+			registered_owner_country_name = EXCLUDED.registered_owner_country_name,
+			registered_owner_operator_flag_code = EXCLUDED.registered_owner_operator_flag_code,
+			registered_owner = EXCLUDED.registered_owner,
+			url_photo = EXCLUDED.url_photo,
+			url_photo_thumbnail = EXCLUDED.url_photo_thumbnail`
+
+	if _, err := tx.Exec(ctx, insertStatement); err != nil {
+		registrationsLog.Error("Unable to insert registrations", "error", err)
+		return
 	}
 
+	if err := tx.Commit(ctx); err != nil {
+		registrationsLog.Error("Unable to insert registrations", "error", err)
+	}
 }
 
-func getRegistration(aircraft Aircraft) (*RegistrationInfo, error) {
+func getRegistration(ctx context.Context, aircraft Aircraft) (*RegistrationInfo, error) {
 
 	url := "https://api.adsbdb.com/v0/aircraft/"
 	url += aircraft.Hex
 
-	response, err := http.Get(url)
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := http.DefaultClient.Do(request)
 
 	if err != nil {
 		return nil, err
 	}
+	defer response.Body.Close()
 
 	data, err := io.ReadAll(response.Body)
 
@@ -137,21 +173,21 @@ func getRegistration(aircraft Aircraft) (*RegistrationInfo, error) {
 
 }
 
-func unprocessedRegistrations(pg *postgres) []Aircraft {
+func unprocessedRegistrations(ctx context.Context, pg *postgres) ([]Aircraft, error) {
 
 	query := `
 		SELECT id, hex
 		FROM aircraft_data
 		WHERE 
 			hex != '' AND
+			address_type = 'icao' AND
 			registration_processed = false
 		ORDER BY first_seen ASC`
 
-	rows, err := pg.db.Query(context.Background(), query)
+	rows, err := pg.db.Query(ctx, query)
 
 	if err != nil {
-		fmt.Println("unprocessedRegistrations() - Error querying db: ", err)
-		return nil
+		return nil, fmt.Errorf("Error querying unprocessed registrations: %w", err)
 	}
 	defer rows.Close()
 
@@ -167,18 +203,17 @@ func unprocessedRegistrations(pg *postgres) []Aircraft {
 		)
 
 		if err != nil {
-			fmt.Println("unprocessedRegistrations() - Error scanning rows: ", err)
-			return nil
+			return nil, fmt.Errorf("Error scanning unprocessed registrations: %w", err)
 		}
 
 		aircrafts = append(aircrafts, aircraft)
 	}
 
-	fmt.Println("Aircrafts that have not have registration processed: ", len(aircrafts))
-	return aircrafts
+	registrationsLog.Debug("Sessions without registrations processed", "count", len(aircrafts))
+	return aircrafts, nil
 }
 
-func checkRegistrationExists(pg *postgres, aircraftToProcess []Aircraft) (existing []Aircraft, new []Aircraft) {
+func checkRegistrationExists(ctx context.Context, pg *postgres, aircraftToProcess []Aircraft) (existing []Aircraft, new []Aircraft) {
 
 	var hexValues []string
 	for _, a := range aircraftToProcess {
@@ -192,10 +227,10 @@ func checkRegistrationExists(pg *postgres, aircraftToProcess []Aircraft) (existi
 		FROM registration_data
 		WHERE mode_s = ANY($1::text[])`
 
-	rows, err := pg.db.Query(context.Background(), query, hexValues)
+	rows, err := pg.db.Query(ctx, query, hexValues)
 
 	if err != nil {
-		fmt.Println("checkRegistrationExists() - Error querying db: ", err)
+		registrationsLog.Error("Error querying existing registrations", "error", err)
 		return nil, nil
 	}
 	defer rows.Close()
@@ -208,7 +243,7 @@ func checkRegistrationExists(pg *postgres, aircraftToProcess []Aircraft) (existi
 		)
 
 		if err != nil {
-			fmt.Println("checkRegistrationExists() - Error scanning rows: ", err)
+			registrationsLog.Error("Error scanning existing registrations", "error", err)
 			continue
 		}
 
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const replayMaxLineSize = 64 * 1024 * 1024
+
+// Hands a single recorded snapshot to updateAircraftDatabase
+type replaySource struct {
+	response *Response
+}
+
+func (s *replaySource) Snapshot(ctx context.Context) (*Response, error) {
+	return s.response, nil
+}
+
+// Pushes recorded archives through the normal ingestion pipeline, in order.
+// Snapshots keep their original "now", and are paced by the gap between
+// them divided by speed.
+func ReplayArchives(ctx context.Context, pg *postgres, path string, speed float64) error {
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		files, err = listRecordings(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(files) == 0 {
+		return fmt.Errorf("no archives found in %s", path)
+	}
+
+	var previousNow float64
+	var replayErr error
+	replayed := 0
+
+	for _, file := range files {
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		ingestLog.Info("Replaying", "file", file)
+
+		err := readRecording(file, func(snapshot recordedSnapshot) error {
+
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			response, err := parseRecordedSnapshot(snapshot)
+			if err != nil {
+				ingestLog.Warn("Skipping snapshot", "error", err)
+				return nil
+			}
+			for i := range response.Aircraft {
+				response.Aircraft[i].Stations = []string{snapshot.Station}
+			}
+
+			if speed > 0 && previousNow > 0 && response.Now > previousNow {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(time.Duration((response.Now - previousNow) / speed * float64(time.Second))):
+				}
+			}
+			previousNow = response.Now
+
+			if err := updateAircraftDatabase(ctx, pg, &replaySource{response: response}); err != nil {
+				return err
+			}
+
+			replayed++
+			if replayed%1000 == 0 {
+				ingestLog.Info("Replaying snapshots", "replayed", replayed, "up_to", time.Unix(int64(response.Now), 0).UTC())
+			}
+			return nil
+		})
+
+		if err != nil {
+			replayErr = fmt.Errorf("Error replaying %s: %w", file, err)
+			break
+		}
+	}
+
+	// Write the sessions still held in memory
+	flushLiveSessions(writeContext(ctx), pg, previousNow)
+
+	if replayErr != nil {
+		return replayErr
+	}
+
+	if ctx.Err() != nil {
+		ingestLog.Info("Replay stopped", "replayed", replayed)
+		return ctx.Err()
+	}
+
+	ingestLog.Info("Replay complete", "replayed", replayed)
+
+	return nil
+}
+
+// Decodes a payload the same way as the source it was recorded from
+func parseRecordedSnapshot(snapshot recordedSnapshot) (*Response, error) {
+	switch snapshot.Source {
+	case "", recordedReadsb:
+		return parseResponse(snapshot.Payload)
+	case recordedUat:
+		return parseUatResponse(snapshot.Payload)
+	}
+	return nil, fmt.Errorf("unknown source %q", snapshot.Source)
+}
+
+// Calls handle with each snapshot in an archive, stopping at the first error
+// it returns
+func readRecording(file string, handle func(snapshot recordedSnapshot) error) error {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 0, 1024*1024), replayMaxLineSize)
+
+	for scanner.Scan() {
+		var snapshot recordedSnapshot
+		if err := json.Unmarshal(scanner.Bytes(), &snapshot); err != nil {
+			ingestLog.Warn("Skipping unreadable snapshot", "file", file, "error", err)
+			continue
+		}
+		if err := handle(snapshot); err != nil {
+			return err
+		}
+	}
+
+	// The archive currently being written, or one cut off by a crash, ends
+	// without a gzip footer
+	if err := scanner.Err(); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+
+	return nil
+}
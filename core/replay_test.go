@@ -0,0 +1,70 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// A recorded payload is decoded on replay by the decoder of the source it
+// came from
+func TestReplayDecodesBySource(t *testing.T) {
+
+	recorder, err := NewRecorder(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readsb := `{"now": 1717243200.0, "messages": 10, "aircraft": [{"hex": "4ca1b2", "type": "adsb_icao", "alt_baro": "ground"}]}`
+	uat := `{"now": 1717243201.0, "messages": 5, "aircraft": [{"hex": "a1b2c3", "addr_type": "adsb_icao", "alt_baro": 1200, "airground_state": "ground"}]}`
+
+	if err := recorder.Record("home", recordedReadsb, []byte(readsb)); err != nil {
+		t.Fatal(err)
+	}
+	if err := recorder.Record("home", recordedUat, []byte(uat)); err != nil {
+		t.Fatal(err)
+	}
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := listRecordings(recorder.dir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("recordings = %v, %v, want one", files, err)
+	}
+
+	var aircraft []Aircraft
+	err = readRecording(files[0], func(snapshot recordedSnapshot) error {
+		response, err := parseRecordedSnapshot(snapshot)
+		if err != nil {
+			return err
+		}
+		aircraft = append(aircraft, response.Aircraft...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aircraft) != 2 {
+		t.Fatalf("got %d aircraft, want 2", len(aircraft))
+	}
+
+	if slices.Contains(aircraft[0].Datalinks, datalinkUat) || !aircraft[0].OnGround {
+		t.Errorf("readsb aircraft = datalinks %v, on_ground %v, want no uat, on the ground", aircraft[0].Datalinks, aircraft[0].OnGround)
+	}
+
+	if !slices.Contains(aircraft[1].Datalinks, datalinkUat) {
+		t.Errorf("uat aircraft datalinks = %v, want uat", aircraft[1].Datalinks)
+	}
+	if aircraft[1].Type != "adsb_icao" || !aircraft[1].OnGround {
+		t.Errorf("uat aircraft = type %q, on_ground %v, want adsb_icao, on the ground", aircraft[1].Type, aircraft[1].OnGround)
+	}
+
+	// Recordings from before the source was kept are readsb's
+	response, err := parseRecordedSnapshot(recordedSnapshot{Payload: []byte(readsb)})
+	if err != nil || len(response.Aircraft) != 1 {
+		t.Errorf("recording without a source = %v, %v, want decoded as readsb", response, err)
+	}
+	if _, err := parseRecordedSnapshot(recordedSnapshot{Source: "sbs", Payload: []byte(readsb)}); err == nil {
+		t.Error("recording from an unknown source was decoded")
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Between runs of the jobs that call adsbdb, so a large range doesn't hammer it
+const reprocessLookupPause = 2 * time.Second
+
+// An enrichment job that reprocess can redo. reset clears its flags (and
+// anything it would otherwise insert twice) for sessions in the range, and
+// pending counts the sessions it still has to get through.
+type reprocessStep struct {
+	name    string
+	reset   []string
+	pending string
+	pause   time.Duration
+	run     func(ctx context.Context, pg *postgres) error
+}
+
+// In the order they are redone. The range is $1 (inclusive) to $2
+// (exclusive), either of which may be NULL.
+var reprocessSteps = []reprocessStep{
+	{
+		name:    "registrations",
+		reset:   []string{`UPDATE aircraft_data SET registration_processed = false WHERE ` + reprocessRange},
+		pending: `hex != '' AND address_type = 'icao' AND registration_processed = false`,
+		pause:   reprocessLookupPause,
+		run:     updateRegistrations,
+	},
+	{
+		name:    "routes",
+		reset:   []string{`UPDATE aircraft_data SET route_processed = false WHERE ` + reprocessRange},
+		pending: `hex != '' AND flight != '' AND route_processed = false`,
+		pause:   reprocessLookupPause,
+		run:     updateRoutes,
+	},
+	{
+		name: "interesting",
+		reset: []string{
+			// Sightings are inserted without ON CONFLICT, so remove them first
+			`DELETE FROM interesting_aircraft_seen s
+			USING aircraft_data a
+			WHERE s.hex = a.hex AND s.seen = a.first_seen AND ` + strings.ReplaceAll(reprocessRange, "first_seen", "a.first_seen"),
+			`UPDATE aircraft_data SET interesting_processed = false WHERE ` + reprocessRange,
+		},
+		pending: `hex != '' AND address_type = 'icao' AND interesting_processed = false`,
+		run:     updateInterestingSeen,
+	},
+	{
+		name: "statistics",
+		reset: []string{`
+			UPDATE aircraft_data SET
+				lowest_aircraft_processed = false,
+				highest_aircraft_processed = false,
+				fastest_aircraft_processed = false,
+				slowest_aircraft_processed = false
+			WHERE ` + reprocessRange},
+		pending: `lowest_aircraft_processed = false OR highest_aircraft_processed = false OR
+			fastest_aircraft_processed = false OR slowest_aircraft_processed = false`,
+		run: updateMeasurementStatistics,
+	},
+	{
+		name: "correlations",
+		reset: []string{fmt.Sprintf(`
+			UPDATE aircraft_data SET correlated_hex = NULL, correlation_processed = false
+			WHERE address_type != '%s' AND `+reprocessRange, addressTypeIcao)},
+		pending: fmt.Sprintf(`address_type != '%s' AND correlation_processed = false AND
+			last_seen < NOW() - INTERVAL '%d seconds'`, addressTypeIcao, sessionGapSeconds),
+		run: updateNonIcaoCorrelations,
+	},
+}
+
+const reprocessRange = `($1::timestamptz IS NULL OR first_seen >= $1) AND ($2::timestamptz IS NULL OR first_seen < $2)`
+
+func runReprocess(args []string) int {
+
+	names := make([]string, len(reprocessSteps))
+	for i, step := range reprocessSteps {
+		names[i] = step.name
+	}
+
+	flags := commandFlags("reprocess", "-from date [-to date] [-only jobs]")
+	from := flags.String("from", "", "redo sessions first seen on or after this date (2006-01-02 or RFC 3339)")
+	to := flags.String("to", "", "redo sessions first seen on or before this date (default now)")
+	only := flags.String("only", strings.Join(names, ","), "comma separated jobs to redo")
+	if code, ok := parseCommand(flags, args, 0, 0); !ok {
+		return code
+	}
+
+	// Reprocessing everything is rarely meant, and can take days of lookups
+	if *from == "" {
+		fmt.Fprintf(os.Stderr, "skystats reprocess: -from is required\n")
+		return exitUsage
+	}
+
+	start, end, err := parseDateRange(*from, *to)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "skystats reprocess: %v\n", err)
+		return exitUsage
+	}
+
+	var steps []reprocessStep
+	for _, name := range strings.Split(*only, ",") {
+		name = strings.TrimSpace(name)
+		i := slices.IndexFunc(reprocessSteps, func(step reprocessStep) bool { return step.name == name })
+		if i < 0 {
+			fmt.Fprintf(os.Stderr, "skystats reprocess: unknown job %q, expected one of %s\n", name, strings.Join(names, ", "))
+			return exitUsage
+		}
+		steps = append(steps, reprocessSteps[i])
+	}
+
+	return withDatabase(func(ctx context.Context, pg *postgres) int {
+		for _, step := range steps {
+			if err := reprocess(ctx, pg, step, start, end); err != nil {
+				slog.Error("Error reprocessing", "job", step.name, "error", err)
+				return exitFailed
+			}
+		}
+		return exitOK
+	})
+}
+
+// Resets the step's flags for the range, then runs its job until nothing is
+// left or a run stops making progress (e.g. adsbdb failing every lookup)
+func reprocess(ctx context.Context, pg *postgres, step reprocessStep, from sql.NullTime, to sql.NullTime) error {
+
+	if step.name == "correlations" && !correlateNonIcao() {
+		slog.Info("Skipping correlations, correlation.non_icao is not enabled")
+		return nil
+	}
+
+	for _, query := range step.reset {
+		result, err := pg.db.Exec(ctx, query, from, to)
+		if err != nil {
+			return fmt.Errorf("Error resetting %s: %w", step.name, err)
+		}
+		slog.Info("Reset sessions", "job", step.name, "rows", result.RowsAffected())
+	}
+
+	pending, err := countPending(ctx, pg, step)
+	if err != nil {
+		return err
+	}
+
+	for pending > 0 {
+
+		if err := step.run(ctx, pg); err != nil {
+			return err
+		}
+
+		left, err := countPending(ctx, pg, step)
+		if err != nil {
+			return err
+		}
+		if left >= pending {
+			slog.Warn("Stopped reprocessing, the last run made no progress", "job", step.name, "left", left)
+			break
+		}
+		pending = left
+		slog.Info("Reprocessing", "job", step.name, "left", pending)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(step.pause):
+		}
+	}
+
+	slog.Info("Reprocessed", "job", step.name)
+	return nil
+}
+
+func countPending(ctx context.Context, pg *postgres, step reprocessStep) (int, error) {
+
+	var count int
+	err := pg.db.QueryRow(ctx, `SELECT COUNT(*) FROM aircraft_data WHERE `+step.pending).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("Error counting %s left to reprocess: %w", step.name, err)
+	}
+
+	return count, nil
+}
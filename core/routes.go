@@ -6,10 +6,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"strings"
 	"time"
 
-	"github.com/jackc/pgx/v5"
 	"github.com/tomcarman/skystats/data"
 )
 
@@ -18,34 +19,41 @@ func getDistanceBetweenAirports(origin []float64, destination []float64) *float6
 	return &distance
 }
 
-func updateRoutes(pg *postgres) {
+func updateRoutes(ctx context.Context, pg *postgres) error {
 
-	aircrafts := unprocessedRoutes(pg)
+	aircrafts, err := unprocessedRoutes(ctx, pg)
+	if err != nil {
+		return err
+	}
 
 	if len(aircrafts) == 0 {
-		return
+		return nil
 	}
 
-	if len(aircrafts) > 100 {
-		aircrafts = aircrafts[:100]
+	if len(aircrafts) > config.Routes.BatchSize {
+		aircrafts = aircrafts[:config.Routes.BatchSize]
 	}
 
-	existing, new := checkRouteExists(pg, aircrafts)
+	existing, new := checkRouteExists(ctx, pg, aircrafts)
 
-	routes, err := getRoutes(new)
+	routes, err := getRoutes(ctx, new)
 	if err != nil {
-		fmt.Println("Error getting routes: ", err)
-		return
+		return fmt.Errorf("Error getting routes: %w", err)
 	}
 
-	insertRoutes(pg, routes)
+	// Finish writing once started, even if shutting down
+	ctx = writeContext(ctx)
+
+	insertRoutes(ctx, pg, routes)
+	forgetCachedRoutes(routes)
 
 	existing = append(existing, new...)
-	MarkProcessed(pg, "route_processed", existing)
+	MarkProcessed(ctx, pg, "route_processed", existing)
 
+	return nil
 }
 
-func unprocessedRoutes(pg *postgres) []Aircraft {
+func unprocessedRoutes(ctx context.Context, pg *postgres) ([]Aircraft, error) {
 
 	query := `
 		SELECT id, flight, last_seen_lat, last_seen_lon
@@ -56,11 +64,10 @@ func unprocessedRoutes(pg *postgres) []Aircraft {
 			route_processed = false
 		ORDER BY first_seen ASC`
 
-	rows, err := pg.db.Query(context.Background(), query)
+	rows, err := pg.db.Query(ctx, query)
 
 	if err != nil {
-		fmt.Println("unprocessedRoutes() - Error querying db: ", err)
-		return nil
+		return nil, fmt.Errorf("Error querying unprocessed routes: %w", err)
 	}
 	defer rows.Close()
 
@@ -78,18 +85,17 @@ func unprocessedRoutes(pg *postgres) []Aircraft {
 		)
 
 		if err != nil {
-			fmt.Println("unprocessedRoutes() - Error scanning rows: ", err)
-			return nil
+			return nil, fmt.Errorf("Error scanning unprocessed routes: %w", err)
 		}
 
 		aircrafts = append(aircrafts, aircraft)
 	}
 
-	fmt.Println("Aircrafts that have not have routes processed: ", len(aircrafts))
-	return aircrafts
+	routesLog.Debug("Sessions without routes processed", "count", len(aircrafts))
+	return aircrafts, nil
 }
 
-func checkRouteExists(pg *postgres, aircraftToProcess []Aircraft) (existing []Aircraft, new []Aircraft) {
+func checkRouteExists(ctx context.Context, pg *postgres, aircraftToProcess []Aircraft) (existing []Aircraft, new []Aircraft) {
 
 	var callsignValues []string
 	for _, a := range aircraftToProcess {
@@ -103,12 +109,12 @@ func checkRouteExists(pg *postgres, aircraftToProcess []Aircraft) (existing []Ai
 		FROM route_data
 		WHERE route_callsign = ANY($1::text[])
 		  AND last_updated IS NOT NULL
-		  AND last_updated > NOW() - INTERVAL '1 hour'`
+		  AND last_updated > NOW() - make_interval(secs => $2)`
 
-	rows, err := pg.db.Query(context.Background(), query, callsignValues)
+	rows, err := pg.db.Query(ctx, query, callsignValues, config.Routes.MaxAgeSeconds)
 
 	if err != nil {
-		fmt.Println("checkRouteExists() - Error querying db: ", err)
+		routesLog.Error("Error querying existing routes", "error", err)
 		return nil, nil
 	}
 	defer rows.Close()
@@ -121,7 +127,7 @@ func checkRouteExists(pg *postgres, aircraftToProcess []Aircraft) (existing []Ai
 		)
 
 		if err != nil {
-			fmt.Println("checkRouteExists() - Error scanning rows: ", err)
+			routesLog.Error("Error scanning existing routes", "error", err)
 			continue
 		}
 
@@ -140,7 +146,7 @@ func checkRouteExists(pg *postgres, aircraftToProcess []Aircraft) (existing []Ai
 
 }
 
-func getRoutes(aircrafts []Aircraft) ([]RouteInfo, error) {
+func getRoutes(ctx context.Context, aircrafts []Aircraft) ([]RouteInfo, error) {
 
 	requestBodyData := buildRouteApiRequestBody(aircrafts)
 	requestBodyJson, err := json.Marshal(requestBodyData)
@@ -151,7 +157,7 @@ func getRoutes(aircrafts []Aircraft) ([]RouteInfo, error) {
 
 	url := "http://adsb.im/api/0/routeset"
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(requestBodyJson))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(requestBodyJson))
 	if err != nil {
 		return nil, err
 	}
@@ -184,12 +190,41 @@ func getRoutes(aircrafts []Aircraft) ([]RouteInfo, error) {
 	return routes, nil
 }
 
-func insertRoutes(pg *postgres, routes []RouteInfo) {
+func insertRoutes(ctx context.Context, pg *postgres, routes []RouteInfo) {
 
-	batch := &pgx.Batch{}
-	last_updated := time.Now().UTC().Format("2006-01-02 15:04:05-07")
+	last_updated := time.Now().UTC()
 	countryLookup := CountryIsoToName()
-	queuedCount := 0
+
+	columns := []string{
+		"route_callsign",
+		"route_callsign_icao",
+		"route_callsign_iata",
+		"airline_name",
+		"airline_icao",
+		"airline_iata",
+		"origin_country_iso_name",
+		"origin_country_name",
+		"origin_elevation",
+		"origin_iata_code",
+		"origin_icao_code",
+		"origin_latitude",
+		"origin_longitude",
+		"origin_municipality",
+		"origin_name",
+		"destination_country_iso_name",
+		"destination_country_name",
+		"destination_elevation",
+		"destination_iata_code",
+		"destination_icao_code",
+		"destination_latitude",
+		"destination_longitude",
+		"destination_municipality",
+		"destination_name",
+		"last_updated",
+		"route_distance",
+	}
+
+	var rows [][]any
 
 	for _, route := range routes {
 
@@ -225,73 +260,16 @@ func insertRoutes(pg *postgres, routes []RouteInfo) {
 			distance = getDistanceBetweenAirports([]float64{origin.Lon, origin.Lat}, []float64{destination.Lon, destination.Lat})
 		}
 
-		insertStatement := `
-			INSERT INTO route_data (
-				route_callsign,
-				route_callsign_icao,
-				airline_name,
-				airline_icao,
-				airline_iata,
-				origin_country_iso_name,
-				origin_country_name,
-				origin_elevation,
-				origin_iata_code,
-				origin_icao_code,
-				origin_latitude,
-				origin_longitude,
-				origin_municipality,
-				origin_name,
-				destination_country_iso_name,
-				destination_country_name,
-				destination_elevation,
-				destination_iata_code,
-				destination_icao_code,
-				destination_latitude,
-				destination_longitude,
-				destination_municipality,
-				destination_name,
-				last_updated,
-				route_distance)
-			VALUES (
-				$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15,
-				$16, $17, $18, $19, $20, $21, $22, $23, $24, $25)
-			ON CONFLICT (route_callsign)
-			DO UPDATE SET
-				route_callsign = EXCLUDED.route_callsign,
-				route_callsign_icao = EXCLUDED.route_callsign_icao,
-				airline_name = EXCLUDED.airline_name,
-				airline_icao = EXCLUDED.airline_icao,
-				airline_iata = EXCLUDED.airline_iata,
-				origin_country_iso_name = EXCLUDED.origin_country_iso_name,
-				origin_country_name = EXCLUDED.origin_country_name,
-				origin_elevation = EXCLUDED.origin_elevation,
-				origin_iata_code = EXCLUDED.origin_iata_code,
-				origin_icao_code = EXCLUDED.origin_icao_code,
-				origin_latitude = EXCLUDED.origin_latitude,
-				origin_longitude = EXCLUDED.origin_longitude,
-				origin_municipality = EXCLUDED.origin_municipality,
-				origin_name = EXCLUDED.origin_name,
-				destination_country_iso_name = EXCLUDED.destination_country_iso_name,
-				destination_country_name = EXCLUDED.destination_country_name,
-				destination_elevation = EXCLUDED.destination_elevation,
-				destination_iata_code = EXCLUDED.destination_iata_code,
-				destination_icao_code = EXCLUDED.destination_icao_code,
-				destination_latitude = EXCLUDED.destination_latitude,
-				destination_longitude = EXCLUDED.destination_longitude,
-				destination_municipality = EXCLUDED.destination_municipality,
-				destination_name = EXCLUDED.destination_name,
-				last_updated = EXCLUDED.last_updated,
-				route_distance = EXCLUDED.route_distance`
-
-		batch.Queue(insertStatement,
+		rows = append(rows, []any{
 			route.Callsign,
 			route.Callsign,
+			routeCallsignIata(route, airline),
 			airline.Name,
 			route.AirlineCode,
 			airline.IATA,
 			origin.CountryIso2,
 			originCountry,
-			origin.AltFeet,
+			int64(math.Round(origin.AltFeet)),
 			origin.Iata,
 			origin.Icao,
 			origin.Lat,
@@ -300,7 +278,7 @@ func insertRoutes(pg *postgres, routes []RouteInfo) {
 			origin.Name,
 			destination.CountryIso2,
 			destinationCountry,
-			destination.AltFeet,
+			int64(math.Round(destination.AltFeet)),
 			destination.Iata,
 			destination.Icao,
 			destination.Lat,
@@ -308,20 +286,89 @@ func insertRoutes(pg *postgres, routes []RouteInfo) {
 			destination.Location,
 			destination.Name,
 			last_updated,
-			distance)
-		queuedCount++
+			distance,
+		})
 	}
 
-	br := pg.db.SendBatch(context.Background(), batch)
-	defer br.Close()
+	if len(rows) == 0 {
+		return
+	}
 
-	for i := 0; i < queuedCount; i++ {
-		_, err := br.Exec()
-		if err != nil {
-			fmt.Println("insertRoutes() - Unable to insert data: ", err)
-		}
+	tx, err := pg.db.Begin(ctx)
+	if err != nil {
+		routesLog.Error("Unable to begin transaction for routes", "error", err)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	staging, err := copyToStaging(ctx, tx, "route_data", columns, rows)
+	if err != nil {
+		routesLog.Error("Unable to insert routes", "error", err)
+		return
+	}
+
+	insertStatement := `
+		INSERT INTO route_data (` + strings.Join(columns, ", ") + `)
+		SELECT DISTINCT ON (route_callsign) ` + strings.Join(columns, ", ") + `
+		FROM ` + staging + `
+		ORDER BY route_callsign
+		ON CONFLICT (route_callsign)
+		DO UPDATE SET
+			route_callsign = EXCLUDED.route_callsign,
+			route_callsign_icao = EXCLUDED.route_callsign_icao,
+			route_callsign_iata = EXCLUDED.route_callsign_iata,
+			airline_name = EXCLUDED.airline_name,
+			airline_icao = EXCLUDED.airline_icao,
+			airline_iata = EXCLUDED.airline_iata,
+			origin_country_iso_name = EXCLUDED.origin_country_iso_name,
+			origin_country_name = EXCLUDED.origin_country_name,
+			origin_elevation = EXCLUDED.origin_elevation,
+			origin_iata_code = EXCLUDED.origin_iata_code,
+			origin_icao_code = EXCLUDED.origin_icao_code,
+			origin_latitude = EXCLUDED.origin_latitude,
+			origin_longitude = EXCLUDED.origin_longitude,
+			origin_municipality = EXCLUDED.origin_municipality,
+			origin_name = EXCLUDED.origin_name,
+			destination_country_iso_name = EXCLUDED.destination_country_iso_name,
+			destination_country_name = EXCLUDED.destination_country_name,
+			destination_elevation = EXCLUDED.destination_elevation,
+			destination_iata_code = EXCLUDED.destination_iata_code,
+			destination_icao_code = EXCLUDED.destination_icao_code,
+			destination_latitude = EXCLUDED.destination_latitude,
+			destination_longitude = EXCLUDED.destination_longitude,
+			destination_municipality = EXCLUDED.destination_municipality,
+			destination_name = EXCLUDED.destination_name,
+			last_updated = EXCLUDED.last_updated,
+			route_distance = EXCLUDED.route_distance`
+
+	if _, err := tx.Exec(ctx, insertStatement); err != nil {
+		routesLog.Error("Unable to insert routes", "error", err)
+		return
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		routesLog.Error("Unable to insert routes", "error", err)
+	}
+}
+
+// The callsign as the airline's IATA code and flight number, e.g. BA123 for
+// BAW123, which is how ACARS messages give the flight. Empty if the airline
+// has no IATA code.
+func routeCallsignIata(route RouteInfo, airline data.Airline) string {
+
+	if len(airline.IATA) != 2 {
+		return ""
+	}
+
+	number := route.Number
+	if number == "" {
+		number = strings.TrimPrefix(route.Callsign, route.AirlineCode)
+	}
+	if number == "" || number == route.Callsign {
+		return ""
 	}
 
+	return normaliseFlightNumber(airline.IATA + number)
 }
 
 func buildRouteApiRequestBody(aircrafts []Aircraft) RouteAPIRequest {
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Allowed on top of a run's timeout before a job counts as stalled
+const jobHealthSlack = 10 * time.Second
+
+var (
+	errUnknownJob = errors.New("unknown job")
+	errJobRunning = errors.New("job is already running")
+)
+
+// A background job, run every Interval plus up to Jitter, so jobs on the same
+// interval don't all hit the database at once. Each run gets a context that is
+// cancelled after Timeout. Writes already started are finished regardless,
+// see writeContext, so the timeout bounds reads and lookups.
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Jitter   time.Duration
+	Timeout  time.Duration
+	Run      func(ctx context.Context) error
+
+	trigger chan struct{}
+
+	mu     sync.Mutex
+	status JobStatus
+	// When the last run finished, or when the scheduler started, see Healthy
+	finished time.Time
+}
+
+type JobStatus struct {
+	Name            string     `json:"name"`
+	IntervalSeconds float64    `json:"interval_seconds"`
+	JitterSeconds   float64    `json:"jitter_seconds"`
+	TimeoutSeconds  float64    `json:"timeout_seconds"`
+	Running         bool       `json:"running"`
+	Runs            int        `json:"runs"`
+	Failures        int        `json:"failures"`
+	LastRun         *time.Time `json:"last_run"`
+	LastDurationMs  float64    `json:"last_duration_ms"`
+	LastError       string     `json:"last_error"`
+	NextRun         *time.Time `json:"next_run"`
+}
+
+// Runs each job in its own goroutine, so a slow job (e.g. waiting on adsbdb)
+// doesn't hold up the others. A job never overlaps with itself.
+type Scheduler struct {
+	jobs []*Job
+	wg   sync.WaitGroup
+}
+
+var scheduler *Scheduler
+
+// A job run as often as set in its jobs section of the config
+func NewJob(name string, jobConfig JobConfig, run func(ctx context.Context) error) *Job {
+
+	job := &Job{
+		Name:     name,
+		Interval: seconds(jobConfig.Interval),
+		Jitter:   seconds(jobConfig.Jitter),
+		Timeout:  seconds(jobConfig.Timeout),
+		Run:      run,
+		trigger:  make(chan struct{}, 1),
+	}
+
+	job.status = JobStatus{
+		Name:            job.Name,
+		IntervalSeconds: jobConfig.Interval,
+		JitterSeconds:   jobConfig.Jitter,
+		TimeoutSeconds:  jobConfig.Timeout,
+	}
+
+	return job
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+func NewScheduler(jobs ...*Job) *Scheduler {
+	return &Scheduler{jobs: jobs}
+}
+
+// Starts every job. They stop once ctx is cancelled, see Wait.
+func (s *Scheduler) Start(ctx context.Context) {
+	for _, job := range s.jobs {
+		job.mu.Lock()
+		job.finished = time.Now()
+		job.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.loop(ctx, job)
+	}
+}
+
+// Waits for runs in progress to finish after the context passed to Start has
+// been cancelled
+func (s *Scheduler) Wait() {
+	s.wg.Wait()
+}
+
+// Runs a job now, rather than waiting for its next interval
+func (s *Scheduler) Trigger(name string) error {
+
+	for _, job := range s.jobs {
+		if job.Name != name {
+			continue
+		}
+
+		job.mu.Lock()
+		running := job.status.Running
+		job.mu.Unlock()
+		if running {
+			return errJobRunning
+		}
+
+		// Already triggered and about to run otherwise
+		select {
+		case job.trigger <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+
+	return errUnknownJob
+}
+
+func (s *Scheduler) Status() []JobStatus {
+
+	statuses := make([]JobStatus, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		job.mu.Lock()
+		statuses = append(statuses, job.status)
+		job.mu.Unlock()
+	}
+
+	return statuses
+}
+
+// Whether a job is still completing runs: one has finished within its
+// interval, jitter and timeout of the one before (or of starting). A run that
+// hangs, ignoring its context, makes the job unhealthy. A run that fails
+// doesn't, see the returned status for that.
+func (s *Scheduler) Healthy(name string) (JobStatus, bool) {
+
+	for _, job := range s.jobs {
+		if job.Name != name {
+			continue
+		}
+
+		job.mu.Lock()
+		defer job.mu.Unlock()
+
+		window := job.Interval + job.Jitter + job.Timeout + jobHealthSlack
+		return job.status, time.Since(job.finished) < window
+	}
+
+	return JobStatus{}, false
+}
+
+func (s *Scheduler) loop(ctx context.Context, job *Job) {
+
+	defer s.wg.Done()
+
+	timer := time.NewTimer(job.schedule(time.Now()))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-job.trigger:
+		}
+
+		start := time.Now()
+		job.run(ctx)
+
+		// Runs that take longer than the interval start again straight away,
+		// rather than queueing up the ticks they missed
+		timer.Reset(job.schedule(start))
+	}
+}
+
+// Sets the next run to an interval (plus jitter) after start, and returns
+// how long that is from now
+func (job *Job) schedule(start time.Time) time.Duration {
+
+	next := start.Add(job.Interval)
+	if job.Jitter > 0 {
+		next = next.Add(rand.N(job.Jitter))
+	}
+
+	job.mu.Lock()
+	job.status.NextRun = &next
+	job.mu.Unlock()
+
+	return max(time.Until(next), 0)
+}
+
+func (job *Job) run(ctx context.Context) {
+
+	start := time.Now()
+	jobsLog.Debug("Running job", "job", job.Name)
+
+	job.mu.Lock()
+	job.status.Running = true
+	job.status.NextRun = nil
+	job.mu.Unlock()
+
+	runCtx, cancel := context.WithTimeout(ctx, job.Timeout)
+	err := job.runSafely(runCtx)
+	cancel()
+
+	if err == nil && runCtx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %v", job.Timeout)
+	}
+
+	duration := time.Since(start)
+	if err != nil {
+		jobsLog.Warn("Job failed", "job", job.Name, "duration", duration, "error", err)
+	} else {
+		jobsLog.Debug("Job finished", "job", job.Name, "duration", duration)
+	}
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	job.finished = time.Now()
+	job.status.Running = false
+	job.status.Runs++
+	job.status.LastRun = &start
+	job.status.LastDurationMs = float64(duration.Microseconds()) / 1000
+	job.status.LastError = ""
+	if err != nil {
+		job.status.Failures++
+		job.status.LastError = err.Error()
+	}
+}
+
+// A panic fails the run rather than taking down every other job with it
+func (job *Job) runSafely(ctx context.Context) (err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return job.Run(ctx)
+}
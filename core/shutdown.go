@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// How long skystats waits for in-flight work to finish when it is stopped
+func getShutdownTimeout() time.Duration {
+	return time.Duration(config.ShutdownTimeout * float64(time.Second))
+}
+
+// Returns the root context, which is cancelled on SIGINT or SIGTERM. Once it
+// has been, skystats has SHUTDOWN_TIMEOUT to finish up before it exits
+// regardless, and a second signal exits straight away.
+func shutdownContext() context.Context {
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-ctx.Done()
+		stop()
+
+		timeout := getShutdownTimeout()
+		slog.Info("Shutting down, waiting for in-flight work to finish", "timeout", timeout)
+
+		time.Sleep(timeout)
+		slog.Error("Timed out shutting down, exiting")
+		os.Exit(1)
+	}()
+
+	return ctx
+}
+
+// Writes that have started carry on after a shutdown has been requested, so
+// batches aren't cut off half way through. They are still bounded by
+// SHUTDOWN_TIMEOUT.
+func writeContext(ctx context.Context) context.Context {
+	return context.WithoutCancel(ctx)
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spoolPrefix       = "spool-"
+	spoolSuffix       = ".seg"
+	spoolPositionFile = "spool.pos"
+	spoolSegmentSize  = 16 * 1024 * 1024
+	spoolPingTimeout  = 5 * time.Second
+)
+
+// Spool buffers snapshots on disk while postgres can't be reached, and
+// writes them to the database in order once it is back.
+//
+// Snapshots are appended to segment files, spool-000001.seg, spool-000002.seg
+// and so on, each record a 4 byte length followed by the gob encoded
+// snapshot. How far the oldest segment has been replayed is kept in spool.pos,
+// so a restart carries on where it left off. Segments are deleted once
+// replayed, or oldest first when the spool grows past its size cap.
+type Spool struct {
+	dir      string
+	maxBytes int64
+	// Stops replaying when cancelled
+	ctx context.Context
+
+	mu        sync.Mutex
+	segments  []int
+	file      *os.File
+	bytes     int64
+	pending   int
+	oldestNow float64
+	draining  bool
+	dropped   int
+	lastError string
+}
+
+type spooledSnapshot struct {
+	Now      float64
+	Aircraft []Aircraft
+}
+
+type SpoolStatus struct {
+	Enabled   bool       `json:"enabled"`
+	Dir       string     `json:"dir,omitempty"`
+	Segments  int        `json:"segments"`
+	Bytes     int64      `json:"bytes"`
+	MaxBytes  int64      `json:"max_bytes"`
+	Pending   int        `json:"pending_snapshots"`
+	OldestNow *time.Time `json:"oldest_snapshot"`
+	Draining  bool       `json:"draining"`
+	Dropped   int        `json:"dropped_snapshots"`
+	LastError string     `json:"last_error,omitempty"`
+
+	DatabaseAvailable bool `json:"database_available"`
+}
+
+// Set at startup by getSpool, nil if spooling is disabled
+var spool *Spool
+
+// Spooling is enabled by setting SPOOL_DIR. SPOOL_MAX_MB caps its size,
+// default 512. Replaying stops when ctx is cancelled.
+func getSpool(ctx context.Context) (*Spool, error) {
+
+	dir := config.Spool.Dir
+	if dir == "" {
+		return nil, nil
+	}
+
+	s, err := NewSpool(dir, config.Spool.MaxMb*1024*1024)
+	if err != nil {
+		return nil, err
+	}
+	s.ctx = ctx
+
+	ingestLog.Info("Spooling snapshots while the database is unavailable", "dir", dir, "pending", s.pending)
+
+	return s, nil
+}
+
+func NewSpool(dir string, maxBytes int64) (*Spool, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Error creating spool directory: %w", err)
+	}
+
+	s := &Spool{dir: dir, maxBytes: maxBytes, ctx: context.Background()}
+
+	segments, err := listSpoolSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	s.segments = segments
+
+	// Count what's left over from before a restart
+	if err := s.count(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Works out the size of the backlog from the segments on disk. Called with
+// the lock held, or before the spool is in use.
+func (s *Spool) count() error {
+
+	s.bytes = 0
+	s.pending = 0
+	s.oldestNow = 0
+
+	segment, offset := s.readPosition()
+	for _, seq := range s.segments {
+		start := int64(0)
+		if seq == segment {
+			start = offset
+		}
+		info, err := os.Stat(s.segmentPath(seq))
+		if err != nil {
+			return err
+		}
+		s.bytes += info.Size()
+		s.readSegment(seq, start, func(snapshot spooledSnapshot, _ int64) bool {
+			if s.pending == 0 {
+				s.oldestNow = snapshot.Now
+			}
+			s.pending++
+			return true
+		})
+	}
+
+	return nil
+}
+
+// Writes a snapshot to the database, or to the spool if the database can't
+// be reached or earlier snapshots are still waiting in the spool. Returns an
+// error if the snapshot was neither written nor spooled.
+func storeSnapshot(ctx context.Context, pg *postgres, nowEpoch float64, aircrafts []Aircraft) error {
+
+	writeCtx := writeContext(ctx)
+
+	if spool == nil {
+		if err := pg.updateDatabase(writeCtx, nowEpoch, aircrafts); err != nil {
+			return fmt.Errorf("unable to write snapshot: %w", err)
+		}
+		return nil
+	}
+
+	// The ping saves waiting on each query in turn while postgres is down
+	if spool.empty() && pingDatabase(writeCtx, pg) == nil {
+		err := pg.updateDatabase(writeCtx, nowEpoch, aircrafts)
+		if err == nil {
+			return nil
+		}
+		ingestLog.Warn("Unable to write snapshot, spooling it", "error", err)
+	}
+
+	if err := spool.Append(spooledSnapshot{Now: nowEpoch, Aircraft: aircrafts}); err != nil {
+		return fmt.Errorf("unable to spool snapshot: %w", err)
+	}
+
+	spool.startDrain(pg)
+	return nil
+}
+
+func pingDatabase(ctx context.Context, pg *postgres) error {
+	ctx, cancel := context.WithTimeout(ctx, spoolPingTimeout)
+	defer cancel()
+	return pg.Ping(ctx)
+}
+
+func (s *Spool) empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending == 0
+}
+
+func (s *Spool) Append(snapshot spooledSnapshot) error {
+
+	var encoded bytes.Buffer
+	if err := gob.NewEncoder(&encoded).Encode(snapshot); err != nil {
+		return err
+	}
+
+	record := make([]byte, 4, 4+encoded.Len())
+	binary.BigEndian.PutUint32(record, uint32(encoded.Len()))
+	record = append(record, encoded.Bytes()...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.rotate(); err != nil {
+		s.lastError = err.Error()
+		return err
+	}
+
+	if _, err := s.file.Write(record); err != nil {
+		s.lastError = err.Error()
+		return err
+	}
+
+	if s.pending == 0 {
+		s.oldestNow = snapshot.Now
+	}
+	s.pending++
+	s.bytes += int64(len(record))
+
+	s.enforceCap()
+
+	return nil
+}
+
+// Opens a new segment when there isn't one, or the current one is full
+func (s *Spool) rotate() error {
+
+	if s.file != nil {
+		info, err := s.file.Stat()
+		if err == nil && info.Size() < spoolSegmentSize {
+			return nil
+		}
+		s.file.Close()
+		s.file = nil
+	}
+
+	seq := 1
+	if len(s.segments) > 0 {
+		seq = s.segments[len(s.segments)-1] + 1
+	}
+
+	file, err := os.OpenFile(s.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Error opening spool segment: %w", err)
+	}
+
+	s.file = file
+	s.segments = append(s.segments, seq)
+
+	return nil
+}
+
+// Drops the oldest segments, never the one being written, until the spool
+// fits under its cap again
+func (s *Spool) enforceCap() {
+
+	for s.bytes > s.maxBytes && len(s.segments) > 1 {
+
+		seq := s.segments[0]
+		path := s.segmentPath(seq)
+
+		start := int64(0)
+		if segment, offset := s.readPosition(); segment == seq {
+			start = offset
+		}
+
+		dropped := 0
+		s.readSegment(seq, start, func(spooledSnapshot, int64) bool {
+			dropped++
+			return true
+		})
+		info, err := os.Stat(path)
+		if err != nil {
+			break
+		}
+
+		if err := os.Remove(path); err != nil {
+			s.lastError = err.Error()
+			break
+		}
+
+		s.segments = s.segments[1:]
+		s.bytes -= info.Size()
+		s.pending -= dropped
+		s.dropped += dropped
+		ingestLog.Warn("Spool full, dropped the oldest snapshots", "max_bytes", s.maxBytes, "dropped", dropped, "file", path)
+	}
+}
+
+// Replays the spool in the background, unless that's already happening, until
+// it is empty or skystats is shutting down
+func (s *Spool) startDrain(pg *postgres) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.draining {
+		return
+	}
+	s.draining = true
+
+	go s.drain(s.ctx, pg)
+}
+
+// Writes spooled snapshots to the database oldest first, stopping if the
+// database goes away again. New snapshots keep being spooled until it has
+// caught up, so everything is written in order.
+func (s *Spool) drain(ctx context.Context, pg *postgres) {
+
+	defer func() {
+		s.mu.Lock()
+		s.draining = false
+		s.mu.Unlock()
+	}()
+
+	writeCtx := writeContext(ctx)
+
+	for ctx.Err() == nil {
+		if err := pingDatabase(writeCtx, pg); err != nil {
+			s.mu.Lock()
+			s.lastError = err.Error()
+			s.mu.Unlock()
+			return
+		}
+
+		s.mu.Lock()
+		if len(s.segments) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		seq := s.segments[0]
+		last := len(s.segments) == 1
+		s.mu.Unlock()
+
+		segment, offset := s.readPosition()
+		if segment != seq {
+			offset = 0
+		}
+
+		replayed := 0
+		failed := false
+		err := s.readSegment(seq, offset, func(snapshot spooledSnapshot, next int64) bool {
+			if ctx.Err() != nil {
+				failed = true
+				return false
+			}
+			// Left in the spool, to be tried again on the next drain
+			if err := pg.updateDatabase(writeCtx, snapshot.Now, snapshot.Aircraft); err != nil {
+				s.mu.Lock()
+				s.lastError = err.Error()
+				s.mu.Unlock()
+				failed = true
+				return false
+			}
+			s.writePosition(seq, next)
+
+			s.mu.Lock()
+			// The cap may have dropped this segment from under us
+			if s.pending > 0 {
+				s.pending--
+			}
+			s.oldestNow = snapshot.Now
+			s.mu.Unlock()
+
+			replayed++
+			return true
+		})
+		corrupt := err != nil
+		if corrupt {
+			ingestLog.Warn("Skipping the rest of a spool segment", "error", err)
+		}
+
+		if replayed > 0 {
+			ingestLog.Info("Replayed spooled snapshots", "replayed", replayed, "file", s.segmentPath(seq))
+		}
+		if failed {
+			return
+		}
+
+		s.mu.Lock()
+		// The segment being written is only finished with once nothing else
+		// has been appended to it
+		if last && !corrupt {
+			info, statErr := os.Stat(s.segmentPath(seq))
+			segment, offset := s.readPosition()
+			if statErr == nil && segment == seq && offset < info.Size() {
+				s.mu.Unlock()
+				continue
+			}
+			if s.file != nil {
+				s.file.Close()
+				s.file = nil
+			}
+		}
+		s.removeSegment(seq)
+		if corrupt {
+			s.lastError = err.Error()
+			s.count()
+		}
+		if s.pending == 0 {
+			s.oldestNow = 0
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Deletes a replayed segment. Called with the lock held.
+func (s *Spool) removeSegment(seq int) {
+
+	path := s.segmentPath(seq)
+	if info, err := os.Stat(path); err == nil {
+		s.bytes -= info.Size()
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		s.lastError = err.Error()
+	}
+
+	for i, segment := range s.segments {
+		if segment == seq {
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			break
+		}
+	}
+
+	os.Remove(filepath.Join(s.dir, spoolPositionFile))
+}
+
+// Calls fn with each snapshot from offset onwards, and the offset of the
+// record after it, until fn returns false. A record cut short by a crash
+// ends the segment.
+func (s *Spool) readSegment(seq int, offset int64, fn func(snapshot spooledSnapshot, next int64) bool) error {
+
+	file, err := os.Open(s.segmentPath(seq))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, 4)
+
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return nil
+		}
+
+		length := binary.BigEndian.Uint32(header)
+		record := make([]byte, length)
+		if _, err := io.ReadFull(reader, record); err != nil {
+			return nil
+		}
+
+		var snapshot spooledSnapshot
+		if err := gob.NewDecoder(bytes.NewReader(record)).Decode(&snapshot); err != nil {
+			return fmt.Errorf("corrupt record in %s: %w", s.segmentPath(seq), err)
+		}
+
+		offset += int64(4 + length)
+		if !fn(snapshot, offset) {
+			return nil
+		}
+	}
+}
+
+func (s *Spool) readPosition() (int, int64) {
+
+	data, err := os.ReadFile(filepath.Join(s.dir, spoolPositionFile))
+	if err != nil {
+		return 0, 0
+	}
+
+	var segment int
+	var offset int64
+	if _, err := fmt.Sscanf(string(data), "%d %d", &segment, &offset); err != nil {
+		return 0, 0
+	}
+
+	return segment, offset
+}
+
+func (s *Spool) writePosition(segment int, offset int64) {
+
+	path := filepath.Join(s.dir, spoolPositionFile)
+	temp := path + ".tmp"
+
+	if err := os.WriteFile(temp, []byte(fmt.Sprintf("%d %d\n", segment, offset)), 0644); err != nil {
+		ingestLog.Error("Error saving spool position", "error", err)
+		return
+	}
+	if err := os.Rename(temp, path); err != nil {
+		ingestLog.Error("Error saving spool position", "error", err)
+	}
+}
+
+func (s *Spool) segmentPath(seq int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s%06d%s", spoolPrefix, seq, spoolSuffix))
+}
+
+func listSpoolSegments(dir string) ([]int, error) {
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []int
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, spoolPrefix) || !strings.HasSuffix(name, spoolSuffix) {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, spoolPrefix), spoolSuffix))
+		if err == nil {
+			segments = append(segments, seq)
+		}
+	}
+	sort.Ints(segments)
+
+	return segments, nil
+}
+
+func (s *Spool) Status() SpoolStatus {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := SpoolStatus{
+		Enabled:   true,
+		Dir:       s.dir,
+		Segments:  len(s.segments),
+		Bytes:     s.bytes,
+		MaxBytes:  s.maxBytes,
+		Pending:   s.pending,
+		Draining:  s.draining,
+		Dropped:   s.dropped,
+		LastError: s.lastError,
+	}
+
+	if s.pending > 0 && s.oldestNow > 0 {
+		oldest := time.UnixMilli(int64(s.oldestNow * 1000))
+		status.OldestNow = &oldest
+	}
+
+	return status
+}
+
+func (s *Spool) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+}
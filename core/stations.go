@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultStationName = "default"
+
+// A named receiver, e.g. one of several Pis feeding the same database
+type Station struct {
+	Name   string
+	Source AircraftSource
+}
+
+// StationsSource polls every station concurrently and merges their snapshots,
+// so the same aircraft heard by several receivers is recorded once, with all
+// of the stations that saw it.
+type StationsSource struct {
+	stations []Station
+	// How long each station has to answer, from READSB_FETCH_TIMEOUT_SECONDS.
+	// Stations that are slower are left out of that snapshot, so one that is
+	// unreachable doesn't hold up the others.
+	timeout time.Duration
+}
+
+// Builds the list of stations from READSB_SOURCES, a comma separated list of
+// name=url pairs, e.g.
+//
+//	home=http://pi1:8080/data/aircraft.json,garden=sbs://pi2:30003,roof=beast://pi3:30005
+//
+// UAT traffic from dump978 can be added as another station, e.g.
+//
+//	uat=uat+http://pi1:8978/data/aircraft.json
+//
+// If READSB_SOURCES is not set, a single station called "default" is created
+// from READSB_SBS, READSB_BEAST or READSB_AIRCRAFT_JSON.
+//
+// aircraft.json payloads are archived by the recorder, if one is given, and
+// streams are read until ctx is done.
+func NewAircraftSource(ctx context.Context, recorder *Recorder) (*StationsSource, error) {
+
+	sources := config.Readsb.Sources
+	timeout := time.Duration(config.Readsb.FetchTimeoutSeconds * float64(time.Second))
+
+	if sources == "" {
+		var source AircraftSource
+		if addr := config.Readsb.Sbs; addr != "" {
+			source = startStream(ctx, NewSBSSource(addr))
+		} else if addr := config.Readsb.Beast; addr != "" {
+			source = startStream(ctx, NewBeastSource(addr))
+		} else {
+			source = &aircraftJsonSource{
+				url:      config.Readsb.AircraftJson,
+				station:  defaultStationName,
+				recorder: recorder,
+			}
+		}
+		return &StationsSource{stations: []Station{{Name: defaultStationName, Source: source}}, timeout: timeout}, nil
+	}
+
+	var stations []Station
+	names := make(map[string]bool)
+
+	for _, entry := range strings.Split(sources, ",") {
+
+		name, url, found := strings.Cut(strings.TrimSpace(entry), "=")
+		name = strings.TrimSpace(name)
+		url = strings.TrimSpace(url)
+
+		if !found || name == "" || url == "" {
+			return nil, fmt.Errorf("invalid READSB_SOURCES entry %q, expected name=url", entry)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("duplicate station name %q in READSB_SOURCES", name)
+		}
+		names[name] = true
+
+		source, err := newSourceFromUrl(ctx, name, url, recorder)
+		if err != nil {
+			return nil, fmt.Errorf("station %q: %w", name, err)
+		}
+
+		stations = append(stations, Station{Name: name, Source: source})
+	}
+
+	return &StationsSource{stations: stations, timeout: timeout}, nil
+}
+
+// http(s):// is polled as aircraft.json, uat+http(s):// as dump978's
+// aircraft.json, and sbs:// and beast:// are streamed
+func newSourceFromUrl(ctx context.Context, name string, url string, recorder *Recorder) (AircraftSource, error) {
+
+	switch {
+	case strings.HasPrefix(url, "http://"), strings.HasPrefix(url, "https://"):
+		return &aircraftJsonSource{url: url, station: name, recorder: recorder}, nil
+	case strings.HasPrefix(url, "uat+http://"), strings.HasPrefix(url, "uat+https://"):
+		return &uatSource{url: strings.TrimPrefix(url, "uat+"), station: name, recorder: recorder}, nil
+	case strings.HasPrefix(url, "sbs://"):
+		return startStream(ctx, NewSBSSource(strings.TrimPrefix(url, "sbs://"))), nil
+	case strings.HasPrefix(url, "beast://"):
+		return startStream(ctx, NewBeastSource(strings.TrimPrefix(url, "beast://"))), nil
+	}
+
+	return nil, fmt.Errorf("unsupported source %q, expected http://, https://, uat+http://, uat+https://, sbs:// or beast://", url)
+}
+
+type streamSource interface {
+	AircraftSource
+	Run(ctx context.Context)
+}
+
+// Streams until ctx, the root context, is done
+func startStream(ctx context.Context, source streamSource) AircraftSource {
+	go source.Run(ctx)
+	return source
+}
+
+func (s *StationsSource) StationNames() []string {
+	names := make([]string, 0, len(s.stations))
+	for _, station := range s.stations {
+		names = append(names, station.Name)
+	}
+	return names
+}
+
+func (s *StationsSource) Snapshot(ctx context.Context) (*Response, error) {
+
+	snapshots := make([]*Response, len(s.stations))
+	errs := make([]error, len(s.stations))
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	type result struct {
+		i        int
+		snapshot *Response
+		err      error
+	}
+
+	// Buffered, so a station that answers after the deadline doesn't block
+	results := make(chan result, len(s.stations))
+	for i, station := range s.stations {
+		go func(i int, station Station) {
+			snapshot, err := station.Source.Snapshot(ctx)
+			results <- result{i: i, snapshot: snapshot, err: err}
+		}(i, station)
+	}
+
+	for i := range errs {
+		errs[i] = fmt.Errorf("no answer within %v", s.timeout)
+	}
+
+collect:
+	for pending := len(s.stations); pending > 0; pending-- {
+		select {
+		case r := <-results:
+			snapshots[r.i], errs[r.i] = r.snapshot, r.err
+		case <-ctx.Done():
+			break collect
+		}
+	}
+
+	merged := &Response{}
+	aircraftByHex := make(map[string]*Aircraft)
+	failed := 0
+
+	for i, snapshot := range snapshots {
+
+		if errs[i] != nil || snapshot == nil {
+			ingestLog.Warn("Error fetching data", "station", s.stations[i].Name, "error", errs[i])
+			failed++
+			continue
+		}
+
+		if snapshot.Now > merged.Now {
+			merged.Now = snapshot.Now
+		}
+		merged.Messages += snapshot.Messages
+
+		for _, aircraft := range snapshot.Aircraft {
+			aircraft.Stations = []string{s.stations[i].Name}
+			if existing, ok := aircraftByHex[aircraft.Hex]; ok {
+				mergeSighting(existing, aircraft)
+			} else {
+				a := aircraft
+				aircraftByHex[aircraft.Hex] = &a
+			}
+		}
+	}
+
+	if failed == len(s.stations) {
+		return nil, fmt.Errorf("no station returned data")
+	}
+
+	for _, aircraft := range aircraftByHex {
+		sort.Strings(aircraft.Stations)
+		merged.Aircraft = append(merged.Aircraft, *aircraft)
+	}
+
+	return merged, nil
+}
+
+// Merges a second station's view of the same aircraft. The freshest record
+// wins, apart from the position which comes from the freshest position, and
+// the callsign which is kept if only one station has decoded it.
+func mergeSighting(existing *Aircraft, other Aircraft) {
+
+	stations := append(existing.Stations, other.Stations...)
+	datalinks := mergeDatalinks(aircraftDatalinks(*existing), aircraftDatalinks(other))
+
+	existingHasPosition := existing.HasPosition()
+	otherHasPosition := other.HasPosition()
+
+	lat, lon, seenPos := existing.Lat, existing.Lon, existing.SeenPos
+	if otherHasPosition && (!existingHasPosition || other.SeenPos < existing.SeenPos) {
+		lat, lon, seenPos = other.Lat, other.Lon, other.SeenPos
+	}
+
+	flight := existing.Flight
+	if other.Seen < existing.Seen {
+		*existing = other
+	}
+	if existing.Flight == "" {
+		existing.Flight = flight
+	}
+
+	existing.Lat, existing.Lon, existing.SeenPos = lat, lon, seenPos
+	existing.Stations = stations
+	existing.Datalinks = datalinks
+}
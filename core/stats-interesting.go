@@ -8,16 +8,19 @@ import (
 	"github.com/jackc/pgx/v5"
 )
 
-func updateInterestingSeen(pg *postgres) {
+func updateInterestingSeen(ctx context.Context, pg *postgres) error {
 
-	aircrafts := unprocessedInteresting(pg)
+	aircrafts, err := unprocessedInteresting(ctx, pg)
+	if err != nil {
+		return err
+	}
 
 	if len(aircrafts) == 0 {
-		return
+		return nil
 	}
 
-	if len(aircrafts) > 1000 {
-		aircrafts = aircrafts[:1000]
+	if len(aircrafts) > config.Interesting.BatchSize {
+		aircrafts = aircrafts[:config.Interesting.BatchSize]
 	}
 
 	aircraftsMap := make(map[string]Aircraft)
@@ -48,11 +51,10 @@ func updateInterestingSeen(pg *postgres) {
 		FROM interesting_aircraft
 		WHERE icao = ANY($1::text[])`
 
-	rows, err := pg.db.Query(context.Background(), query, aircraftsHex)
+	rows, err := pg.db.Query(ctx, query, aircraftsHex)
 
 	if err != nil {
-		fmt.Println("updateInterestingSeen() - Error querying db: ", err)
-		return
+		return fmt.Errorf("Error querying interesting aircraft: %w", err)
 	}
 
 	defer rows.Close()
@@ -80,7 +82,7 @@ func updateInterestingSeen(pg *postgres) {
 		)
 
 		if err != nil {
-			fmt.Println("updateInterestingSeen() - Error scanning rows: ", err)
+			interestingLog.Error("Error scanning interesting aircraft", "error", err)
 			continue
 		}
 
@@ -101,8 +103,8 @@ func updateInterestingSeen(pg *postgres) {
 			interestingAircraft.Tas = aircraft.Tas
 			interestingAircraft.Track = aircraft.Track
 			interestingAircraft.BaroRate = aircraft.BaroRate
-			interestingAircraft.Lat = aircraft.Lat
-			interestingAircraft.Lon = aircraft.Lon
+			interestingAircraft.Lat = sightingCoordinate(aircraft, aircraft.Lat)
+			interestingAircraft.Lon = sightingCoordinate(aircraft, aircraft.Lon)
 			interestingAircraft.Alert = aircraft.Alert
 			interestingAircraft.DbFlags = aircraft.DbFlags
 			interestingAircraft.Seen = aircraft.FirstSeen
@@ -110,7 +112,7 @@ func updateInterestingSeen(pg *postgres) {
 		}
 	}
 
-	fmt.Println("Interesting aircrafts found: ", len(interestingAircrafts))
+	interestingLog.Debug("Interesting aircraft found", "count", len(interestingAircrafts))
 
 	batch := &pgx.Batch{}
 
@@ -189,21 +191,25 @@ func updateInterestingSeen(pg *postgres) {
 			aircraft.SeenEpoch)
 	}
 
-	br := pg.db.SendBatch(context.Background(), batch)
+	// Finish writing once started, even if shutting down
+	ctx = writeContext(ctx)
+
+	br := pg.db.SendBatch(ctx, batch)
 	defer br.Close()
 
 	for i := 0; i < len(interestingAircrafts); i++ {
 		_, err := br.Exec()
 		if err != nil {
-			fmt.Println("insertRegistrations() - Unable to insert data: ", err)
+			interestingLog.Error("Unable to insert interesting sighting", "hex", interestingAircrafts[i].Hex, "flight", interestingAircrafts[i].Flight, "error", err)
 		}
 	}
 
-	MarkProcessed(pg, "interesting_processed", aircrafts)
+	MarkProcessed(ctx, pg, "interesting_processed", aircrafts)
 
+	return nil
 }
 
-func unprocessedInteresting(pg *postgres) []Aircraft {
+func unprocessedInteresting(ctx context.Context, pg *postgres) ([]Aircraft, error) {
 
 	query := `
 		SELECT id,
@@ -218,8 +224,8 @@ func unprocessedInteresting(pg *postgres) []Aircraft {
 				tas,
 				track,
 				baro_rate,
-				lat,
-				lon,
+				COALESCE(lat, 0),
+				COALESCE(lon, 0),
 				alert,
 				db_flags,
 				first_seen,
@@ -227,14 +233,14 @@ func unprocessedInteresting(pg *postgres) []Aircraft {
 		FROM aircraft_data
 		WHERE
 			hex != '' AND
+			address_type = 'icao' AND
 			interesting_processed = false
 		ORDER BY first_seen ASC`
 
-	rows, err := pg.db.Query(context.Background(), query)
+	rows, err := pg.db.Query(ctx, query)
 
 	if err != nil {
-		fmt.Println("unprocessedInteresting() - Error querying db: ", err)
-		return nil
+		return nil, fmt.Errorf("Error querying unprocessed interesting aircraft: %w", err)
 	}
 
 	defer rows.Close()
@@ -267,13 +273,12 @@ func unprocessedInteresting(pg *postgres) []Aircraft {
 		)
 
 		if err != nil {
-			fmt.Println("unprocessedInteresting() - Error scanning rows: ", err)
-			return nil
+			return nil, fmt.Errorf("Error scanning unprocessed interesting aircraft: %w", err)
 		}
 
 		aircrafts = append(aircrafts, aircraft)
 	}
 
-	fmt.Println("Aircrafts that have not have interesting processed: ", len(aircrafts))
-	return aircrafts
+	interestingLog.Debug("Sessions without interesting processed", "count", len(aircrafts))
+	return aircrafts, nil
 }
@@ -4,7 +4,7 @@ import (
 	"context"
 )
 
-func getHighestAircraftFloor(pg *postgres) int {
+func getHighestAircraftFloor(ctx context.Context, pg *postgres) int {
 
 	var returnValue int
 	defaultValue := 0
@@ -14,7 +14,7 @@ func getHighestAircraftFloor(pg *postgres) int {
 				ORDER BY barometric_altitude ASC, first_seen ASC
 				LIMIT 1`
 
-	err := pg.db.QueryRow(context.Background(), query).Scan(&returnValue)
+	err := pg.db.QueryRow(ctx, query).Scan(&returnValue)
 	if err == nil {
 		return returnValue
 	} else {
@@ -22,7 +22,7 @@ func getHighestAircraftFloor(pg *postgres) int {
 	}
 }
 
-func getLowestAircraftCeiling(pg *postgres) int {
+func getLowestAircraftCeiling(ctx context.Context, pg *postgres) int {
 
 	var returnValue int
 	defaultValue := 999999
@@ -32,7 +32,7 @@ func getLowestAircraftCeiling(pg *postgres) int {
 				ORDER BY barometric_altitude DESC, first_seen ASC
 				LIMIT 1`
 
-	err := pg.db.QueryRow(context.Background(), query).Scan(&returnValue)
+	err := pg.db.QueryRow(ctx, query).Scan(&returnValue)
 	if err == nil {
 		return returnValue
 	} else {
@@ -40,7 +40,7 @@ func getLowestAircraftCeiling(pg *postgres) int {
 	}
 }
 
-func getFastestAircraftFloor(pg *postgres) float64 {
+func getFastestAircraftFloor(ctx context.Context, pg *postgres) float64 {
 
 	var returnValue float64
 	defaultValue := 0.0
@@ -50,7 +50,7 @@ func getFastestAircraftFloor(pg *postgres) float64 {
 				ORDER BY ground_speed ASC, first_seen ASC
 				LIMIT 1`
 
-	err := pg.db.QueryRow(context.Background(), query).Scan(&returnValue)
+	err := pg.db.QueryRow(ctx, query).Scan(&returnValue)
 	if err == nil {
 		return returnValue
 	} else {
@@ -58,7 +58,7 @@ func getFastestAircraftFloor(pg *postgres) float64 {
 	}
 }
 
-func getSlowestAircraftCeiling(pg *postgres) float64 {
+func getSlowestAircraftCeiling(ctx context.Context, pg *postgres) float64 {
 
 	var returnValue float64
 	defaultValue := 99999.0
@@ -68,7 +68,7 @@ func getSlowestAircraftCeiling(pg *postgres) float64 {
 				ORDER BY ground_speed DESC, first_seen ASC
 				LIMIT 1`
 
-	err := pg.db.QueryRow(context.Background(), query).Scan(&returnValue)
+	err := pg.db.QueryRow(ctx, query).Scan(&returnValue)
 	if err == nil {
 		return returnValue
 	} else {
@@ -8,18 +8,28 @@ import (
 	"github.com/jackc/pgx/v5"
 )
 
-func updateMeasurementStatistics(pg *postgres) {
+func updateMeasurementStatistics(ctx context.Context, pg *postgres) error {
 
-	aircrafts := getAircraftsForMeasurementStatistics(pg)
+	aircrafts, err := getAircraftsForMeasurementStatistics(ctx, pg)
+	if err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 
-	updateLowestAircraft(pg, aircrafts)
-	updateFastestAircraft(pg, aircrafts)
-	updateHighestAircraft(pg, aircrafts)
-	updateSlowestAircraft(pg, aircrafts)
+	// Finish writing once started, even if shutting down
+	ctx = writeContext(ctx)
 
+	updateLowestAircraft(ctx, pg, aircrafts)
+	updateFastestAircraft(ctx, pg, aircrafts)
+	updateHighestAircraft(ctx, pg, aircrafts)
+	updateSlowestAircraft(ctx, pg, aircrafts)
+
+	return nil
 }
 
-func updateLowestAircraft(pg *postgres, aircrafts []Aircraft) {
+func updateLowestAircraft(ctx context.Context, pg *postgres, aircrafts []Aircraft) {
 	processedMetricName := "lowest_aircraft_processed"
 	tableName := "lowest_aircraft"
 	metricName := "barometric_altitude"
@@ -36,19 +46,21 @@ func updateLowestAircraft(pg *postgres, aircrafts []Aircraft) {
 		return
 	}
 
-	lowestAircraftCeiling := getLowestAircraftCeiling(pg)
+	aircraftWithMetric := withAltitude(aircraftToProcess)
+
+	lowestAircraftCeiling := getLowestAircraftCeiling(ctx, pg)
 
-	sort.Slice(aircraftToProcess, func(i, j int) bool {
-		return aircraftToProcess[i].AltBaro < aircraftToProcess[j].AltBaro
+	sort.Slice(aircraftWithMetric, func(i, j int) bool {
+		return aircraftWithMetric[i].AltBaro.Int64 < aircraftWithMetric[j].AltBaro.Int64
 	})
 
 	var aircraftsToInsert []Aircraft
 
-	for _, aircraft := range aircraftToProcess {
-		if aircraft.AltBaro < 1 {
+	for _, aircraft := range aircraftWithMetric {
+		if aircraft.AltBaro.Int64 < 1 {
 			continue
 		}
-		if aircraft.AltBaro < lowestAircraftCeiling {
+		if aircraft.AltBaro.Int64 < int64(lowestAircraftCeiling) {
 			aircraftsToInsert = append(aircraftsToInsert, aircraft)
 		} else {
 			break
@@ -88,24 +100,24 @@ func updateLowestAircraft(pg *postgres, aircrafts []Aircraft) {
 			aircraft.AltGeom)
 	}
 
-	br := pg.db.SendBatch(context.Background(), batch)
+	br := pg.db.SendBatch(ctx, batch)
 	defer br.Close()
 
 	for i := 0; i < len(aircraftsToInsert); i++ {
 		_, err := br.Exec()
 		if err != nil {
-			fmt.Println("updateLowestAircraft() - Unable to insert data: ", err)
+			motionLog.Error("Unable to insert lowest aircraft", "error", err)
 		}
 	}
-	DeleteExcessRows(pg, tableName, metricName, "DESC", 50)
+	DeleteExcessRows(ctx, pg, tableName, metricName, "DESC", config.Statistics.KeepRows)
 
 	if len(aircraftToProcess) > 0 {
-		MarkProcessed(pg, processedMetricName, aircraftToProcess)
+		MarkProcessed(ctx, pg, processedMetricName, aircraftToProcess)
 	}
 
 }
 
-func updateHighestAircraft(pg *postgres, aircrafts []Aircraft) {
+func updateHighestAircraft(ctx context.Context, pg *postgres, aircrafts []Aircraft) {
 
 	processedMetricName := "highest_aircraft_processed"
 	tableName := "highest_aircraft"
@@ -123,16 +135,18 @@ func updateHighestAircraft(pg *postgres, aircrafts []Aircraft) {
 		return
 	}
 
-	highestAircraftFloor := getHighestAircraftFloor(pg)
+	aircraftWithMetric := withAltitude(aircraftToProcess)
 
-	sort.Slice(aircraftToProcess, func(i, j int) bool {
-		return aircraftToProcess[i].AltBaro > aircraftToProcess[j].AltBaro
+	highestAircraftFloor := getHighestAircraftFloor(ctx, pg)
+
+	sort.Slice(aircraftWithMetric, func(i, j int) bool {
+		return aircraftWithMetric[i].AltBaro.Int64 > aircraftWithMetric[j].AltBaro.Int64
 	})
 
 	var aircraftsToInsert []Aircraft
 
-	for _, aircraft := range aircraftToProcess {
-		if aircraft.AltBaro > highestAircraftFloor {
+	for _, aircraft := range aircraftWithMetric {
+		if aircraft.AltBaro.Int64 > int64(highestAircraftFloor) {
 			aircraftsToInsert = append(aircraftsToInsert, aircraft)
 		} else {
 			break
@@ -172,24 +186,24 @@ func updateHighestAircraft(pg *postgres, aircrafts []Aircraft) {
 			aircraft.AltGeom)
 	}
 
-	br := pg.db.SendBatch(context.Background(), batch)
+	br := pg.db.SendBatch(ctx, batch)
 	defer br.Close()
 
 	for i := 0; i < len(aircraftsToInsert); i++ {
 		_, err := br.Exec()
 		if err != nil {
-			fmt.Println("updateHighestAircraft() - Unable to insert data: ", err)
+			motionLog.Error("Unable to insert highest aircraft", "error", err)
 		}
 	}
 
-	DeleteExcessRows(pg, tableName, metricName, "ASC", 50)
+	DeleteExcessRows(ctx, pg, tableName, metricName, "ASC", config.Statistics.KeepRows)
 
 	if len(aircraftToProcess) > 0 {
-		MarkProcessed(pg, processedMetricName, aircraftToProcess)
+		MarkProcessed(ctx, pg, processedMetricName, aircraftToProcess)
 	}
 }
 
-func updateSlowestAircraft(pg *postgres, aircrafts []Aircraft) {
+func updateSlowestAircraft(ctx context.Context, pg *postgres, aircrafts []Aircraft) {
 
 	processedMetricName := "slowest_aircraft_processed"
 	tableName := "slowest_aircraft"
@@ -207,20 +221,22 @@ func updateSlowestAircraft(pg *postgres, aircrafts []Aircraft) {
 		return
 	}
 
-	slowestAircraftCeiling := getSlowestAircraftCeiling(pg)
+	aircraftWithMetric := withGroundSpeed(aircraftToProcess)
+
+	slowestAircraftCeiling := getSlowestAircraftCeiling(ctx, pg)
 
-	sort.Slice(aircraftToProcess, func(i, j int) bool {
-		return aircraftToProcess[i].Gs < aircraftToProcess[j].Gs
+	sort.Slice(aircraftWithMetric, func(i, j int) bool {
+		return aircraftWithMetric[i].Gs.Float64 < aircraftWithMetric[j].Gs.Float64
 	})
 
 	var aircraftsToInsert []Aircraft
 
-	for _, aircraft := range aircraftToProcess {
-		if aircraft.Gs < 1 {
+	for _, aircraft := range aircraftWithMetric {
+		if aircraft.Gs.Float64 < 1 {
 			continue
 		}
 
-		if aircraft.Gs < slowestAircraftCeiling {
+		if aircraft.Gs.Float64 < slowestAircraftCeiling {
 			aircraftsToInsert = append(aircraftsToInsert, aircraft)
 		} else {
 			break
@@ -263,24 +279,24 @@ func updateSlowestAircraft(pg *postgres, aircrafts []Aircraft) {
 			aircraft.Ias)
 	}
 
-	br := pg.db.SendBatch(context.Background(), batch)
+	br := pg.db.SendBatch(ctx, batch)
 	defer br.Close()
 
 	for i := 0; i < len(aircraftsToInsert); i++ {
 		_, err := br.Exec()
 		if err != nil {
-			fmt.Println("updateSlowestAircraft() - Unable to insert data: ", err)
+			motionLog.Error("Unable to insert slowest aircraft", "error", err)
 		}
 	}
 
-	DeleteExcessRows(pg, tableName, metricName, "DESC", 50)
+	DeleteExcessRows(ctx, pg, tableName, metricName, "DESC", config.Statistics.KeepRows)
 
 	if len(aircraftToProcess) > 0 {
-		MarkProcessed(pg, processedMetricName, aircraftToProcess)
+		MarkProcessed(ctx, pg, processedMetricName, aircraftToProcess)
 	}
 }
 
-func updateFastestAircraft(pg *postgres, aircrafts []Aircraft) {
+func updateFastestAircraft(ctx context.Context, pg *postgres, aircrafts []Aircraft) {
 
 	processedMetricName := "fastest_aircraft_processed"
 	tableName := "fastest_aircraft"
@@ -298,16 +314,18 @@ func updateFastestAircraft(pg *postgres, aircrafts []Aircraft) {
 		return
 	}
 
-	fastestAircraftFloor := getFastestAircraftFloor(pg)
+	aircraftWithMetric := withGroundSpeed(aircraftToProcess)
 
-	sort.Slice(aircraftToProcess, func(i, j int) bool {
-		return aircraftToProcess[i].Gs > aircraftToProcess[j].Gs
+	fastestAircraftFloor := getFastestAircraftFloor(ctx, pg)
+
+	sort.Slice(aircraftWithMetric, func(i, j int) bool {
+		return aircraftWithMetric[i].Gs.Float64 > aircraftWithMetric[j].Gs.Float64
 	})
 
 	var aircraftsToInsert []Aircraft
 
-	for _, aircraft := range aircraftToProcess {
-		if aircraft.Gs > fastestAircraftFloor {
+	for _, aircraft := range aircraftWithMetric {
+		if aircraft.Gs.Float64 > fastestAircraftFloor {
 			aircraftsToInsert = append(aircraftsToInsert, aircraft)
 		} else {
 			break
@@ -350,24 +368,46 @@ func updateFastestAircraft(pg *postgres, aircrafts []Aircraft) {
 			aircraft.Ias)
 	}
 
-	br := pg.db.SendBatch(context.Background(), batch)
+	br := pg.db.SendBatch(ctx, batch)
 	defer br.Close()
 
 	for i := 0; i < len(aircraftsToInsert); i++ {
 		_, err := br.Exec()
 		if err != nil {
-			fmt.Println("updateFastestAircraft() - Unable to insert data: ", err)
+			motionLog.Error("Unable to insert fastest aircraft", "error", err)
 		}
 	}
 
-	DeleteExcessRows(pg, tableName, metricName, "ASC", 50)
+	DeleteExcessRows(ctx, pg, tableName, metricName, "ASC", config.Statistics.KeepRows)
 
 	if len(aircraftToProcess) > 0 {
-		MarkProcessed(pg, processedMetricName, aircraftToProcess)
+		MarkProcessed(ctx, pg, processedMetricName, aircraftToProcess)
+	}
+}
+
+// Aircraft that never reported an altitude or speed are still marked as
+// processed, but can't place in the tables
+func withAltitude(aircrafts []Aircraft) []Aircraft {
+	var filtered []Aircraft
+	for _, aircraft := range aircrafts {
+		if aircraft.AltBaro.Valid {
+			filtered = append(filtered, aircraft)
+		}
+	}
+	return filtered
+}
+
+func withGroundSpeed(aircrafts []Aircraft) []Aircraft {
+	var filtered []Aircraft
+	for _, aircraft := range aircrafts {
+		if aircraft.Gs.Valid {
+			filtered = append(filtered, aircraft)
+		}
 	}
+	return filtered
 }
 
-func getAircraftsForMeasurementStatistics(pg *postgres) []Aircraft {
+func getAircraftsForMeasurementStatistics(ctx context.Context, pg *postgres) ([]Aircraft, error) {
 
 	query := `SELECT id, hex, flight, r, t, first_seen, last_seen, alt_baro, alt_geom, gs, ias, tas, 
 				lowest_aircraft_processed, highest_aircraft_processed, fastest_aircraft_processed, slowest_aircraft_processed
@@ -377,10 +417,9 @@ func getAircraftsForMeasurementStatistics(pg *postgres) []Aircraft {
 					fastest_aircraft_processed = false OR
 					slowest_aircraft_processed = false`
 
-	rows, err := pg.db.Query(context.Background(), query)
+	rows, err := pg.db.Query(ctx, query)
 	if err != nil {
-		fmt.Println("getAircraftsForMeasurementStatistics() - Error querying db: ", err)
-		return nil
+		return nil, fmt.Errorf("Error querying aircraft for statistics: %w", err)
 	}
 	defer rows.Close()
 
@@ -409,12 +448,11 @@ func getAircraftsForMeasurementStatistics(pg *postgres) []Aircraft {
 			&aircraft.SlowestProcessed)
 
 		if err != nil {
-			fmt.Println("getAircraftsForMeasurementStatistics() - Error scanning rows: ", err)
-			return nil
+			return nil, fmt.Errorf("Error scanning aircraft for statistics: %w", err)
 		}
 		aircrafts = append(aircrafts, aircraft)
 	}
 
-	fmt.Println("Aircrafts that have not have statistics processed: ", len(aircrafts))
-	return aircrafts
+	motionLog.Debug("Sessions without statistics processed", "count", len(aircrafts))
+	return aircrafts, nil
 }
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sends a state, e.g. READY=1, to systemd when running as a Type=notify
+// service. Does nothing when NOTIFY_SOCKET isn't set, i.e. outside of systemd.
+func sdNotify(state string) error {
+
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// An abstract socket
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("Error connecting to systemd: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("Error notifying systemd: %w", err)
+	}
+
+	return nil
+}
+
+// How often systemd expects WATCHDOG=1 (WatchdogSec in the unit), or 0 if
+// the watchdog isn't enabled for this process
+func watchdogInterval() time.Duration {
+
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Pings the watchdog at half its interval for as long as the aircraft job
+// keeps completing runs. If it stalls, e.g. on a readsb that stops responding
+// mid request, the pings stop and systemd restarts skystats. Failed runs
+// (readsb or postgres down) don't stop the pings, as a restart wouldn't fix
+// them, but are shown in systemctl status.
+func runWatchdog(ctx context.Context, interval time.Duration) {
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	lastState := ""
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		status, healthy := scheduler.Healthy("aircraft")
+
+		state := "STATUS=Recording aircraft"
+		if status.LastError != "" {
+			state = "STATUS=Unable to update aircraft: " + status.LastError
+		}
+		if !healthy {
+			state = "STATUS=Aircraft updates have stalled"
+		}
+
+		if state != lastState {
+			lastState = state
+			if !healthy {
+				jobsLog.Warn("Aircraft updates have stalled, no longer pinging the systemd watchdog")
+			}
+		}
+
+		if healthy {
+			state += "\nWATCHDOG=1"
+		}
+		if err := sdNotify(state); err != nil {
+			slog.Warn("Unable to notify systemd", "error", err)
+		}
+	}
+}
+
+// Prints a systemd unit that runs skystats in the foreground from where it is
+// now, as the current user, with the same -config and -env-file, e.g.
+//
+//	./skystats systemd-unit | sudo tee /etc/systemd/system/skystats.service
+func runSystemdUnit(args []string) int {
+
+	flags := commandFlags("systemd-unit", "[-user name] [-watchdog seconds]")
+	username := ""
+	if current, err := user.Current(); err == nil {
+		username = current.Username
+	}
+	runAs := flags.String("user", username, "user to run skystats as")
+	watchdog := flags.Int("watchdog", 60, "seconds without a completed aircraft update before systemd restarts skystats, 0 disables the watchdog")
+	if code, ok := parseCommand(flags, args, 0, 0); !ok {
+		return code
+	}
+
+	execPath, err := os.Executable()
+	if err == nil {
+		execPath, err = filepath.EvalSymlinks(execPath)
+	}
+	if err != nil {
+		slog.Error("Error finding the skystats executable", "error", err)
+		return exitFailed
+	}
+
+	command := []string{execPath, "serve", "-foreground"}
+	if configFile != "" {
+		command = append(command, "-config", configFile)
+	}
+	if envFile != "" {
+		if abs, err := filepath.Abs(envFile); err == nil {
+			command = append(command, "-env-file", abs)
+		}
+	}
+	for i, arg := range command {
+		command[i] = systemdQuote(arg)
+	}
+
+	fmt.Printf(`[Unit]
+Description=Skystats
+Documentation=https://github.com/tomcarman/skystats
+Wants=network-online.target
+After=network-online.target postgresql.service
+
+[Service]
+Type=notify
+NotifyAccess=main
+ExecStart=%s
+WorkingDirectory=%s
+`, strings.Join(command, " "), strings.ReplaceAll(filepath.Dir(execPath), "%", "%%"))
+
+	if *runAs != "" {
+		fmt.Printf("User=%s\n", *runAs)
+	}
+	if *watchdog > 0 {
+		fmt.Printf("WatchdogSec=%d\n", *watchdog)
+	}
+
+	// Looking up the receiver location and plane-alert-db can take a while
+	fmt.Printf(`TimeoutStartSec=300
+TimeoutStopSec=%d
+Restart=on-failure
+RestartSec=10
+# Bad arguments and invalid configuration won't be fixed by restarting
+RestartPreventExitStatus=%d %d
+
+[Install]
+WantedBy=multi-user.target
+`, int(config.ShutdownTimeout)+10, exitUsage, exitConfig)
+
+	return exitOK
+}
+
+// Quotes a word of ExecStart if it needs it. % starts a specifier in units.
+func systemdQuote(word string) string {
+	word = strings.ReplaceAll(word, "%", "%%")
+	if !strings.ContainsAny(word, " \t\"'\\") {
+		return word
+	}
+	return strconv.Quote(word)
+}
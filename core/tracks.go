@@ -0,0 +1,275 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+const feetToMetres = 0.3048
+
+type trackSession struct {
+	Id        int       `json:"id"`
+	Hex       string    `json:"hex"`
+	Flight    string    `json:"flight"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// Returns the track flown during one aircraft_data session, as a GeoJSON
+// LineString (the default), KML or GPX, chosen with ?format=. 404s if no
+// positions were recorded for it.
+func (s *APIServer) getSessionTrack(c *gin.Context) {
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session id"})
+		return
+	}
+
+	format := c.DefaultQuery("format", "geojson")
+	if format != "geojson" && format != "kml" && format != "gpx" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid format. Use 'geojson', 'kml' or 'gpx'"})
+		return
+	}
+
+	var session trackSession
+	query := `SELECT id, hex, COALESCE(flight, ''), first_seen, last_seen FROM aircraft_data WHERE id = $1`
+	err = s.pg.db.QueryRow(c.Request.Context(), query, id).Scan(
+		&session.Id, &session.Hex, &session.Flight, &session.FirstSeen, &session.LastSeen)
+	if err == pgx.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	points, err := getSessionTrack(c.Request.Context(), s.pg, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(points) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No positions recorded for this session"})
+		return
+	}
+
+	filename := fmt.Sprintf("%s-%d.%s", session.Hex, session.Id, format)
+	c.Header("Content-Disposition", fmt.Sprintf("inline; filename=%q", filename))
+
+	switch format {
+	case "kml":
+		writeXml(c, "application/vnd.google-earth.kml+xml", trackKml(session, points))
+	case "gpx":
+		writeXml(c, "application/gpx+xml", trackGpx(session, points))
+	default:
+		c.Header("Content-Type", "application/geo+json")
+		c.JSON(http.StatusOK, trackGeoJson(session, points))
+	}
+}
+
+// Barometric altitude where known, falling back to geometric, in metres
+func trackPointAltitude(point trackPoint) (float64, bool) {
+	if point.altBaro.Valid {
+		return math.Round(float64(point.altBaro.Int64)*feetToMetres*10) / 10, true
+	}
+	if point.altGeom.Valid {
+		return math.Round(float64(point.altGeom.Int64)*feetToMetres*10) / 10, true
+	}
+	return 0, false
+}
+
+func trackName(session trackSession) string {
+	if session.Flight != "" {
+		return session.Flight
+	}
+	return session.Hex
+}
+
+// A single Feature, with per point times, altitudes (feet), speeds and
+// tracks alongside the coordinates, as togeojson does for coordTimes. A
+// LineString needs two positions, so a session with one is a Point.
+func trackGeoJson(session trackSession, points []trackPoint) gin.H {
+
+	coordinates := make([][]float64, 0, len(points))
+	times := make([]time.Time, 0, len(points))
+	altitudes := make([]*int64, 0, len(points))
+	speeds := make([]*float64, 0, len(points))
+	tracks := make([]*float64, 0, len(points))
+	sources := make([]string, 0, len(points))
+
+	for _, point := range points {
+		coordinates = append(coordinates, []float64{point.lon, point.lat})
+		times = append(times, point.time)
+		altitudes = append(altitudes, nullIntPointer(point.altBaro))
+		speeds = append(speeds, nullFloatPointer(point.gs))
+		tracks = append(tracks, nullFloatPointer(point.track))
+		sources = append(sources, point.source)
+	}
+
+	geometry := gin.H{
+		"type":        "LineString",
+		"coordinates": coordinates,
+	}
+	if len(coordinates) == 1 {
+		geometry = gin.H{
+			"type":        "Point",
+			"coordinates": coordinates[0],
+		}
+	}
+
+	return gin.H{
+		"type":     "Feature",
+		"geometry": geometry,
+		"properties": gin.H{
+			"id":         session.Id,
+			"hex":        session.Hex,
+			"flight":     session.Flight,
+			"first_seen": session.FirstSeen,
+			"last_seen":  session.LastSeen,
+			"coordTimes": times,
+			"alt_baro":   altitudes,
+			"gs":         speeds,
+			"track":      tracks,
+			"source":     sources,
+		},
+	}
+}
+
+type kmlDocument struct {
+	XMLName   xml.Name     `xml:"kml"`
+	Namespace string       `xml:"xmlns,attr"`
+	Placemark kmlPlacemark `xml:"Document>Placemark"`
+}
+
+type kmlPlacemark struct {
+	Name        string        `xml:"name"`
+	Description string        `xml:"description"`
+	LineString  kmlLineString `xml:"LineString"`
+}
+
+type kmlLineString struct {
+	AltitudeMode string `xml:"altitudeMode"`
+	Coordinates  string `xml:"coordinates"`
+}
+
+// KML can't mix 2D and 3D coordinates, so altitudes are only used when every
+// point has one
+func trackKml(session trackSession, points []trackPoint) kmlDocument {
+
+	hasAltitudes := len(points) > 0
+	for _, point := range points {
+		if _, ok := trackPointAltitude(point); !ok {
+			hasAltitudes = false
+			break
+		}
+	}
+
+	altitudeMode := "clampToGround"
+	if hasAltitudes {
+		altitudeMode = "absolute"
+	}
+
+	coordinates := make([]string, 0, len(points))
+	for _, point := range points {
+		coordinate := strconv.FormatFloat(point.lon, 'f', -1, 64) + "," + strconv.FormatFloat(point.lat, 'f', -1, 64)
+		if hasAltitudes {
+			altitude, _ := trackPointAltitude(point)
+			coordinate += "," + strconv.FormatFloat(altitude, 'f', 1, 64)
+		}
+		coordinates = append(coordinates, coordinate)
+	}
+
+	return kmlDocument{
+		Namespace: "http://www.opengis.net/kml/2.2",
+		Placemark: kmlPlacemark{
+			Name:        trackName(session),
+			Description: fmt.Sprintf("%s seen %s to %s", session.Hex, session.FirstSeen.UTC().Format(time.RFC3339), session.LastSeen.UTC().Format(time.RFC3339)),
+			LineString: kmlLineString{
+				AltitudeMode: altitudeMode,
+				Coordinates:  strings.Join(coordinates, " "),
+			},
+		},
+	}
+}
+
+type gpxDocument struct {
+	XMLName   xml.Name `xml:"gpx"`
+	Namespace string   `xml:"xmlns,attr"`
+	Version   string   `xml:"version,attr"`
+	Creator   string   `xml:"creator,attr"`
+	Track     gpxTrack `xml:"trk"`
+}
+
+type gpxTrack struct {
+	Name   string     `xml:"name"`
+	Points []gpxPoint `xml:"trkseg>trkpt"`
+}
+
+type gpxPoint struct {
+	Lat       float64  `xml:"lat,attr"`
+	Lon       float64  `xml:"lon,attr"`
+	Elevation *float64 `xml:"ele,omitempty"`
+	Time      string   `xml:"time"`
+}
+
+func trackGpx(session trackSession, points []trackPoint) gpxDocument {
+
+	gpxPoints := make([]gpxPoint, 0, len(points))
+	for _, point := range points {
+		gpxPoint := gpxPoint{
+			Lat:  point.lat,
+			Lon:  point.lon,
+			Time: point.time.UTC().Format(time.RFC3339),
+		}
+		if altitude, ok := trackPointAltitude(point); ok {
+			gpxPoint.Elevation = &altitude
+		}
+		gpxPoints = append(gpxPoints, gpxPoint)
+	}
+
+	return gpxDocument{
+		Namespace: "http://www.topografix.com/GPX/1/1",
+		Version:   "1.1",
+		Creator:   "skystats",
+		Track: gpxTrack{
+			Name:   trackName(session),
+			Points: gpxPoints,
+		},
+	}
+}
+
+func writeXml(c *gin.Context, contentType string, document any) {
+
+	body, err := xml.MarshalIndent(document, "", "  ")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Data(http.StatusOK, contentType, append([]byte(xml.Header), body...))
+}
+
+func nullIntPointer(value sql.NullInt64) *int64 {
+	if !value.Valid {
+		return nil
+	}
+	return &value.Int64
+}
+
+func nullFloatPointer(value sql.NullFloat64) *float64 {
+	if !value.Valid {
+		return nil
+	}
+	return &value.Float64
+}
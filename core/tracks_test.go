@@ -0,0 +1,36 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTrackGeoJsonGeometry(t *testing.T) {
+
+	session := trackSession{Id: 1, Hex: "4ca7b5"}
+	start := time.Unix(1700000000, 0)
+	points := []trackPoint{
+		{time: start, lat: 51.47, lon: -0.4543},
+		{time: start.Add(15 * time.Second), lat: 51.48, lon: -0.4},
+	}
+
+	for _, test := range []struct {
+		points          []trackPoint
+		wantType        string
+		wantCoordinates any
+	}{
+		{points, "LineString", [][]float64{{-0.4543, 51.47}, {-0.4, 51.48}}},
+		{points[:1], "Point", []float64{-0.4543, 51.47}},
+	} {
+		geometry := trackGeoJson(session, test.points)["geometry"].(gin.H)
+		if geometry["type"] != test.wantType {
+			t.Errorf("%d points: type = %v, want %s", len(test.points), geometry["type"], test.wantType)
+		}
+		if !reflect.DeepEqual(geometry["coordinates"], test.wantCoordinates) {
+			t.Errorf("%d points: coordinates = %v, want %v", len(test.points), geometry["coordinates"], test.wantCoordinates)
+		}
+	}
+}
@@ -1,10 +1,6 @@
 package main
 
-import (
-	"flag"
-	"fmt"
-	"os"
-)
+import "flag"
 
 // injected by goreleaser on build
 var (
@@ -14,11 +10,6 @@ var (
 	showVersion bool
 )
 
-func showVersionExit() {
-	fmt.Printf("skystats %s (commit %s) build %s\n", version, commit, date)
-	os.Exit(0)
-}
-
 func init() {
 	flag.BoolVar(&showVersion, "version", false, "display version")
 	flag.BoolVar(&showVersion, "v", false, "display version")
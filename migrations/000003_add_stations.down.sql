@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_aircraft_data_stations;
+ALTER TABLE aircraft_data DROP COLUMN stations;
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TABLE aircraft_data ADD COLUMN stations TEXT[] DEFAULT '{}';
+CREATE INDEX idx_aircraft_data_stations ON aircraft_data USING gin (stations);
\ No newline at end of file
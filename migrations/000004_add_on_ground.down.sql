@@ -0,0 +1 @@
+ALTER TABLE aircraft_data DROP COLUMN on_ground;
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE aircraft_data ADD COLUMN on_ground BOOLEAN;
\ No newline at end of file
@@ -0,0 +1,13 @@
+ALTER TABLE aircraft_data
+    DROP COLUMN nav_altitude_fms,
+    DROP COLUMN oat,
+    DROP COLUMN tat,
+    DROP COLUMN wd,
+    DROP COLUMN ws,
+    DROP COLUMN rr_lat,
+    DROP COLUMN rr_lon,
+    DROP COLUMN last_position_lat,
+    DROP COLUMN last_position_lon,
+    DROP COLUMN last_position_nic,
+    DROP COLUMN last_position_rc,
+    DROP COLUMN last_position_seen_pos;
\ No newline at end of file
@@ -0,0 +1,13 @@
+ALTER TABLE aircraft_data
+    ADD COLUMN nav_altitude_fms INTEGER,
+    ADD COLUMN oat INTEGER,
+    ADD COLUMN tat INTEGER,
+    ADD COLUMN wd INTEGER,
+    ADD COLUMN ws INTEGER,
+    ADD COLUMN rr_lat NUMERIC(9,6),
+    ADD COLUMN rr_lon NUMERIC(9,6),
+    ADD COLUMN last_position_lat NUMERIC(9,6),
+    ADD COLUMN last_position_lon NUMERIC(9,6),
+    ADD COLUMN last_position_nic INTEGER,
+    ADD COLUMN last_position_rc INTEGER,
+    ADD COLUMN last_position_seen_pos NUMERIC(9,3);
\ No newline at end of file
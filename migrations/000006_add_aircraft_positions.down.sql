@@ -0,0 +1 @@
+DROP TABLE IF EXISTS aircraft_positions;
\ No newline at end of file
@@ -0,0 +1,14 @@
+CREATE TABLE aircraft_positions (
+    id BIGSERIAL PRIMARY KEY,
+    aircraft_id INTEGER NOT NULL REFERENCES aircraft_data(id) ON DELETE CASCADE,
+    time TIMESTAMPTZ NOT NULL,
+    lat NUMERIC(9,6) NOT NULL,
+    lon NUMERIC(9,6) NOT NULL,
+    alt_baro INTEGER,
+    alt_geom INTEGER,
+    gs NUMERIC(6,1),
+    track NUMERIC(5,2),
+    source VARCHAR
+);
+
+CREATE INDEX idx_aircraft_positions_aircraft_id_time ON aircraft_positions (aircraft_id, time);
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE aircraft_data DROP COLUMN mode_s_only;
\ No newline at end of file
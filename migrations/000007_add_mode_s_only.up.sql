@@ -0,0 +1 @@
+ALTER TABLE aircraft_data ADD COLUMN mode_s_only BOOLEAN DEFAULT false;
\ No newline at end of file
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_aircraft_data_datalinks;
+ALTER TABLE aircraft_data DROP COLUMN datalinks;
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TABLE aircraft_data ADD COLUMN datalinks TEXT[] DEFAULT '{1090}';
+CREATE INDEX idx_aircraft_data_datalinks ON aircraft_data USING gin (datalinks);
\ No newline at end of file
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_aircraft_data_r;
+DROP TABLE IF EXISTS acars_messages;
+ALTER TABLE aircraft_data DROP COLUMN out_time;
+ALTER TABLE aircraft_data DROP COLUMN off_time;
+ALTER TABLE aircraft_data DROP COLUMN on_time;
+ALTER TABLE aircraft_data DROP COLUMN in_time;
\ No newline at end of file
@@ -0,0 +1,30 @@
+CREATE TABLE acars_messages (
+    id SERIAL PRIMARY KEY,
+    aircraft_id INTEGER REFERENCES aircraft_data(id) ON DELETE SET NULL,
+    time TIMESTAMPTZ NOT NULL,
+    source VARCHAR,
+    freq NUMERIC(7,3),
+    hex VARCHAR,
+    registration VARCHAR,
+    flight VARCHAR,
+    mode VARCHAR,
+    label VARCHAR,
+    block_id VARCHAR,
+    msg_num VARCHAR,
+    text TEXT,
+    departure VARCHAR,
+    destination VARCHAR,
+    out_time TIMESTAMPTZ,
+    off_time TIMESTAMPTZ,
+    on_time TIMESTAMPTZ,
+    in_time TIMESTAMPTZ,
+    link_processed BOOLEAN DEFAULT false
+);
+CREATE INDEX idx_acars_messages_aircraft_id ON acars_messages USING btree (aircraft_id);
+CREATE INDEX idx_acars_messages_time ON acars_messages USING btree (time DESC);
+CREATE INDEX idx_acars_messages_unprocessed ON acars_messages USING btree (id) WHERE link_processed = false;
+CREATE INDEX idx_aircraft_data_r ON aircraft_data USING btree (r);
+ALTER TABLE aircraft_data ADD COLUMN out_time TIMESTAMPTZ;
+ALTER TABLE aircraft_data ADD COLUMN off_time TIMESTAMPTZ;
+ALTER TABLE aircraft_data ADD COLUMN on_time TIMESTAMPTZ;
+ALTER TABLE aircraft_data ADD COLUMN in_time TIMESTAMPTZ;
\ No newline at end of file
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_aircraft_positions_time;
+ALTER TABLE aircraft_data DROP COLUMN correlation_processed;
+ALTER TABLE aircraft_data DROP COLUMN correlated_hex;
+ALTER TABLE aircraft_data DROP COLUMN address_type;
\ No newline at end of file
@@ -0,0 +1,6 @@
+ALTER TABLE aircraft_data ADD COLUMN address_type VARCHAR DEFAULT 'icao';
+UPDATE aircraft_data SET address_type = 'trackfile' WHERE type = 'tisb_trackfile';
+UPDATE aircraft_data SET address_type = 'other' WHERE address_type = 'icao' AND (hex LIKE '~%' OR type LIKE '%\_other');
+ALTER TABLE aircraft_data ADD COLUMN correlated_hex VARCHAR;
+ALTER TABLE aircraft_data ADD COLUMN correlation_processed BOOLEAN DEFAULT false;
+CREATE INDEX idx_aircraft_positions_time ON aircraft_positions (time);
\ No newline at end of file
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_route_data_route_callsign_iata;
+DROP INDEX IF EXISTS idx_aircraft_data_flight_last_seen;
+DROP INDEX IF EXISTS idx_aircraft_data_r_last_seen;
+CREATE INDEX idx_aircraft_data_r ON aircraft_data USING btree (r);
\ No newline at end of file
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_aircraft_data_r;
+CREATE INDEX idx_aircraft_data_r_last_seen ON aircraft_data USING btree (r, last_seen DESC);
+CREATE INDEX idx_aircraft_data_flight_last_seen ON aircraft_data USING btree (flight, last_seen DESC);
+CREATE INDEX idx_route_data_route_callsign_iata ON route_data USING btree (route_callsign_iata);
\ No newline at end of file
@@ -0,0 +1,3 @@
+-- One way: the zero padding dropped from acars_messages.flight can't be
+-- restored, and route_callsign_iata is filled in by route lookups anyway.
+SELECT 1;
\ No newline at end of file
@@ -0,0 +1,10 @@
+-- Drops the zero padding from stored ACARS flight numbers, e.g. BA0123 to
+-- BA123, as they are now decoded, and fills in route_callsign_iata for routes
+-- already looked up, so both sides of the flight number link match.
+UPDATE acars_messages SET flight = regexp_replace(flight, '^([A-Z0-9]{2})0+([0-9])', '\1\2') WHERE flight ~ '^[A-Z0-9]{2}0+[0-9]';
+UPDATE route_data
+SET route_callsign_iata = regexp_replace(airline_iata || substring(route_callsign FROM length(airline_icao) + 1), '^([A-Z0-9]{2})0+([0-9])', '\1\2')
+WHERE route_callsign_iata IS NULL
+    AND length(airline_iata) = 2
+    AND length(route_callsign) > length(airline_icao)
+    AND route_callsign LIKE airline_icao || '%';
\ No newline at end of file
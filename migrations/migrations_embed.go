@@ -0,0 +1,9 @@
+package migrations
+
+import "embed"
+
+// The schema migrations, built into the binary so it can set up the database
+// without a checkout of the repository alongside it
+//
+//go:embed *.sql
+var FS embed.FS
@@ -0,0 +1,19 @@
+//go:build embedweb
+
+package web
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// Built by npm run build, which has to be run before go build -tags embedweb
+//
+//go:embed all:dist
+var dist embed.FS
+
+// The built web app, if it was built into the binary
+func Dist() (fs.FS, bool) {
+	app, err := fs.Sub(dist, "dist")
+	return app, err == nil
+}
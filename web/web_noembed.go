@@ -0,0 +1,11 @@
+//go:build !embedweb
+
+package web
+
+import "io/fs"
+
+// Built without -tags embedweb, so the web app is served from api.web_dir,
+// if set, or by something else, e.g. nginx in the docker image
+func Dist() (fs.FS, bool) {
+	return nil, false
+}